@@ -0,0 +1,148 @@
+// iCalendar feed of plant care due dates
+package app
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// CalendarTokenModel authorizes reading one user's calendar feed. Only a hash
+// of the token is stored; the token itself is shown to the user once.
+type CalendarTokenModel struct {
+	gorm.Model
+	UserID    uint       `json:"-" gorm:"index"`
+	TokenHash string     `json:"-" gorm:"uniqueIndex"`
+	RevokedAt *time.Time `json:"revokedAt"`
+}
+
+func hashCalendarToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateCalendarToken revokes any existing tokens of a user and issues a new one.
+func CreateCalendarToken(db *gorm.DB, userId uint) (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := RevokeCalendarTokens(tx, userId); err != nil {
+			return err
+		}
+		return tx.Create(&CalendarTokenModel{UserID: userId, TokenHash: hashCalendarToken(token)}).Error
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+func RevokeCalendarTokens(db *gorm.DB, userId uint) error {
+	return db.Model(&CalendarTokenModel{}).
+		Where("user_id = ? AND revoked_at IS NULL", userId).
+		Update("revoked_at", time.Now()).Error
+}
+
+// GetCalendarTokenOwner returns the ID of the user a live token belongs to.
+func GetCalendarTokenOwner(db *gorm.DB, token string) (uint, error) {
+	var calendarToken CalendarTokenModel
+	err := db.Where("token_hash = ? AND revoked_at IS NULL", hashCalendarToken(token)).First(&calendarToken).Error
+	if err != nil {
+		return 0, err
+	}
+	return calendarToken.UserID, nil
+}
+
+// escape text values per RFC 5545 3.3.11
+func icsEscape(value string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`)
+	return replacer.Replace(value)
+}
+
+// write a content line, folded at 75 octets per RFC 5545 3.1
+func icsLine(b *strings.Builder, line string) {
+	limit := 75
+	for len(line) > limit {
+		cut := limit
+		// don't split a UTF-8 sequence
+		for cut > 0 && line[cut]&0xC0 == 0x80 {
+			cut--
+		}
+		b.WriteString(line[:cut])
+		b.WriteString("\r\n ")
+		line = line[cut:]
+		// continuation lines start with a space
+		limit = 74
+	}
+	b.WriteString(line)
+	b.WriteString("\r\n")
+}
+
+func icsDate(t time.Time) string {
+	return t.Format("20060102")
+}
+
+// BuildCalendar renders the next watering and fertilizing of each plant as
+// an all-day event plus a to-do.
+func BuildCalendar(plants []PlantModel, now time.Time) string {
+	var b strings.Builder
+	icsLine(&b, "BEGIN:VCALENDAR")
+	icsLine(&b, "VERSION:2.0")
+	icsLine(&b, "PRODID:-//plantmindr//plant care//EN")
+	icsLine(&b, "CALSCALE:GREGORIAN")
+	icsLine(&b, "METHOD:PUBLISH")
+	icsLine(&b, "X-WR-CALNAME:Plantmindr")
+
+	stamp := now.UTC().Format("20060102T150405Z")
+	for i := range plants {
+		plant := &plants[i]
+		cares := []struct {
+			kind         string
+			verb         string
+			lastCareDate CareDate
+			intervalDays int
+		}{
+			{SCHEDULE_WATER, "Water", plant.LastWaterDate, plant.WateringFrequency},
+			{SCHEDULE_FERTILIZE, "Fertilize", plant.LastFertilizeDate, plant.FertilizingFrequency},
+		}
+		for _, care := range cares {
+			dueDate, ok := careDueDate(care.lastCareDate, care.intervalDays)
+			if !ok {
+				continue
+			}
+			summary := icsEscape(fmt.Sprintf("%s %s", care.verb, plant.Name))
+			description := icsEscape(fmt.Sprintf("Last done %s, every %d day(s).", care.lastCareDate, care.intervalDays))
+			uid := fmt.Sprintf("plant-%d-%s", plant.ID, care.kind)
+
+			icsLine(&b, "BEGIN:VEVENT")
+			icsLine(&b, "UID:"+uid+"-event@plantmindr.com")
+			icsLine(&b, "DTSTAMP:"+stamp)
+			icsLine(&b, "DTSTART;VALUE=DATE:"+icsDate(dueDate))
+			icsLine(&b, "DTEND;VALUE=DATE:"+icsDate(dueDate.AddDate(0, 0, 1)))
+			icsLine(&b, "SUMMARY:"+summary)
+			icsLine(&b, "DESCRIPTION:"+description)
+			icsLine(&b, "TRANSP:TRANSPARENT")
+			icsLine(&b, "END:VEVENT")
+
+			icsLine(&b, "BEGIN:VTODO")
+			icsLine(&b, "UID:"+uid+"-todo@plantmindr.com")
+			icsLine(&b, "DTSTAMP:"+stamp)
+			icsLine(&b, "DUE;VALUE=DATE:"+icsDate(dueDate))
+			icsLine(&b, "SUMMARY:"+summary)
+			icsLine(&b, "DESCRIPTION:"+description)
+			icsLine(&b, "STATUS:NEEDS-ACTION")
+			icsLine(&b, "END:VTODO")
+		}
+	}
+	icsLine(&b, "END:VCALENDAR")
+	return b.String()
+}
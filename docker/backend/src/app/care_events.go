@@ -0,0 +1,311 @@
+// structured history of care given to plants
+package app
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	EVENT_WATERED           = "watered"
+	EVENT_FERTILIZED        = "fertilized"
+	EVENT_SKIPPED_FERTILIZE = "skipped_fertilize"
+	EVENT_MOIST_CHECK       = "moist_check"
+	EVENT_REPOTTED          = "repotted"
+	EVENT_NOTE              = "note"
+)
+
+// how long care events are kept; zero keeps them forever. Care events are
+// deleted for good, whether they expire or their plant is deleted.
+var CARE_EVENT_RETENTION = 5 * 365 * 24 * time.Hour
+
+// how far ahead of ours a client's clock may run when logging care
+var CARE_EVENT_CLOCK_SKEW = 5 * time.Minute
+
+var DEFAULT_EVENT_PAGE_SIZE = 50
+var MAX_EVENT_PAGE_SIZE = 200
+
+type CareEventModel struct {
+	gorm.Model
+	PlantID    int       `json:"plantId" gorm:"index"`
+	Kind       string    `json:"kind"`
+	OccurredAt time.Time `json:"occurredAt" gorm:"index"`
+	// who gave the care, if they have an account
+	UserID uint `json:"userId,omitempty" gorm:"index"`
+	// their current username, filled in on reading; only stored for
+	// sitters without an account
+	Actor string `json:"actor"`
+	// optional quantity, e.g. millilitres of water or grams of fertilizer
+	Amount *float64 `json:"amount,omitempty"`
+	Note   string   `json:"note"`
+	// set on care logged by a plant sitter, and on notes about their access
+	GrantID uint `json:"grantId,omitempty" gorm:"index"`
+}
+
+type CareEventPage struct {
+	Events     []CareEventModel `json:"events"`
+	NextCursor string           `json:"nextCursor"`
+}
+
+func isValidCareEventKind(kind string) bool {
+	switch kind {
+	case EVENT_WATERED, EVENT_FERTILIZED, EVENT_SKIPPED_FERTILIZE, EVENT_MOIST_CHECK, EVENT_REPOTTED, EVENT_NOTE:
+		return true
+	}
+	return false
+}
+
+// InvalidCareEventError is returned for care events that can't be recorded as
+// given, as opposed to ones that failed to be stored.
+type InvalidCareEventError struct {
+	Reason string
+}
+
+func (e *InvalidCareEventError) Error() string {
+	return e.Reason
+}
+
+// validateLoggedCareEvent checks care logged directly by a client, which can
+// only be in the past.
+func validateLoggedCareEvent(event *CareEventModel) error {
+	if event.OccurredAt.After(time.Now().Add(CARE_EVENT_CLOCK_SKEW)) {
+		return &InvalidCareEventError{"Care can't be logged in the future."}
+	}
+	return nil
+}
+
+func AddCareEvent(db *gorm.DB, event *CareEventModel) error {
+	if !isValidCareEventKind(event.Kind) {
+		return &InvalidCareEventError{"Invalid care event kind."}
+	}
+	if event.PlantID == 0 {
+		return &InvalidCareEventError{"Invalid plant ID."}
+	}
+	if event.Amount != nil && *event.Amount < 0 {
+		return &InvalidCareEventError{"Invalid amount."}
+	}
+	if event.OccurredAt.IsZero() {
+		event.OccurredAt = time.Now()
+	}
+	return db.Create(event).Error
+}
+
+// careEventAt builds an event for a care date from the frontend, falling back
+// to now if the date is unset.
+func careEventAt(plant *PlantModel, kind string, careDate CareDate, actorId uint) *CareEventModel {
+	occurredAt := time.Now()
+	if careDate.Valid {
+		occurredAt = careDate.Time
+	}
+	return &CareEventModel{
+		PlantID:    int(plant.ID),
+		Kind:       kind,
+		OccurredAt: occurredAt,
+		UserID:     actorId,
+	}
+}
+
+// most plants one care action can be logged on at once
+var MAX_CARE_ACTION_PLANTS = 200
+
+// CareActionRequest logs one care action, on the plant in the URL or on each
+// of PlantIDs. OccurredAt defaults to now.
+type CareActionRequest struct {
+	Action     string    `json:"action"`
+	OccurredAt time.Time `json:"occurredAt"`
+	Amount     *float64  `json:"amount"`
+	Note       string    `json:"note"`
+	PlantIDs   []uint    `json:"plantIds"`
+}
+
+// care date each care action moves, and the reminder it resets
+var careActionColumns = map[string][2]string{
+	EVENT_WATERED:           {"last_water_date", "last_water_notify_date"},
+	EVENT_MOIST_CHECK:       {"last_moist_date", "last_water_notify_date"},
+	EVENT_FERTILIZED:        {"last_fertilize_date", "last_fertilize_notify_date"},
+	EVENT_SKIPPED_FERTILIZE: {"last_fertilize_date", "last_fertilize_notify_date"},
+}
+
+// isCareAction reports whether kind is care that moves one of a plant's care
+// dates, which can be logged on its own.
+func isCareAction(kind string) bool {
+	_, ok := careActionColumns[kind]
+	return ok
+}
+
+// RecordCareAction records care given to a plant as event, and moves the
+// plant's matching care date up to when it happened, resetting its reminder.
+// Care logged for before the plant's current date is only recorded, so
+// actions logged at the same time don't undo each other. The updated plant
+// is loaded into plant.
+//
+// Unlike edits, care actions don't check the plant's version: the update is
+// conditional on the care date instead, so it can't overwrite newer care and
+// two people caring for a plant at once both succeed. The version is still
+// bumped, so edits based on the plant from before the care are refused.
+func RecordCareAction(db *gorm.DB, plant *PlantModel, event *CareEventModel) error {
+	if !isCareAction(event.Kind) {
+		return &InvalidCareEventError{"Invalid care action."}
+	}
+	if event.OccurredAt.IsZero() {
+		event.OccurredAt = time.Now()
+	}
+	if err := validateLoggedCareEvent(event); err != nil {
+		return err
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		var current PlantModel
+		if err := tx.First(&current, plant.ID).Error; err != nil {
+			return err
+		}
+		columns := careActionColumns[event.Kind]
+		updates := map[string]interface{}{
+			columns[0]: NewCareDate(event.OccurredAt),
+			columns[1]: CareDate{},
+			"version":  gorm.Expr("version + 1"),
+		}
+		switch event.Kind {
+		case EVENT_WATERED:
+			// watering makes an earlier moist check moot, but not a later one
+			updates["last_moist_date"] = gorm.Expr("CASE WHEN last_moist_date < ? THEN NULL ELSE last_moist_date END", event.OccurredAt)
+			updates["last_moist_notify_date"] = gorm.Expr("CASE WHEN last_moist_date < ? THEN NULL ELSE last_moist_notify_date END", event.OccurredAt)
+		case EVENT_MOIST_CHECK:
+			updates["last_moist_notify_date"] = CareDate{}
+		case EVENT_FERTILIZED, EVENT_SKIPPED_FERTILIZE:
+			updates["skipped_last_fertilize"] = event.Kind == EVENT_SKIPPED_FERTILIZE
+		}
+		err := tx.Model(&PlantModel{}).
+			Where(fmt.Sprintf("id = ? AND (%s IS NULL OR %s < ?)", columns[0], columns[0]), current.ID, event.OccurredAt).
+			Updates(updates).Error
+		if err != nil {
+			return err
+		}
+		event.ID = 0
+		event.PlantID = int(current.ID)
+		if err := AddCareEvent(tx, event); err != nil {
+			return err
+		}
+		var updated PlantModel
+		if err := tx.First(&updated, current.ID).Error; err != nil {
+			return err
+		}
+		if err := saveCareDueDates(tx, &updated); err != nil {
+			return err
+		}
+		*plant = updated
+		return nil
+	})
+}
+
+// saveCareDueDates sets and stores the due dates of a plant whose care dates
+// were changed in place.
+func saveCareDueDates(db *gorm.DB, plant *PlantModel) error {
+	setCareDueDates(plant)
+	return db.Model(&PlantModel{}).Where("id = ?", plant.ID).UpdateColumns(map[string]interface{}{
+		"water_due_date":       plant.WaterDueDate,
+		"fertilize_due_date":   plant.FertilizeDueDate,
+		"moist_check_due_date": plant.MoistCheckDueDate,
+	}).Error
+}
+
+// LogCareEvent records care logged directly on a plant. Care actions go
+// through RecordCareAction, so the plant's care dates and reminders agree
+// with its history; other events, such as notes and repotting, are only
+// recorded.
+func LogCareEvent(db *gorm.DB, plant *PlantModel, event *CareEventModel) error {
+	if err := validateLoggedCareEvent(event); err != nil {
+		return err
+	}
+	if isCareAction(event.Kind) {
+		return RecordCareAction(db, plant, event)
+	}
+	event.PlantID = int(plant.ID)
+	return AddCareEvent(db, event)
+}
+
+// RecordCareActions records the same care on each of plants, all or nothing.
+// Each plant gets its own copy of event.
+func RecordCareActions(db *gorm.DB, plants []PlantModel, event *CareEventModel) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		for i := range plants {
+			plantEvent := *event
+			if err := RecordCareAction(tx, &plants[i], &plantEvent); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// cursors are "<occurredAt unix micros>_<id>" of the last event on a page
+func encodeEventCursor(event *CareEventModel) string {
+	return fmt.Sprintf("%d_%d", event.OccurredAt.UnixMicro(), event.ID)
+}
+
+func decodeEventCursor(cursor string) (time.Time, uint, error) {
+	parts := strings.Split(cursor, "_")
+	if len(parts) != 2 {
+		return time.Time{}, 0, errors.New("Invalid cursor.")
+	}
+	micros, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return time.Time{}, 0, errors.New("Invalid cursor.")
+	}
+	id, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return time.Time{}, 0, errors.New("Invalid cursor.")
+	}
+	return time.UnixMicro(micros), uint(id), nil
+}
+
+// GetCareEvents returns a page of a plant's events, newest first, starting
+// after cursor (or from the newest event if cursor is empty).
+func GetCareEvents(db *gorm.DB, plantId int, cursor string, limit int, page *CareEventPage) error {
+	if limit <= 0 {
+		limit = DEFAULT_EVENT_PAGE_SIZE
+	}
+	if limit > MAX_EVENT_PAGE_SIZE {
+		limit = MAX_EVENT_PAGE_SIZE
+	}
+	query := db.Where("plant_id = ?", plantId)
+	if cursor != "" {
+		occurredAt, id, err := decodeEventCursor(cursor)
+		if err != nil {
+			return err
+		}
+		query = query.Where("occurred_at < ? OR (occurred_at = ? AND id < ?)", occurredAt, occurredAt, id)
+	}
+	var events []CareEventModel
+	err := query.Order("occurred_at desc").Order("id desc").Limit(limit + 1).Find(&events).Error
+	if err != nil {
+		return err
+	}
+	page.NextCursor = ""
+	if len(events) > limit {
+		events = events[:limit]
+		page.NextCursor = encodeEventCursor(&events[limit-1])
+	}
+	page.Events = events
+	return resolveCareEventNames(db, page.Events)
+}
+
+// pruneCareEvents deletes events older than the retention period.
+func pruneCareEvents(db *gorm.DB) {
+	if CARE_EVENT_RETENTION <= 0 {
+		return
+	}
+	cutoff := time.Now().Add(-CARE_EVENT_RETENTION)
+	result := db.Unscoped().Where("occurred_at < ?", cutoff).Delete(&CareEventModel{})
+	if result.Error != nil {
+		fmt.Printf("Failed pruning care events: %v\n", result.Error)
+		return
+	}
+	if result.RowsAffected > 0 {
+		fmt.Printf("Pruned %d care events older than %v\n", result.RowsAffected, cutoff)
+	}
+}
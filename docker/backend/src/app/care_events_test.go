@@ -0,0 +1,62 @@
+package app
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// care logged as an event moves the plant's dates like a care action; other
+// events leave them alone
+func TestLogCareEvent(t *testing.T) {
+	db := newTestDb(t)
+	userId := createTestUser(t, db, "alice")
+	now := time.Now()
+	lastCare := NewCareDate(now.AddDate(0, 0, -10))
+	plant := createTestPlant(t, db, PlantModel{UserID: userId, Name: "fern", WateringFrequency: 3, FertilizingFrequency: 30,
+		LastWaterDate: lastCare, LastFertilizeDate: lastCare, LastWaterNotifyDate: lastCare})
+
+	note := CareEventModel{Kind: EVENT_NOTE, Note: "new leaf", UserID: userId}
+	if err := LogCareEvent(db, &plant, &note); err != nil {
+		t.Fatal(err)
+	}
+	if reloaded := reloadTestPlant(t, db, plant.ID); !reloaded.LastWaterDate.Equal(lastCare) || reloaded.Version != plant.Version {
+		t.Errorf("a note changed the plant: %+v", reloaded)
+	}
+
+	watered := CareEventModel{Kind: EVENT_WATERED, OccurredAt: now.Add(-time.Hour), UserID: userId}
+	if err := LogCareEvent(db, &plant, &watered); err != nil {
+		t.Fatal(err)
+	}
+	reloaded := reloadTestPlant(t, db, plant.ID)
+	if !reloaded.LastWaterDate.Time.Equal(watered.OccurredAt) || reloaded.LastWaterNotifyDate.Valid {
+		t.Errorf("watering left the plant at %s, notified %s", reloaded.LastWaterDate, reloaded.LastWaterNotifyDate)
+	}
+	if !reloaded.WaterDueDate.Time.Equal(watered.OccurredAt.AddDate(0, 0, 3)) {
+		t.Errorf("water due %s", reloaded.WaterDueDate)
+	}
+
+	skipped := CareEventModel{Kind: EVENT_SKIPPED_FERTILIZE, OccurredAt: now.Add(-time.Hour), UserID: userId}
+	if err := LogCareEvent(db, &plant, &skipped); err != nil {
+		t.Fatal(err)
+	}
+	if reloaded := reloadTestPlant(t, db, plant.ID); !reloaded.SkippedLastFertilize || !reloaded.LastFertilizeDate.Time.Equal(skipped.OccurredAt) {
+		t.Errorf("skipping fertilizer left the plant at %s, skipped %t", reloaded.LastFertilizeDate, reloaded.SkippedLastFertilize)
+	}
+
+	var events []CareEventModel
+	db.Where("plant_id = ?", plant.ID).Order("id asc").Find(&events)
+	if len(events) != 3 || events[0].Kind != EVENT_NOTE || events[1].Kind != EVENT_WATERED || events[2].Kind != EVENT_SKIPPED_FERTILIZE {
+		t.Errorf("history %+v", events)
+	}
+
+	var invalidErr *InvalidCareEventError
+	future := CareEventModel{Kind: EVENT_WATERED, OccurredAt: now.Add(time.Hour), UserID: userId}
+	if err := LogCareEvent(db, &plant, &future); !errors.As(err, &invalidErr) {
+		t.Errorf("expected care in the future to be refused, got %v", err)
+	}
+	unknown := CareEventModel{Kind: "sang", UserID: userId}
+	if err := LogCareEvent(db, &plant, &unknown); !errors.As(err, &invalidErr) {
+		t.Errorf("expected an unknown kind to be refused, got %v", err)
+	}
+}
@@ -0,0 +1,157 @@
+// computed care calendar
+package app
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	SCHEDULE_WATER     = "water"
+	SCHEDULE_FERTILIZE = "fertilize"
+)
+
+// days after a due date before a reminder email is sent, so reminders are
+// reminders and not alerts
+var REMINDER_GRACE_DAYS = 3
+
+var DEFAULT_SCHEDULE_DAYS = 7
+var MAX_SCHEDULE_DAYS = 366
+
+type ScheduleEntry struct {
+	PlantID   uint     `json:"plantId"`
+	PlantName string   `json:"plantName"`
+	Kind      string   `json:"kind"`
+	DueDate   CareDate `json:"dueDate"`
+	Overdue   bool     `json:"overdue"`
+}
+
+type Schedule struct {
+	From    CareDate        `json:"from"`
+	To      CareDate        `json:"to"`
+	Entries []ScheduleEntry `json:"entries"`
+}
+
+// careDueDate is the day care is next due, given the last time it was given
+// and how often it is needed. ok is false if there is no schedule.
+func careDueDate(lastCareDate CareDate, intervalDays int) (time.Time, bool) {
+	if !lastCareDate.Valid || intervalDays <= 0 {
+		return time.Time{}, false
+	}
+	return lastCareDate.Time.AddDate(0, 0, intervalDays), true
+}
+
+// how long after soil was found moist it should be checked again
+var MOIST_CHECK_INTERVAL = 24 * time.Hour
+
+// moistCheckDueDate is when soil found moist should be checked again. ok is
+// false unless the soil was checked since the plant was last watered.
+func moistCheckDueDate(plant *PlantModel) (time.Time, bool) {
+	if !plant.LastMoistDate.Valid {
+		return time.Time{}, false
+	}
+	if plant.LastWaterDate.Valid && !plant.LastMoistDate.Time.After(plant.LastWaterDate.Time) {
+		return time.Time{}, false
+	}
+	return plant.LastMoistDate.Time.Add(MOIST_CHECK_INTERVAL), true
+}
+
+// optionalCareDate turns a due date that may not exist into a CareDate.
+func optionalCareDate(date time.Time, ok bool) CareDate {
+	if !ok {
+		return CareDate{}
+	}
+	return NewCareDate(date)
+}
+
+// setCareDueDates works out when a plant's care is next due. The due dates
+// are stored with the plant so that plant lists can sort and filter on them,
+// and must be set again whenever its care dates or frequencies change.
+func setCareDueDates(plant *PlantModel) {
+	plant.WaterDueDate = optionalCareDate(careDueDate(plant.LastWaterDate, plant.WateringFrequency))
+	plant.FertilizeDueDate = optionalCareDate(careDueDate(plant.LastFertilizeDate, plant.FertilizingFrequency))
+	plant.MoistCheckDueDate = optionalCareDate(moistCheckDueDate(plant))
+}
+
+// overdueCutoff is the due date before which care is more than graceDays
+// late at now.
+func overdueCutoff(now time.Time, graceDays int) time.Time {
+	return now.AddDate(0, 0, -graceDays)
+}
+
+// isCareOverdue reports whether now is more than graceDays past the due date.
+func isCareOverdue(lastCareDate CareDate, intervalDays int, graceDays int, now time.Time) bool {
+	dueDate, ok := careDueDate(lastCareDate, intervalDays)
+	if !ok {
+		return false
+	}
+	return dueDate.Before(overdueCutoff(now, graceDays))
+}
+
+// scheduleOccurrences projects care every intervalDays from the next due date
+// through to. A first occurrence before from is care still outstanding, so it
+// is always included; Overdue flags it once it is past the grace period.
+func scheduleOccurrences(plant *PlantModel, kind string, lastCareDate CareDate, intervalDays int, from time.Time, to time.Time, graceDays int, now time.Time) []ScheduleEntry {
+	var entries []ScheduleEntry
+	dueDate, ok := careDueDate(lastCareDate, intervalDays)
+	if !ok {
+		return entries
+	}
+	first := true
+	for ; !dueDate.After(to); dueDate = dueDate.AddDate(0, 0, intervalDays) {
+		isFirst := first
+		first = false
+		if dueDate.Before(from) && !isFirst {
+			continue
+		}
+		overdue := isFirst && isCareOverdue(lastCareDate, intervalDays, graceDays, now)
+		entries = append(entries, ScheduleEntry{
+			PlantID:   plant.ID,
+			PlantName: plant.Name,
+			Kind:      kind,
+			DueDate:   NewCareDate(dueDate),
+			Overdue:   overdue,
+		})
+	}
+	return entries
+}
+
+// BuildSchedule computes due waterings and fertilizings for plants between
+// from and to inclusive, ordered by due date.
+func BuildSchedule(plants []PlantModel, from time.Time, to time.Time, graceDays int, schedule *Schedule) error {
+	if to.Before(from) {
+		return errors.New("'to' must not be before 'from'.")
+	}
+	if to.Sub(from) > time.Duration(MAX_SCHEDULE_DAYS)*24*time.Hour {
+		return errors.New("Schedule range is too long.")
+	}
+	if graceDays < 0 {
+		return errors.New("Invalid grace period.")
+	}
+	now := time.Now()
+	schedule.From = NewCareDate(from)
+	schedule.To = NewCareDate(to)
+	schedule.Entries = []ScheduleEntry{}
+	for i := range plants {
+		plant := &plants[i]
+		schedule.Entries = append(schedule.Entries, scheduleOccurrences(plant, SCHEDULE_WATER, plant.LastWaterDate, plant.WateringFrequency, from, to, graceDays, now)...)
+		schedule.Entries = append(schedule.Entries, scheduleOccurrences(plant, SCHEDULE_FERTILIZE, plant.LastFertilizeDate, plant.FertilizingFrequency, from, to, graceDays, now)...)
+	}
+	sort.SliceStable(schedule.Entries, func(i, j int) bool {
+		return schedule.Entries[i].DueDate.Time.Before(schedule.Entries[j].DueDate.Time)
+	})
+	return nil
+}
+
+// GetSchedule builds the care schedule for the plants of a user and of their
+// households.
+func GetSchedule(db *gorm.DB, userId uint, from time.Time, to time.Time, graceDays int, schedule *Schedule) error {
+	var plants []PlantModel
+	if err := db.Where("user_id = ? OR household_id IN (?)", userId, userHouseholdIds(db, userId)).Find(&plants).Error; err != nil {
+		return err
+	}
+	return BuildSchedule(plants, from, to, graceDays, schedule)
+}
@@ -0,0 +1,118 @@
+package app
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIsCareOverdue(t *testing.T) {
+	now := time.Date(2026, 6, 15, 12, 0, 0, 0, time.UTC)
+	daysBefore := func(days int) CareDate { return NewCareDate(now.AddDate(0, 0, -days)) }
+	cases := []struct {
+		name      string
+		last      CareDate
+		interval  int
+		graceDays int
+		expected  bool
+	}{
+		{"not due", daysBefore(3), 7, 3, false},
+		{"due today", daysBefore(7), 7, 3, false},
+		{"within grace", daysBefore(10), 7, 3, false},
+		{"past grace", daysBefore(11), 7, 3, true},
+		{"no grace", daysBefore(8), 7, 0, true},
+		{"never cared for", CareDate{}, 7, 3, false},
+		{"no schedule", daysBefore(100), 0, 3, false},
+		{"negative interval", daysBefore(100), -1, 3, false},
+	}
+	for _, c := range cases {
+		if overdue := isCareOverdue(c.last, c.interval, c.graceDays, now); overdue != c.expected {
+			t.Errorf("%s: got %t", c.name, overdue)
+		}
+	}
+}
+
+func TestScheduleOccurrences(t *testing.T) {
+	now := time.Date(2026, 6, 15, 12, 0, 0, 0, time.UTC)
+	day := func(offset int) time.Time { return now.AddDate(0, 0, offset) }
+	plant := &PlantModel{Name: "fern"}
+	plant.ID = 4
+
+	type occurrence struct {
+		offset  int
+		overdue bool
+	}
+	cases := []struct {
+		name     string
+		last     CareDate
+		interval int
+		from, to time.Time
+		expected []occurrence
+	}{
+		{"upcoming", NewCareDate(day(-5)), 7, day(0), day(14), []occurrence{{2, false}, {9, false}}},
+		{"due on the last day", NewCareDate(day(-5)), 7, day(0), day(2), []occurrence{{2, false}}},
+		{"after the range", NewCareDate(day(-1)), 7, day(0), day(5), nil},
+		// care left undone is still outstanding, and overdue only past the grace period
+		{"due within grace", NewCareDate(day(-9)), 7, day(0), day(7), []occurrence{{-2, false}, {5, false}}},
+		{"overdue", NewCareDate(day(-20)), 7, day(0), day(7), []occurrence{{-13, true}, {1, false}}},
+		// only the first missed occurrence is listed, not every one since
+		{"long overdue", NewCareDate(day(-40)), 7, day(0), day(3), []occurrence{{-33, true}, {2, false}}},
+		{"range in the future", NewCareDate(day(-5)), 7, day(5), day(12), []occurrence{{2, false}, {9, false}}},
+		{"never cared for", CareDate{}, 7, day(0), day(14), nil},
+		{"no schedule", NewCareDate(day(-5)), 0, day(0), day(14), nil},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			entries := scheduleOccurrences(plant, SCHEDULE_WATER, c.last, c.interval, c.from, c.to, 3, now)
+			if len(entries) != len(c.expected) {
+				t.Fatalf("got %d entries %+v, want %d", len(entries), entries, len(c.expected))
+			}
+			for i, entry := range entries {
+				expected := c.expected[i]
+				if !entry.DueDate.Time.Equal(day(expected.offset)) || entry.Overdue != expected.overdue {
+					t.Errorf("entry %d: due %v overdue %t, want %v overdue %t", i, entry.DueDate.Time, entry.Overdue, day(expected.offset), expected.overdue)
+				}
+				if entry.PlantID != 4 || entry.PlantName != "fern" || entry.Kind != SCHEDULE_WATER {
+					t.Errorf("entry %d: %+v", i, entry)
+				}
+			}
+		})
+	}
+}
+
+func TestBuildSchedule(t *testing.T) {
+	now := time.Now()
+	plants := []PlantModel{
+		{Name: "fern", WateringFrequency: 7, LastWaterDate: NewCareDate(now.AddDate(0, 0, -6)), FertilizingFrequency: 30, LastFertilizeDate: NewCareDate(now.AddDate(0, 0, -28))},
+		{Name: "cactus", WateringFrequency: 14, LastWaterDate: NewCareDate(now.AddDate(0, 0, -20))},
+	}
+	var schedule Schedule
+	if err := BuildSchedule(plants, now, now.AddDate(0, 0, 7), REMINDER_GRACE_DAYS, &schedule); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, entry := range schedule.Entries {
+		got = append(got, entry.PlantName+" "+entry.Kind)
+	}
+	expected := []string{"cactus water", "fern water", "fern fertilize"}
+	if len(got) != len(expected) {
+		t.Fatalf("got %v, want %v", got, expected)
+	}
+	for i := range expected {
+		if got[i] != expected[i] {
+			t.Fatalf("got %v, want %v", got, expected)
+		}
+	}
+	if !schedule.Entries[0].Overdue || schedule.Entries[1].Overdue {
+		t.Errorf("overdue flags %+v", schedule.Entries)
+	}
+
+	if err := BuildSchedule(plants, now, now.AddDate(0, 0, -1), 3, &schedule); err == nil {
+		t.Error("expected a range that ends before it starts to be refused")
+	}
+	if err := BuildSchedule(plants, now, now.AddDate(0, 0, MAX_SCHEDULE_DAYS+1), 3, &schedule); err == nil {
+		t.Error("expected a range that is too long to be refused")
+	}
+	if err := BuildSchedule(plants, now, now, -1, &schedule); err == nil {
+		t.Error("expected a negative grace period to be refused")
+	}
+}
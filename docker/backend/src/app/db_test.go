@@ -0,0 +1,70 @@
+package app
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/glebarez/sqlite"
+	"github.com/waterproofpatch/go_authentication/authentication"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+func TestMain(m *testing.M) {
+	// SQLite keeps times as text, which only sorts by time if every time is
+	// written in the same zone
+	time.Local = time.UTC
+	os.Exit(m.Run())
+}
+
+// newTestDb opens an empty in-memory database with every model migrated.
+func newTestDb(t *testing.T) *gorm.DB {
+	t.Helper()
+	db, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// every connection to :memory: is its own database
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB.SetMaxOpenConns(1)
+	t.Cleanup(func() { sqlDB.Close() })
+	if err := db.AutoMigrate(&authentication.User{}); err != nil {
+		t.Fatal(err)
+	}
+	InitModels(db, false)
+	return db
+}
+
+// createTestUser registers an account and returns its ID.
+func createTestUser(t *testing.T, db *gorm.DB, username string) uint {
+	t.Helper()
+	user := authentication.User{Email: username + "@example.com", Username: username}
+	if err := db.Create(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	return user.ID
+}
+
+// createTestPlant stores plant as is, without AddPlant's checks.
+func createTestPlant(t *testing.T, db *gorm.DB, plant PlantModel) PlantModel {
+	t.Helper()
+	setCareDueDates(&plant)
+	if err := db.Create(&plant).Error; err != nil {
+		t.Fatal(err)
+	}
+	return plant
+}
+
+// reloadTestPlant reads a plant back from the database.
+func reloadTestPlant(t *testing.T, db *gorm.DB, id uint) PlantModel {
+	t.Helper()
+	var plant PlantModel
+	if err := db.First(&plant, id).Error; err != nil {
+		t.Fatal(err)
+	}
+	return plant
+}
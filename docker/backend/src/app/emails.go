@@ -0,0 +1,86 @@
+// rendering of the emails we send
+package app
+
+import (
+	"bytes"
+	"embed"
+	htmltemplate "html/template"
+	"strings"
+	texttemplate "text/template"
+)
+
+//go:embed templates/email/*.tmpl
+var emailTemplateFS embed.FS
+
+var textTemplates = texttemplate.Must(texttemplate.ParseFS(emailTemplateFS, "templates/email/*.subject.tmpl", "templates/email/*.txt.tmpl"))
+var htmlTemplates = htmltemplate.Must(htmltemplate.ParseFS(emailTemplateFS, "templates/email/*.html.tmpl"))
+
+type CareEmailItem struct {
+	PlantName       string
+	NeedsWater      bool
+	NeedsFertilizer bool
+}
+
+type CareEmailData struct {
+	Username string
+	Plants   []CareEmailItem
+	SiteUrl  string
+}
+
+type LinkEmailData struct {
+	Url string
+}
+
+type HouseholdInviteEmailData struct {
+	Inviter   string
+	Household string
+	Role      string
+	Url       string
+}
+
+// renderEmail builds a message from the <name>.subject, <name>.txt and
+// <name>.html templates.
+func renderEmail(name string, to string, toName string, data interface{}) (*EmailMessage, error) {
+	var subject, plainText, html bytes.Buffer
+	if err := textTemplates.ExecuteTemplate(&subject, name+".subject.tmpl", data); err != nil {
+		return nil, err
+	}
+	if err := textTemplates.ExecuteTemplate(&plainText, name+".txt.tmpl", data); err != nil {
+		return nil, err
+	}
+	if err := htmlTemplates.ExecuteTemplate(&html, name+".html.tmpl", data); err != nil {
+		return nil, err
+	}
+	return &EmailMessage{
+		To:        to,
+		ToName:    toName,
+		Subject:   strings.TrimSpace(subject.String()),
+		PlainText: plainText.String(),
+		Html:      html.String(),
+	}, nil
+}
+
+func renderCareEmail(email string, duePlants []duePlant) (*EmailMessage, error) {
+	data := CareEmailData{SiteUrl: siteUrl()}
+	for _, due := range duePlants {
+		data.Username = due.Plant.Username
+		data.Plants = append(data.Plants, CareEmailItem{
+			PlantName:       due.Plant.Name,
+			NeedsWater:      due.NeedsWater,
+			NeedsFertilizer: due.NeedsFertilizer,
+		})
+	}
+	return renderEmail("care", email, data.Username, data)
+}
+
+func renderVerificationEmail(email string, url string) (*EmailMessage, error) {
+	return renderEmail("verify", email, email, LinkEmailData{Url: url})
+}
+
+func renderPasswordResetEmail(email string, url string) (*EmailMessage, error) {
+	return renderEmail("reset", email, email, LinkEmailData{Url: url})
+}
+
+func renderHouseholdInviteEmail(email string, data HouseholdInviteEmailData) (*EmailMessage, error) {
+	return renderEmail("invite", email, email, data)
+}
@@ -0,0 +1,257 @@
+// the bits of EXIF metadata uploads care about, and keeping the rest out
+package app
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"strings"
+	"time"
+)
+
+const (
+	exifTagOrientation        = 0x0112
+	exifTagDateTime           = 0x0132
+	exifTagExifIfd            = 0x8769
+	exifTagDateTimeOriginal   = 0x9003
+	exifTagOffsetTimeOriginal = 0x9011
+
+	exifTypeShort = 3
+	exifTypeLong  = 4
+)
+
+// ExifInfo is what uploads keep from an image's EXIF metadata. Location and
+// everything else is dropped.
+type ExifInfo struct {
+	// 1-8, see applyOrientation; 0 if absent
+	Orientation int
+	// nil if absent or unparseable
+	CapturedAt *time.Time
+}
+
+type exifEntry struct {
+	tag    uint16
+	typ    uint16
+	count  uint32
+	value  []byte // the 4 inline bytes
+	offset uint32
+}
+
+// jpegExif returns the TIFF payload of a JPEG's EXIF segment.
+func jpegExif(data []byte) ([]byte, error) {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil, errors.New("not a JPEG")
+	}
+	pos := 2
+	for pos+4 <= len(data) {
+		if data[pos] != 0xFF {
+			return nil, errors.New("invalid JPEG marker")
+		}
+		marker := data[pos+1]
+		// start of scan, no more metadata
+		if marker == 0xDA || marker == 0xD9 {
+			break
+		}
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		if length < 2 || pos+2+length > len(data) {
+			return nil, errors.New("truncated JPEG segment")
+		}
+		segment := data[pos+4 : pos+2+length]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return segment[6:], nil
+		}
+		pos += 2 + length
+	}
+	return nil, nil
+}
+
+// readExifIfd parses the entries of the IFD at offset in a TIFF payload.
+func readExifIfd(tiff []byte, order binary.ByteOrder, offset uint32) ([]exifEntry, error) {
+	if int(offset)+2 > len(tiff) {
+		return nil, errors.New("IFD out of range")
+	}
+	count := int(order.Uint16(tiff[offset:]))
+	var entries []exifEntry
+	for i := 0; i < count; i++ {
+		start := int(offset) + 2 + i*12
+		if start+12 > len(tiff) {
+			return nil, errors.New("IFD entry out of range")
+		}
+		raw := tiff[start : start+12]
+		entries = append(entries, exifEntry{
+			tag:    order.Uint16(raw[0:]),
+			typ:    order.Uint16(raw[2:]),
+			count:  order.Uint32(raw[4:]),
+			value:  raw[8:12],
+			offset: order.Uint32(raw[8:]),
+		})
+	}
+	return entries, nil
+}
+
+// an ASCII value, stored inline if it fits in 4 bytes
+func exifString(tiff []byte, entry exifEntry) string {
+	raw := entry.value
+	if entry.count > 4 {
+		end := int(entry.offset) + int(entry.count)
+		if end > len(tiff) || end < int(entry.offset) {
+			return ""
+		}
+		raw = tiff[entry.offset:end]
+	} else {
+		raw = raw[:entry.count]
+	}
+	return strings.TrimRight(string(raw), "\x00 ")
+}
+
+// parse an EXIF timestamp, which has no zone unless an offset tag gives one
+func parseExifTime(value string, offset string) *time.Time {
+	layout := "2006:01:02 15:04:05"
+	if offset != "" {
+		value += offset
+		layout += "-07:00"
+	}
+	t, err := time.Parse(layout, value)
+	if err != nil || t.Year() < 1900 {
+		return nil
+	}
+	return &t
+}
+
+// ReadExif extracts orientation and capture time from a JPEG. Only JPEG's
+// APP1 segment is read: other formats, and images without EXIF, yield an empty
+// ExifInfo, so PNG and WebP uploads are taken as upright and without a
+// capture time. HEIC decoding applies its own rotation.
+func ReadExif(data []byte) (ExifInfo, error) {
+	var info ExifInfo
+	if !bytes.HasPrefix(data, []byte{0xFF, 0xD8}) {
+		return info, nil
+	}
+	tiff, err := jpegExif(data)
+	if err != nil || tiff == nil {
+		return info, err
+	}
+	if len(tiff) < 8 {
+		return info, errors.New("truncated EXIF")
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return info, errors.New("invalid EXIF byte order")
+	}
+	ifd0, err := readExifIfd(tiff, order, order.Uint32(tiff[4:]))
+	if err != nil {
+		return info, err
+	}
+
+	var dateTime, dateTimeOriginal, offsetTimeOriginal string
+	for _, entry := range ifd0 {
+		switch entry.tag {
+		case exifTagOrientation:
+			if entry.typ == exifTypeShort {
+				info.Orientation = int(order.Uint16(entry.value))
+			}
+		case exifTagDateTime:
+			dateTime = exifString(tiff, entry)
+		case exifTagExifIfd:
+			if entry.typ != exifTypeLong {
+				continue
+			}
+			exifIfd, err := readExifIfd(tiff, order, entry.offset)
+			if err != nil {
+				continue
+			}
+			for _, exifEntry := range exifIfd {
+				switch exifEntry.tag {
+				case exifTagDateTimeOriginal:
+					dateTimeOriginal = exifString(tiff, exifEntry)
+				case exifTagOffsetTimeOriginal:
+					offsetTimeOriginal = exifString(tiff, exifEntry)
+				}
+			}
+		}
+	}
+	if dateTimeOriginal != "" {
+		info.CapturedAt = parseExifTime(dateTimeOriginal, offsetTimeOriginal)
+	}
+	if info.CapturedAt == nil && dateTime != "" {
+		info.CapturedAt = parseExifTime(dateTime, "")
+	}
+	return info, nil
+}
+
+// applyOrientation rotates and flips img so it displays upright, given an
+// EXIF orientation. Orientations other than 2-8 leave img as is.
+func applyOrientation(img image.Image, orientation int) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return img
+	}
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	// 5-8 swap width and height
+	dstW, dstH := w, h
+	if orientation >= 5 {
+		dstW, dstH = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dstW, dstH))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2: // mirrored
+				dx, dy = w-1-x, y
+			case 3: // rotated 180
+				dx, dy = w-1-x, h-1-y
+			case 4: // mirrored vertically
+				dx, dy = x, h-1-y
+			case 5: // transposed
+				dx, dy = y, x
+			case 6: // rotated 90 clockwise to display
+				dx, dy = h-1-y, x
+			case 7: // transversed
+				dx, dy = h-1-y, w-1-x
+			case 8: // rotated 90 counter-clockwise to display
+				dx, dy = y, w-1-x
+			}
+			dst.Set(dx, dy, img.At(bounds.Min.X+x, bounds.Min.Y+y))
+		}
+	}
+	return dst
+}
+
+// stripJpegMetadata removes application segments (EXIF, XMP, IPTC and the
+// like, which is where location lives) and comments from a JPEG. Anything
+// else is returned unchanged.
+func stripJpegMetadata(data []byte) []byte {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return data
+	}
+	out := []byte{0xFF, 0xD8}
+	pos := 2
+	for pos+4 <= len(data) {
+		if data[pos] != 0xFF {
+			return data
+		}
+		marker := data[pos+1]
+		if marker == 0xDA {
+			// the rest is image data
+			return append(out, data[pos:]...)
+		}
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		if length < 2 || pos+2+length > len(data) {
+			return data
+		}
+		// keep APP0 (JFIF), drop APP1-APP15 and COM
+		isMetadata := (marker >= 0xE1 && marker <= 0xEF) || marker == 0xFE
+		if !isMetadata {
+			out = append(out, data[pos:pos+2+length]...)
+		}
+		pos += 2 + length
+	}
+	return data
+}
@@ -0,0 +1,254 @@
+package app
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"testing"
+	"time"
+)
+
+type testExifEntry struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	// the inline value or offset
+	value uint32
+}
+
+// testTiff lays out a TIFF payload: the header, IFD0 at 8, then the Exif IFD
+// and any strings at the offsets the entries give.
+func testTiff(order binary.ByteOrder, ifd0 []testExifEntry, size int, extra map[int][]byte) []byte {
+	tiff := make([]byte, size)
+	if order == binary.LittleEndian {
+		copy(tiff, "II")
+	} else {
+		copy(tiff, "MM")
+	}
+	order.PutUint16(tiff[2:], 42)
+	order.PutUint32(tiff[4:], 8)
+	writeTestIfd(tiff, order, 8, ifd0)
+	for offset, data := range extra {
+		copy(tiff[offset:], data)
+	}
+	return tiff
+}
+
+func writeTestIfd(tiff []byte, order binary.ByteOrder, offset int, entries []testExifEntry) {
+	order.PutUint16(tiff[offset:], uint16(len(entries)))
+	for i, entry := range entries {
+		raw := tiff[offset+2+i*12:]
+		order.PutUint16(raw[0:], entry.tag)
+		order.PutUint16(raw[2:], entry.typ)
+		order.PutUint32(raw[4:], entry.count)
+		if entry.typ == exifTypeShort && entry.count == 1 {
+			// shorts are left-justified in the value field
+			order.PutUint16(raw[8:], uint16(entry.value))
+		} else {
+			order.PutUint32(raw[8:], entry.value)
+		}
+	}
+}
+
+// testJpeg wraps a TIFF payload in a JPEG's EXIF segment, after a JFIF one.
+func testJpeg(tiff []byte) []byte {
+	jpeg := []byte{0xFF, 0xD8, 0xFF, 0xE0, 0x00, 0x07, 'J', 'F', 'I', 'F', 0}
+	segment := append([]byte("Exif\x00\x00"), tiff...)
+	jpeg = append(jpeg, 0xFF, 0xE1, byte((len(segment)+2)>>8), byte(len(segment)+2))
+	jpeg = append(jpeg, segment...)
+	// start of scan, then "image data"
+	return append(jpeg, 0xFF, 0xDA, 0x00, 0x02, 1, 2, 3, 0xFF, 0xD9)
+}
+
+func orientationTiff(order binary.ByteOrder, orientation uint32) []byte {
+	return testTiff(order, []testExifEntry{{exifTagOrientation, exifTypeShort, 1, orientation}}, 64, nil)
+}
+
+func TestReadExifOrientation(t *testing.T) {
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		for orientation := 1; orientation <= 8; orientation++ {
+			info, err := ReadExif(testJpeg(orientationTiff(order, uint32(orientation))))
+			if err != nil {
+				t.Fatalf("%v %d: %v", order, orientation, err)
+			}
+			if info.Orientation != orientation {
+				t.Errorf("%v: read orientation %d, expected %d", order, info.Orientation, orientation)
+			}
+		}
+	}
+}
+
+func TestReadExifCapturedAt(t *testing.T) {
+	zone := time.FixedZone("", -4*3600)
+	cases := []struct {
+		name     string
+		ifd0     []testExifEntry
+		exifIfd  []testExifEntry
+		expected *time.Time
+	}{
+		{
+			name: "original time with offset",
+			ifd0: []testExifEntry{
+				{exifTagDateTime, 2, 20, 200},
+				{exifTagExifIfd, exifTypeLong, 1, 100},
+			},
+			exifIfd: []testExifEntry{
+				{exifTagDateTimeOriginal, 2, 20, 240},
+				{exifTagOffsetTimeOriginal, 2, 7, 280},
+			},
+			expected: ptrTime(time.Date(2023, 6, 1, 9, 30, 0, 0, zone)),
+		},
+		{
+			name:     "modification time if that's all there is",
+			ifd0:     []testExifEntry{{exifTagDateTime, 2, 20, 200}},
+			expected: ptrTime(time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)),
+		},
+		{
+			name:     "no times",
+			ifd0:     []testExifEntry{{exifTagOrientation, exifTypeShort, 1, 6}},
+			expected: nil,
+		},
+		{
+			name:     "Exif IFD that isn't a long",
+			ifd0:     []testExifEntry{{exifTagExifIfd, exifTypeShort, 1, 100}},
+			exifIfd:  []testExifEntry{{exifTagDateTimeOriginal, 2, 20, 240}},
+			expected: nil,
+		},
+	}
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		for _, c := range cases {
+			tiff := testTiff(order, c.ifd0, 320, map[int][]byte{
+				200: []byte("2024:01:02 03:04:05\x00"),
+				240: []byte("2023:06:01 09:30:00\x00"),
+				280: []byte("-04:00\x00"),
+			})
+			if c.exifIfd != nil {
+				writeTestIfd(tiff, order, 100, c.exifIfd)
+			}
+			info, err := ReadExif(testJpeg(tiff))
+			if err != nil {
+				t.Fatalf("%v %s: %v", order, c.name, err)
+			}
+			switch {
+			case c.expected == nil && info.CapturedAt != nil:
+				t.Errorf("%v %s: unexpected capture time %v", order, c.name, info.CapturedAt)
+			case c.expected != nil && (info.CapturedAt == nil || !info.CapturedAt.Equal(*c.expected)):
+				t.Errorf("%v %s: captured at %v, expected %v", order, c.name, info.CapturedAt, c.expected)
+			}
+		}
+	}
+}
+
+func ptrTime(t time.Time) *time.Time {
+	return &t
+}
+
+// broken and hostile metadata must neither panic nor be trusted
+func TestReadExifMalformed(t *testing.T) {
+	order := binary.BigEndian
+	valid := testJpeg(orientationTiff(order, 6))
+	badOffset := orientationTiff(order, 6)
+	order.PutUint32(badOffset[4:], 0xFFFFFFF0)
+	badOrder := orientationTiff(order, 6)
+	copy(badOrder, "XX")
+	manyEntries := orientationTiff(order, 6)
+	order.PutUint16(manyEntries[8:], 0xFFFF)
+	// a string whose offset runs past the end, or wraps around
+	badString := testTiff(order, []testExifEntry{{exifTagDateTime, 2, 20, 0xFFFFFFF0}}, 64, nil)
+	hugeString := testTiff(order, []testExifEntry{{exifTagDateTime, 2, 0xFFFFFFFF, 40}}, 64, nil)
+	// an Exif IFD out of range is skipped
+	badExifIfd := testTiff(order, []testExifEntry{
+		{exifTagOrientation, exifTypeShort, 1, 3},
+		{exifTagExifIfd, exifTypeLong, 1, 0xFFFFFFFF},
+	}, 64, nil)
+	badLength := append([]byte{}, valid...)
+	// the EXIF segment's length, past the end of the file
+	badLength[13], badLength[14] = 0xFF, 0xFF
+
+	cases := []struct {
+		name        string
+		data        []byte
+		orientation int
+		expectError bool
+	}{
+		{"empty", nil, 0, false},
+		{"not a JPEG", []byte("\x89PNG\r\n\x1a\n"), 0, false},
+		{"JPEG without EXIF", []byte{0xFF, 0xD8, 0xFF, 0xDA, 0x00, 0x02, 0xFF, 0xD9}, 0, false},
+		{"truncated segment", valid[:20], 0, true},
+		{"segment length past the end", badLength, 0, true},
+		{"garbage between segments", append([]byte{0xFF, 0xD8, 0x00}, valid[2:]...), 0, true},
+		{"truncated EXIF", testJpeg([]byte("MM\x00\x2a")), 0, true},
+		{"invalid byte order", testJpeg(badOrder), 0, true},
+		{"IFD0 out of range", testJpeg(badOffset), 0, true},
+		{"more entries than bytes", testJpeg(manyEntries), 0, true},
+		{"string out of range", testJpeg(badString), 0, false},
+		{"string longer than the payload", testJpeg(hugeString), 0, false},
+		{"Exif IFD out of range", testJpeg(badExifIfd), 3, false},
+	}
+	for _, c := range cases {
+		info, err := ReadExif(c.data)
+		if (err != nil) != c.expectError {
+			t.Errorf("%s: error %v", c.name, err)
+		}
+		if info.Orientation != c.orientation || info.CapturedAt != nil {
+			t.Errorf("%s: read %+v", c.name, info)
+		}
+	}
+}
+
+func TestApplyOrientation(t *testing.T) {
+	// 3x2, pixels numbered
+	//   1 2 3
+	//   4 5 6
+	src := image.NewGray(image.Rect(0, 0, 3, 2))
+	for i := range src.Pix {
+		src.Pix[i] = uint8(i + 1)
+	}
+	cases := []struct {
+		orientation int
+		expected    [][]uint8
+	}{
+		{0, [][]uint8{{1, 2, 3}, {4, 5, 6}}},
+		{1, [][]uint8{{1, 2, 3}, {4, 5, 6}}},
+		{2, [][]uint8{{3, 2, 1}, {6, 5, 4}}},
+		{3, [][]uint8{{6, 5, 4}, {3, 2, 1}}},
+		{4, [][]uint8{{4, 5, 6}, {1, 2, 3}}},
+		{5, [][]uint8{{1, 4}, {2, 5}, {3, 6}}},
+		{6, [][]uint8{{4, 1}, {5, 2}, {6, 3}}},
+		{7, [][]uint8{{6, 3}, {5, 2}, {4, 1}}},
+		{8, [][]uint8{{3, 6}, {2, 5}, {1, 4}}},
+		{9, [][]uint8{{1, 2, 3}, {4, 5, 6}}},
+	}
+	for _, c := range cases {
+		img := applyOrientation(src, c.orientation)
+		bounds := img.Bounds()
+		if bounds.Dy() != len(c.expected) || bounds.Dx() != len(c.expected[0]) {
+			t.Errorf("orientation %d: bounds %v", c.orientation, bounds)
+			continue
+		}
+		for y, row := range c.expected {
+			for x, expected := range row {
+				got := color.GrayModel.Convert(img.At(bounds.Min.X+x, bounds.Min.Y+y)).(color.Gray).Y
+				if got != expected {
+					t.Errorf("orientation %d: pixel (%d,%d) is %d, expected %d", c.orientation, x, y, got, expected)
+				}
+			}
+		}
+	}
+}
+
+func TestStripJpegMetadata(t *testing.T) {
+	jpeg := testJpeg(orientationTiff(binary.LittleEndian, 6))
+	stripped := stripJpegMetadata(jpeg)
+	if bytes.Contains(stripped, []byte("Exif")) {
+		t.Error("EXIF segment kept")
+	}
+	if !bytes.Contains(stripped, []byte("JFIF")) || !bytes.HasSuffix(stripped, []byte{1, 2, 3, 0xFF, 0xD9}) {
+		t.Errorf("lost more than metadata: % x", stripped)
+	}
+	png := []byte("\x89PNG\r\n\x1a\n")
+	if !bytes.Equal(stripJpegMetadata(png), png) {
+		t.Error("non-JPEG data changed")
+	}
+}
@@ -0,0 +1,437 @@
+// households: groups of users who look after plants together
+package app
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/waterproofpatch/go_authentication/authentication"
+	"gorm.io/gorm"
+)
+
+const (
+	ROLE_OWNER  = "owner"
+	ROLE_EDITOR = "editor"
+	ROLE_VIEWER = "viewer"
+)
+
+// each role may do everything the roles ranked below it may
+var roleRanks = map[string]int{
+	ROLE_VIEWER: 1,
+	ROLE_EDITOR: 2,
+	ROLE_OWNER:  3,
+}
+
+var HOUSEHOLD_INVITE_TTL = 7 * 24 * time.Hour
+
+var ErrHouseholdForbidden = errors.New("You don't have permission to do that in this household.")
+var ErrInvalidInvite = errors.New("This invitation is invalid or has expired.")
+
+type HouseholdModel struct {
+	gorm.Model
+	Name    string                 `json:"name"`
+	Members []HouseholdMemberModel `json:"members" gorm:"foreignKey:HouseholdID"`
+}
+
+type HouseholdMemberModel struct {
+	gorm.Model
+	HouseholdID uint   `json:"householdId" gorm:"uniqueIndex:idx_household_member"`
+	UserID      uint   `json:"userId" gorm:"uniqueIndex:idx_household_member;index"`
+	Role        string `json:"role"`
+	Username    string `json:"username" gorm:"-"`
+}
+
+// HouseholdInviteModel lets the invited email join a household. Only a hash
+// of the code is stored; the code itself is only sent to the invitee.
+type HouseholdInviteModel struct {
+	gorm.Model
+	HouseholdID uint       `json:"householdId" gorm:"index"`
+	Email       string     `json:"email"`
+	Role        string     `json:"role"`
+	InvitedBy   uint       `json:"invitedBy"`
+	CodeHash    string     `json:"-" gorm:"uniqueIndex"`
+	ExpiresAt   time.Time  `json:"expiresAt"`
+	AcceptedAt  *time.Time `json:"acceptedAt"`
+}
+
+func isValidRole(role string) bool {
+	_, ok := roleRanks[role]
+	return ok
+}
+
+// hasRole reports whether role includes the permissions of required.
+func hasRole(role string, required string) bool {
+	return role != "" && roleRanks[role] >= roleRanks[required]
+}
+
+// householdRole returns a user's role in a household, or "" if they aren't
+// a member.
+func householdRole(db *gorm.DB, householdId uint, userId uint) (string, error) {
+	if householdId == 0 || userId == 0 {
+		return "", nil
+	}
+	var roles []string
+	err := db.Model(&HouseholdMemberModel{}).
+		Where("household_id = ? AND user_id = ?", householdId, userId).
+		Limit(1).Pluck("role", &roles).Error
+	if err != nil || len(roles) == 0 {
+		return "", err
+	}
+	return roles[0], nil
+}
+
+func requireHouseholdRole(db *gorm.DB, householdId uint, userId uint, required string) error {
+	role, err := householdRole(db, householdId, userId)
+	if err != nil {
+		return err
+	}
+	if !hasRole(role, required) {
+		return ErrHouseholdForbidden
+	}
+	return nil
+}
+
+// userHouseholdIds selects the households a user belongs to, for use as a
+// subquery.
+func userHouseholdIds(db *gorm.DB, userId uint) *gorm.DB {
+	return db.Model(&HouseholdMemberModel{}).Select("household_id").Where("user_id = ?", userId)
+}
+
+// plantRole returns a user's role on a plant: owner for whoever created it,
+// otherwise their role in the plant's household, or "" if they have none.
+func plantRole(db *gorm.DB, plant *PlantModel, userId uint) (string, error) {
+	if userId == 0 {
+		return "", nil
+	}
+	if plant.UserID == userId {
+		return ROLE_OWNER, nil
+	}
+	return householdRole(db, plant.HouseholdID, userId)
+}
+
+// canViewPlant reports whether role, as returned by plantRole, may see plant.
+func canViewPlant(plant *PlantModel, role string) bool {
+	return plant.IsPublic || hasRole(role, ROLE_VIEWER)
+}
+
+// CreateHousehold creates a household with userId as its owner.
+func CreateHousehold(db *gorm.DB, userId uint, household *HouseholdModel) error {
+	household.Name = strings.TrimSpace(household.Name)
+	if household.Name == "" {
+		return errors.New("Household name is required.")
+	}
+	household.ID = 0
+	household.Members = nil
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(household).Error; err != nil {
+			return err
+		}
+		return tx.Create(&HouseholdMemberModel{HouseholdID: household.ID, UserID: userId, Role: ROLE_OWNER}).Error
+	})
+	if err != nil {
+		return err
+	}
+	return GetHousehold(db, household.ID, household)
+}
+
+// GetHousehold loads a household with its members.
+func GetHousehold(db *gorm.DB, id uint, household *HouseholdModel) error {
+	if err := db.Preload("Members").First(household, id).Error; err != nil {
+		return err
+	}
+	return resolveMemberNames(db, household.Members)
+}
+
+// GetHouseholds lists the households a user belongs to.
+func GetHouseholds(db *gorm.DB, userId uint, households *[]HouseholdModel) error {
+	*households = []HouseholdModel{}
+	if err := db.Preload("Members").Where("id IN (?)", userHouseholdIds(db, userId)).Order("id asc").Find(households).Error; err != nil {
+		return err
+	}
+	for i := range *households {
+		if err := resolveMemberNames(db, (*households)[i].Members); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func resolveMemberNames(db *gorm.DB, members []HouseholdMemberModel) error {
+	var ids []uint
+	for i := range members {
+		ids = append(ids, members[i].UserID)
+	}
+	users, err := usersById(db, ids)
+	if err != nil {
+		return err
+	}
+	for i := range members {
+		members[i].Username = users[members[i].UserID].Username
+	}
+	return nil
+}
+
+// DeleteHousehold removes a household, returning its plants to whoever
+// created them. Only owners may delete a household.
+func DeleteHousehold(db *gorm.DB, householdId uint, userId uint) error {
+	if err := requireHouseholdRole(db, householdId, userId, ROLE_OWNER); err != nil {
+		return err
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&PlantModel{}).Where("household_id = ?", householdId).
+			UpdateColumns(map[string]interface{}{"household_id": 0, "version": gorm.Expr("version + 1")}).Error
+		if err != nil {
+			return err
+		}
+		if err := tx.Where("household_id = ?", householdId).Delete(&HouseholdInviteModel{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Unscoped().Where("household_id = ?", householdId).Delete(&HouseholdMemberModel{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&HouseholdModel{}, householdId).Error
+	})
+}
+
+func hashInviteCode(code string) string {
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// InviteToHousehold invites email to join a household with role, and emails
+// them a link to accept. Only owners may invite.
+func InviteToHousehold(db *gorm.DB, householdId uint, inviterId uint, email string, role string, invite *HouseholdInviteModel) error {
+	if err := requireHouseholdRole(db, householdId, inviterId, ROLE_OWNER); err != nil {
+		return err
+	}
+	email = strings.TrimSpace(email)
+	if !authentication.IsValidEmail(email) {
+		return errors.New("Invalid email.")
+	}
+	if !isValidRole(role) {
+		return errors.New("Invalid role.")
+	}
+	var household HouseholdModel
+	if err := db.First(&household, householdId).Error; err != nil {
+		return err
+	}
+	inviter, err := userById(db, inviterId)
+	if err != nil {
+		return err
+	}
+
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return err
+	}
+	code := base64.RawURLEncoding.EncodeToString(raw)
+	*invite = HouseholdInviteModel{
+		HouseholdID: householdId,
+		Email:       email,
+		Role:        role,
+		InvitedBy:   inviterId,
+		CodeHash:    hashInviteCode(code),
+		ExpiresAt:   time.Now().Add(HOUSEHOLD_INVITE_TTL),
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(invite).Error; err != nil {
+			return err
+		}
+		return sendHouseholdInvite(tx, email, inviter.Username, household.Name, role, code)
+	})
+}
+
+// queue the email inviting someone into a household
+func sendHouseholdInvite(db *gorm.DB, email string, inviter string, household string, role string, code string) error {
+	if os.Getenv("DEBUG_EMAIL") != "" && os.Getenv("DEBUG_EMAIL") != email {
+		fmt.Println("Debug email does not match recipient. Not sending.")
+		return nil
+	}
+	url := fmt.Sprintf("%s/households?invite=%s", siteUrl(), code)
+	msg, err := renderHouseholdInviteEmail(email, HouseholdInviteEmailData{
+		Inviter:   inviter,
+		Household: household,
+		Role:      role,
+		Url:       url,
+	})
+	if err != nil {
+		return err
+	}
+	return queueEmail(db, msg)
+}
+
+// GetHouseholdInvites lists a household's pending invitations. Only owners
+// may see them.
+func GetHouseholdInvites(db *gorm.DB, householdId uint, userId uint, invites *[]HouseholdInviteModel) error {
+	if err := requireHouseholdRole(db, householdId, userId, ROLE_OWNER); err != nil {
+		return err
+	}
+	*invites = []HouseholdInviteModel{}
+	return db.Where("household_id = ? AND accepted_at IS NULL AND expires_at > ?", householdId, time.Now()).
+		Order("id asc").Find(invites).Error
+}
+
+// RevokeHouseholdInvite withdraws a pending invitation. Only owners may.
+func RevokeHouseholdInvite(db *gorm.DB, householdId uint, userId uint, inviteId uint) error {
+	if err := requireHouseholdRole(db, householdId, userId, ROLE_OWNER); err != nil {
+		return err
+	}
+	result := db.Where("id = ? AND household_id = ? AND accepted_at IS NULL", inviteId, householdId).Delete(&HouseholdInviteModel{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+// AcceptHouseholdInvite adds the user holding code to the household it is
+// for. The invitation must be addressed to the user's email. Members who are
+// invited again keep the higher of their two roles.
+func AcceptHouseholdInvite(db *gorm.DB, code string, userId uint, email string, household *HouseholdModel) error {
+	var invite HouseholdInviteModel
+	err := db.Where("code_hash = ? AND accepted_at IS NULL AND expires_at > ?", hashInviteCode(code), time.Now()).First(&invite).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return ErrInvalidInvite
+	}
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(invite.Email, email) {
+		fmt.Printf("User %d tried accepting an invitation for %s\n", userId, invite.Email)
+		return ErrInvalidInvite
+	}
+	err = db.Transaction(func(tx *gorm.DB) error {
+		role, err := householdRole(tx, invite.HouseholdID, userId)
+		if err != nil {
+			return err
+		}
+		if role == "" {
+			err = tx.Create(&HouseholdMemberModel{HouseholdID: invite.HouseholdID, UserID: userId, Role: invite.Role}).Error
+		} else if roleRanks[invite.Role] > roleRanks[role] {
+			err = tx.Model(&HouseholdMemberModel{}).
+				Where("household_id = ? AND user_id = ?", invite.HouseholdID, userId).
+				Update("role", invite.Role).Error
+		}
+		if err != nil {
+			return err
+		}
+		return tx.Model(&invite).Update("accepted_at", time.Now()).Error
+	})
+	if err != nil {
+		return err
+	}
+	return GetHousehold(db, invite.HouseholdID, household)
+}
+
+// countOwners returns how many owners a household has, so the last one can't
+// leave it without an owner.
+func countOwners(db *gorm.DB, householdId uint) (int64, error) {
+	var count int64
+	err := db.Model(&HouseholdMemberModel{}).Where("household_id = ? AND role = ?", householdId, ROLE_OWNER).Count(&count).Error
+	return count, err
+}
+
+// SetHouseholdMemberRole changes a member's role. Only owners may.
+func SetHouseholdMemberRole(db *gorm.DB, householdId uint, userId uint, memberId uint, role string) error {
+	if err := requireHouseholdRole(db, householdId, userId, ROLE_OWNER); err != nil {
+		return err
+	}
+	if !isValidRole(role) {
+		return errors.New("Invalid role.")
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		current, err := householdRole(tx, householdId, memberId)
+		if err != nil {
+			return err
+		}
+		if current == "" {
+			return gorm.ErrRecordNotFound
+		}
+		if current == ROLE_OWNER && role != ROLE_OWNER {
+			owners, err := countOwners(tx, householdId)
+			if err != nil {
+				return err
+			}
+			if owners <= 1 {
+				return errors.New("A household needs at least one owner.")
+			}
+		}
+		return tx.Model(&HouseholdMemberModel{}).
+			Where("household_id = ? AND user_id = ?", householdId, memberId).
+			Update("role", role).Error
+	})
+}
+
+// RemoveHouseholdMember takes a member out of a household. Owners may remove
+// anyone; other members may only leave. Plants the member created stay in
+// the household.
+func RemoveHouseholdMember(db *gorm.DB, householdId uint, userId uint, memberId uint) error {
+	if userId != memberId {
+		if err := requireHouseholdRole(db, householdId, userId, ROLE_OWNER); err != nil {
+			return err
+		}
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		role, err := householdRole(tx, householdId, memberId)
+		if err != nil {
+			return err
+		}
+		if role == "" {
+			return gorm.ErrRecordNotFound
+		}
+		if role == ROLE_OWNER {
+			owners, err := countOwners(tx, householdId)
+			if err != nil {
+				return err
+			}
+			if owners <= 1 {
+				return errors.New("A household needs at least one owner.")
+			}
+		}
+		return tx.Unscoped().Where("household_id = ? AND user_id = ?", householdId, memberId).Delete(&HouseholdMemberModel{}).Error
+	})
+}
+
+// MovePlantToHousehold shares a plant with a household, or with householdId 0
+// makes it personal again. Only the plant's creator may move it, and only
+// into a household where they can edit.
+func MovePlantToHousehold(db *gorm.DB, plant *PlantModel, userId uint, householdId uint) error {
+	if plant.UserID != userId {
+		return ErrHouseholdForbidden
+	}
+	logMsg := "Plant is no longer shared with a household"
+	if householdId != 0 {
+		if err := requireHouseholdRole(db, householdId, userId, ROLE_EDITOR); err != nil {
+			return err
+		}
+		var household HouseholdModel
+		if err := db.First(&household, householdId).Error; err != nil {
+			return err
+		}
+		logMsg = fmt.Sprintf("Plant shared with household %s", household.Name)
+	}
+	if plant.HouseholdID == householdId {
+		return nil
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&PlantModel{}).Where("id = ?", plant.ID).UpdateColumns(map[string]interface{}{
+			"household_id": householdId,
+			"version":      gorm.Expr("version + 1"),
+		}).Error
+		if err != nil {
+			return err
+		}
+		plant.HouseholdID = householdId
+		plant.Version++
+		return addPlantLog(tx, plant, logMsg)
+	})
+}
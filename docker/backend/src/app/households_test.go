@@ -0,0 +1,170 @@
+package app
+
+import (
+	"errors"
+	"regexp"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+var inviteLinkPattern = regexp.MustCompile(`/households\?invite=([A-Za-z0-9_-]+)`)
+
+// inviteTestUser invites username to a household and returns the code from
+// the link in their invitation email.
+func inviteTestUser(t *testing.T, db *gorm.DB, householdId uint, inviterId uint, username string, role string) string {
+	t.Helper()
+	var invite HouseholdInviteModel
+	if err := InviteToHousehold(db, householdId, inviterId, username+"@example.com", role, &invite); err != nil {
+		t.Fatal(err)
+	}
+	var email OutboxEmailModel
+	if err := db.Where("subject <> ''").Order("id desc").First(&email).Error; err != nil {
+		t.Fatal(err)
+	}
+	match := inviteLinkPattern.FindStringSubmatch(email.PlainText)
+	if match == nil {
+		t.Fatalf("no invitation link in %q", email.PlainText)
+	}
+	return match[1]
+}
+
+func createTestHousehold(t *testing.T, db *gorm.DB, ownerId uint) uint {
+	t.Helper()
+	household := HouseholdModel{Name: "home"}
+	if err := CreateHousehold(db, ownerId, &household); err != nil {
+		t.Fatal(err)
+	}
+	return household.ID
+}
+
+func expectHouseholdRole(t *testing.T, db *gorm.DB, householdId uint, userId uint, expected string) {
+	t.Helper()
+	role, err := householdRole(db, householdId, userId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if role != expected {
+		t.Errorf("user %d is %q, expected %q", userId, role, expected)
+	}
+}
+
+func TestAcceptHouseholdInvite(t *testing.T) {
+	t.Setenv("DEBUG_EMAIL", "")
+	db := newTestDb(t)
+	alice := createTestUser(t, db, "alice")
+	bob := createTestUser(t, db, "bob")
+	mallory := createTestUser(t, db, "mallory")
+	householdId := createTestHousehold(t, db, alice)
+
+	code := inviteTestUser(t, db, householdId, alice, "bob", ROLE_VIEWER)
+	var household HouseholdModel
+	// only whoever the invitation was sent to may use it
+	if err := AcceptHouseholdInvite(db, code, mallory, "mallory@example.com", &household); !errors.Is(err, ErrInvalidInvite) {
+		t.Errorf("expected ErrInvalidInvite for someone else, got %v", err)
+	}
+	if err := AcceptHouseholdInvite(db, code, bob, "Bob@Example.com", &household); err != nil {
+		t.Fatal(err)
+	}
+	if household.ID != householdId || len(household.Members) != 2 {
+		t.Errorf("joined %+v", household)
+	}
+	expectHouseholdRole(t, db, householdId, bob, ROLE_VIEWER)
+	if err := AcceptHouseholdInvite(db, code, bob, "bob@example.com", &household); !errors.Is(err, ErrInvalidInvite) {
+		t.Errorf("expected a used invitation to be refused, got %v", err)
+	}
+
+	// invited again, members keep the higher role
+	code = inviteTestUser(t, db, householdId, alice, "bob", ROLE_EDITOR)
+	if err := AcceptHouseholdInvite(db, code, bob, "bob@example.com", &household); err != nil {
+		t.Fatal(err)
+	}
+	expectHouseholdRole(t, db, householdId, bob, ROLE_EDITOR)
+	code = inviteTestUser(t, db, householdId, alice, "bob", ROLE_VIEWER)
+	if err := AcceptHouseholdInvite(db, code, bob, "bob@example.com", &household); err != nil {
+		t.Fatal(err)
+	}
+	expectHouseholdRole(t, db, householdId, bob, ROLE_EDITOR)
+
+	code = inviteTestUser(t, db, householdId, alice, "mallory", ROLE_VIEWER)
+	db.Model(&HouseholdInviteModel{}).Where("email = ?", "mallory@example.com").Update("expires_at", time.Now().Add(-time.Minute))
+	if err := AcceptHouseholdInvite(db, code, mallory, "mallory@example.com", &household); !errors.Is(err, ErrInvalidInvite) {
+		t.Errorf("expected an expired invitation to be refused, got %v", err)
+	}
+	expectHouseholdRole(t, db, householdId, mallory, "")
+}
+
+func TestHouseholdRoles(t *testing.T) {
+	t.Setenv("DEBUG_EMAIL", "")
+	db := newTestDb(t)
+	alice := createTestUser(t, db, "alice")
+	bob := createTestUser(t, db, "bob")
+	carol := createTestUser(t, db, "carol")
+	dave := createTestUser(t, db, "dave")
+	householdId := createTestHousehold(t, db, alice)
+	var household HouseholdModel
+	for username, role := range map[string]string{"bob": ROLE_VIEWER, "carol": ROLE_EDITOR} {
+		code := inviteTestUser(t, db, householdId, alice, username, role)
+		userId, err := userIdForEmail(db, username+"@example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := AcceptHouseholdInvite(db, code, userId, username+"@example.com", &household); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// only owners manage the household
+	var invite HouseholdInviteModel
+	if err := InviteToHousehold(db, householdId, carol, "dave@example.com", ROLE_VIEWER, &invite); !errors.Is(err, ErrHouseholdForbidden) {
+		t.Errorf("expected an editor not to invite, got %v", err)
+	}
+	if err := SetHouseholdMemberRole(db, householdId, carol, bob, ROLE_EDITOR); !errors.Is(err, ErrHouseholdForbidden) {
+		t.Errorf("expected an editor not to change roles, got %v", err)
+	}
+	if err := RemoveHouseholdMember(db, householdId, bob, carol); !errors.Is(err, ErrHouseholdForbidden) {
+		t.Errorf("expected a viewer not to remove others, got %v", err)
+	}
+
+	// household plants follow household roles
+	plant := createTestPlant(t, db, PlantModel{UserID: carol, HouseholdID: householdId, Name: "fern", WateringFrequency: 7})
+	for userId, expected := range map[uint]string{alice: ROLE_OWNER, bob: ROLE_VIEWER, carol: ROLE_OWNER, dave: ""} {
+		role, err := plantRole(db, &plant, userId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if role != expected {
+			t.Errorf("user %d is %q on the plant, expected %q", userId, role, expected)
+		}
+		if canViewPlant(&plant, role) != (expected != "") {
+			t.Errorf("user %d can view the plant: %t", userId, canViewPlant(&plant, role))
+		}
+	}
+	bobsPlant := createTestPlant(t, db, PlantModel{UserID: bob, Name: "ivy", WateringFrequency: 7})
+	if err := MovePlantToHousehold(db, &bobsPlant, bob, householdId); !errors.Is(err, ErrHouseholdForbidden) {
+		t.Errorf("expected a viewer not to share plants, got %v", err)
+	}
+	if err := MovePlantToHousehold(db, &plant, alice, 0); !errors.Is(err, ErrHouseholdForbidden) {
+		t.Errorf("expected only the creator to move a plant, got %v", err)
+	}
+
+	// a household always keeps an owner
+	if err := SetHouseholdMemberRole(db, householdId, alice, alice, ROLE_EDITOR); err == nil {
+		t.Error("expected the last owner not to step down")
+	}
+	if err := RemoveHouseholdMember(db, householdId, alice, alice); err == nil {
+		t.Error("expected the last owner not to leave")
+	}
+	if err := SetHouseholdMemberRole(db, householdId, alice, carol, ROLE_OWNER); err != nil {
+		t.Fatal(err)
+	}
+	if err := RemoveHouseholdMember(db, householdId, alice, alice); err != nil {
+		t.Errorf("expected an owner to leave once there's another, got %v", err)
+	}
+	if err := RemoveHouseholdMember(db, householdId, bob, bob); err != nil {
+		t.Errorf("expected a viewer to leave, got %v", err)
+	}
+	expectHouseholdRole(t, db, householdId, bob, "")
+	expectHouseholdRole(t, db, householdId, carol, ROLE_OWNER)
+}
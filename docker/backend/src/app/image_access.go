@@ -0,0 +1,65 @@
+// who may see an image
+package app
+
+import (
+	"errors"
+
+	auth_types "github.com/waterproofpatch/go_authentication/types"
+	"gorm.io/gorm"
+)
+
+// imagePlant returns the plant an image (or a resized copy of it) belongs to.
+func imagePlant(db *gorm.DB, image *ImageModel) (*PlantModel, error) {
+	id := image.ID
+	if image.OriginalID != 0 {
+		id = image.OriginalID
+	}
+	var plant PlantModel
+	// past photos as well as the current cover
+	var photo PlantPhotoModel
+	err := db.Where("image_id = ?", id).First(&photo).Error
+	if err == nil {
+		err = db.First(&plant, photo.PlantID).Error
+	} else if errors.Is(err, gorm.ErrRecordNotFound) {
+		err = db.Where("image_id = ?", id).First(&plant).Error
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &plant, nil
+}
+
+// canViewImage reports whether the caller may see image, and whether anyone
+// may, which decides how it can be cached. Images of public plants are
+// visible to all; others only to the plant's owner, its household and
+// admins. Images not attached to any plant are visible only to admins.
+func canViewImage(db *gorm.DB, image *ImageModel, claims *auth_types.JWTData) (allowed bool, public bool, err error) {
+	plant, err := imagePlant(db, image)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return claims != nil && claims.IsAdmin, false, nil
+	}
+	if err != nil {
+		return false, false, err
+	}
+	if plant.IsPublic {
+		return true, true, nil
+	}
+	if claims == nil {
+		return false, false, nil
+	}
+	if claims.IsAdmin {
+		return true, false, nil
+	}
+	userId, err := callerId(db, claims)
+	if errors.Is(err, ErrUnknownUser) {
+		return false, false, nil
+	}
+	if err != nil {
+		return false, false, err
+	}
+	role, err := plantRole(db, plant, userId)
+	if err != nil {
+		return false, false, err
+	}
+	return canViewPlant(plant, role), false, nil
+}
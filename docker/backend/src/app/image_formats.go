@@ -0,0 +1,60 @@
+// image formats accepted for upload
+package app
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	_ "image/gif"
+	_ "image/png"
+
+	"github.com/gen2brain/heic"
+	_ "golang.org/x/image/webp"
+)
+
+const (
+	IMAGE_TYPE_JPEG = "image/jpeg"
+	IMAGE_TYPE_WEBP = "image/webp"
+)
+
+// longest edge in pixels an upload may have; decoding one allocates 4 bytes
+// per pixel, so larger images are refused before they are decoded
+var MAX_UPLOAD_IMAGE_EDGE = 8192
+
+var ErrImageTooLarge = errors.New("image is too large")
+
+func init() {
+	// the heic package only recognizes the "heic" brand; phones also write
+	// these for HEVC coded stills and sequences
+	for _, brand := range []string{"heix", "hevc", "hevx", "heim", "heis", "mif1", "msf1"} {
+		image.RegisterFormat("heic", "????ftyp"+brand, heic.Decode, heic.DecodeConfig)
+	}
+}
+
+// DecodeUpload decodes an uploaded JPEG, PNG, GIF (first frame), WebP or HEIC
+// image. Transparent areas are filled with white, as JPEG, which every image
+// is stored as, doesn't keep them. Images with an edge over MAX_UPLOAD_IMAGE_EDGE are refused with
+// ErrImageTooLarge.
+func DecodeUpload(data []byte) (image.Image, string, error) {
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, format, err
+	}
+	if config.Width > MAX_UPLOAD_IMAGE_EDGE || config.Height > MAX_UPLOAD_IMAGE_EDGE {
+		return nil, format, fmt.Errorf("%w: %dx%d, at most %d pixels a side", ErrImageTooLarge, config.Width, config.Height, MAX_UPLOAD_IMAGE_EDGE)
+	}
+	img, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, format, err
+	}
+	if opaque, ok := img.(interface{ Opaque() bool }); ok && opaque.Opaque() {
+		return img, format, nil
+	}
+	bounds := img.Bounds()
+	flat := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(flat, flat.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.Draw(flat, flat.Bounds(), img, bounds.Min, draw.Over)
+	return flat, format, nil
+}
@@ -0,0 +1,67 @@
+package app
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+)
+
+func encodeTestPng(t *testing.T, img image.Image) []byte {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDecodeUploadSizeLimit(t *testing.T) {
+	edge := MAX_UPLOAD_IMAGE_EDGE
+	for _, size := range [][2]int{{edge, 1}, {1, edge}} {
+		if _, _, err := DecodeUpload(encodeTestPng(t, image.NewGray(image.Rect(0, 0, size[0], size[1])))); err != nil {
+			t.Errorf("%dx%d refused: %v", size[0], size[1], err)
+		}
+	}
+	for _, size := range [][2]int{{edge + 1, 1}, {1, edge + 1}} {
+		_, format, err := DecodeUpload(encodeTestPng(t, image.NewGray(image.Rect(0, 0, size[0], size[1]))))
+		if !errors.Is(err, ErrImageTooLarge) || format != "png" {
+			t.Errorf("%dx%d: expected ErrImageTooLarge, got %v (%s)", size[0], size[1], err, format)
+		}
+	}
+
+	// a header claiming far more pixels than the data holds is refused
+	// without decoding anything
+	data := encodeTestPng(t, image.NewGray(image.Rect(0, 0, 1, 1)))
+	ihdr := data[16:29]
+	binary.BigEndian.PutUint32(ihdr[0:], 100000)
+	binary.BigEndian.PutUint32(ihdr[4:], 100000)
+	binary.BigEndian.PutUint32(data[29:], crc32.ChecksumIEEE(data[12:29]))
+	if _, _, err := DecodeUpload(data); !errors.Is(err, ErrImageTooLarge) {
+		t.Errorf("expected ErrImageTooLarge, got %v", err)
+	}
+}
+
+func TestDecodeUploadFlattensTransparency(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 2, 1))
+	img.SetNRGBA(0, 0, color.NRGBA{255, 0, 0, 255})
+	img.SetNRGBA(1, 0, color.NRGBA{0, 0, 255, 0})
+	decoded, format, err := DecodeUpload(encodeTestPng(t, img))
+	if err != nil || format != "png" {
+		t.Fatalf("%v (%s)", err, format)
+	}
+	for x, expected := range []color.RGBA{{255, 0, 0, 255}, {255, 255, 255, 255}} {
+		if got := color.RGBAModel.Convert(decoded.At(x, 0)); got != expected {
+			t.Errorf("pixel %d is %v, expected %v", x, got, expected)
+		}
+	}
+}
+
+func TestDecodeUploadGarbage(t *testing.T) {
+	if _, _, err := DecodeUpload([]byte("not an image")); err == nil || errors.Is(err, ErrImageTooLarge) {
+		t.Errorf("expected a decoding error, got %v", err)
+	}
+}
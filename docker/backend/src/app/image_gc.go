@@ -0,0 +1,138 @@
+// garbage collection of images no plant refers to
+package app
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+var IMAGE_GC_INTERVAL = 6 * time.Hour
+
+// images younger than this are left alone, since an upload is stored before
+// the plant or photo referring to it is
+var IMAGE_GC_MIN_AGE = 1 * time.Hour
+
+// ImageGcReport describes the orphaned images a collection found, and removed
+// unless it was a dry run.
+type ImageGcReport struct {
+	DryRun bool `json:"dryRun"`
+	// the orphaned full size images, resized copies whose full size image is
+	// gone, and images soft deleted but still stored
+	ImageIds []uint `json:"imageIds"`
+	// rows including resized copies, and their total size in bytes
+	Count int   `json:"count"`
+	Bytes int64 `json:"bytes"`
+}
+
+// orphanedImageIds finds images created before cutoff that neither a plant
+// nor a photo of a plant refers to.
+func orphanedImageIds(db *gorm.DB, cutoff time.Time) ([]uint, error) {
+	plantImages := db.Model(&PlantModel{}).Select("image_id")
+	livePlants := db.Model(&PlantModel{}).Select("id")
+	photoImages := db.Model(&PlantPhotoModel{}).Select("image_id").Where("plant_id IN (?)", livePlants)
+	liveImages := db.Model(&ImageModel{}).Select("id")
+
+	var ids []uint
+	err := db.Model(&ImageModel{}).
+		Where("created_at < ?", cutoff).
+		Where(db.Where("(original_id = 0 OR original_id IS NULL) AND id NOT IN (?) AND id NOT IN (?)", plantImages, photoImages).
+			Or("original_id <> 0 AND original_id NOT IN (?)", liveImages)).
+		Order("id asc").
+		Pluck("id", &ids).Error
+	return ids, err
+}
+
+// deletedImageIds finds images that were only soft deleted, whose rows and
+// bytes are still stored.
+func deletedImageIds(db *gorm.DB) ([]uint, error) {
+	var ids []uint
+	err := db.Unscoped().Model(&ImageModel{}).Where("deleted_at IS NOT NULL").Order("id asc").Pluck("id", &ids).Error
+	return ids, err
+}
+
+// imageByteSize returns the stored size of an image, measuring and recording
+// it for images stored before sizes were.
+func imageByteSize(db *gorm.DB, image *ImageModel) (int64, error) {
+	if image.ByteSize != 0 {
+		return image.ByteSize, nil
+	}
+	data, err := ReadImage(image)
+	if err != nil {
+		return 0, err
+	}
+	image.ByteSize = int64(len(data))
+	return image.ByteSize, db.Model(&ImageModel{}).Where("id = ?", image.ID).UpdateColumn("byte_size", image.ByteSize).Error
+}
+
+// CollectOrphanedImages finds images no plant refers to, and soft deleted
+// ones, and unless dryRun is set deletes them along with their resized
+// copies.
+func CollectOrphanedImages(db *gorm.DB, dryRun bool) (*ImageGcReport, error) {
+	ids, err := orphanedImageIds(db, time.Now().Add(-IMAGE_GC_MIN_AGE))
+	if err != nil {
+		return nil, err
+	}
+	deletedIds, err := deletedImageIds(db)
+	if err != nil {
+		return nil, err
+	}
+	ids = append(ids, deletedIds...)
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	report := &ImageGcReport{DryRun: dryRun, ImageIds: []uint{}}
+	// resized copies go with their full size image, even if listed too
+	counted := map[uint]bool{}
+	for _, id := range ids {
+		if counted[id] {
+			continue
+		}
+		var images []ImageModel
+		if err := db.Unscoped().Where("id = ? OR original_id = ?", id, id).Find(&images).Error; err != nil {
+			return report, err
+		}
+		for i := range images {
+			counted[images[i].ID] = true
+			size, err := imageByteSize(db, &images[i])
+			if err != nil {
+				fmt.Printf("Failed measuring image %d: %v\n", images[i].ID, err)
+			}
+			report.Bytes += size
+		}
+		if !dryRun {
+			if err := DeleteImage(db, id); err != nil {
+				fmt.Printf("Failed deleting orphaned image %d: %v\n", id, err)
+				continue
+			}
+		}
+		report.ImageIds = append(report.ImageIds, id)
+		report.Count += len(images)
+	}
+	verb := "Deleted"
+	if dryRun {
+		verb = "Found"
+	}
+	fmt.Printf("%s %d orphaned image(s), %d row(s), %d bytes\n", verb, len(report.ImageIds), report.Count, report.Bytes)
+	return report, nil
+}
+
+// StartImageGc deletes orphaned images once per IMAGE_GC_INTERVAL until
+// stopCh is closed.
+func StartImageGc(stopCh chan bool, db *gorm.DB) {
+	fmt.Printf("Starting image garbage collector, interval=%v\n", IMAGE_GC_INTERVAL)
+	ticker := time.NewTicker(IMAGE_GC_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := CollectOrphanedImages(db, false); err != nil {
+				fmt.Printf("Failed collecting orphaned images: %v\n", err)
+			}
+		case <-stopCh:
+			fmt.Println("Stopping image garbage collector...")
+			return
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package app
+
+import (
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+func imageRowsAndBytes(t *testing.T, db *gorm.DB) (int, int64) {
+	t.Helper()
+	var images []ImageModel
+	if err := db.Unscoped().Find(&images).Error; err != nil {
+		t.Fatal(err)
+	}
+	var bytes int64
+	for _, image := range images {
+		bytes += image.ByteSize
+	}
+	return len(images), bytes
+}
+
+func TestCollectOrphanedImages(t *testing.T) {
+	db := newTestDb(t)
+	userId := createTestUser(t, db, "alice")
+	used := saveTestImage(t, db)
+	createTestPlant(t, db, PlantModel{UserID: userId, Name: "fern", WateringFrequency: 7, ImageId: int(used.ID)})
+	usedRows, usedBytes := imageRowsAndBytes(t, db)
+
+	orphaned := saveTestImage(t, db)
+	// soft deleted, as images were before deletes were for good
+	softDeleted := saveTestImage(t, db)
+	if err := db.Where("id = ? OR original_id = ?", softDeleted.ID, softDeleted.ID).Delete(&ImageModel{}).Error; err != nil {
+		t.Fatal(err)
+	}
+	allRows, allBytes := imageRowsAndBytes(t, db)
+
+	// too new to be collected
+	report, err := CollectOrphanedImages(db, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.ImageIds) != 1 || report.ImageIds[0] != softDeleted.ID {
+		t.Errorf("found %v, expected only the soft deleted image %d", report.ImageIds, softDeleted.ID)
+	}
+
+	old := time.Now().Add(-2 * IMAGE_GC_MIN_AGE)
+	db.Unscoped().Model(&ImageModel{}).Where("id > 0").UpdateColumn("created_at", old)
+	report, err = CollectOrphanedImages(db, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.ImageIds) != 2 || report.Count != allRows-usedRows || report.Bytes != allBytes-usedBytes {
+		t.Errorf("dry run found %v, %d rows, %d bytes; expected %d and %d, %d rows, %d bytes",
+			report.ImageIds, report.Count, report.Bytes, orphaned.ID, softDeleted.ID, allRows-usedRows, allBytes-usedBytes)
+	}
+	if rows, _ := imageRowsAndBytes(t, db); rows != allRows {
+		t.Errorf("dry run deleted %d rows", allRows-rows)
+	}
+
+	collected, err := CollectOrphanedImages(db, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if collected.Count != report.Count || collected.Bytes != report.Bytes {
+		t.Errorf("collected %d rows, %d bytes; the dry run found %d, %d", collected.Count, collected.Bytes, report.Count, report.Bytes)
+	}
+	// the bytes reported freed are gone from the table
+	if rows, bytes := imageRowsAndBytes(t, db); rows != usedRows || bytes != usedBytes {
+		t.Errorf("%d rows, %d bytes left; expected %d, %d", rows, bytes, usedRows, usedBytes)
+	}
+}
@@ -0,0 +1,336 @@
+// pluggable storage for plant image bytes
+package app
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"gorm.io/gorm"
+)
+
+const (
+	IMAGE_STORE_DB = "db"
+	IMAGE_STORE_FS = "fs"
+	IMAGE_STORE_S3 = "s3"
+)
+
+// ImageStore holds the bytes of an image. The ImageModel row is always kept in
+// the database; Store and Key record where its bytes live.
+type ImageStore interface {
+	Name() string
+	// Put stores data for image, setting image.Key (or image.Data).
+	Put(image *ImageModel, data []byte) error
+	Get(image *ImageModel) ([]byte, error)
+	Delete(image *ImageModel) error
+}
+
+// DbImageStore keeps image bytes in ImageModel.Data, as images always were.
+type DbImageStore struct{}
+
+// FsImageStore keeps image bytes as files under Dir.
+type FsImageStore struct {
+	Dir string
+}
+
+var imageStore ImageStore = &DbImageStore{}
+
+// stores constructed on demand to read images written by a previous config,
+// shared by concurrent requests
+var imageStores = map[string]ImageStore{}
+var imageStoresLock sync.Mutex
+
+func InitImageStore(store ImageStore) {
+	imageStoresLock.Lock()
+	defer imageStoresLock.Unlock()
+	imageStore = store
+	imageStores[store.Name()] = store
+}
+
+// NewImageStoreFromEnv builds the store named by IMAGE_STORE, defaulting to
+// the database.
+func NewImageStoreFromEnv() (ImageStore, error) {
+	name := os.Getenv("IMAGE_STORE")
+	if name == "" {
+		name = IMAGE_STORE_DB
+	}
+	return NewImageStore(name)
+}
+
+// NewImageStore builds a store by name, configured from the environment.
+func NewImageStore(name string) (ImageStore, error) {
+	switch name {
+	case IMAGE_STORE_DB:
+		return &DbImageStore{}, nil
+	case IMAGE_STORE_FS:
+		dir := os.Getenv("IMAGE_STORE_DIR")
+		if dir == "" {
+			return nil, errors.New("IMAGE_STORE_DIR must be set for the fs image store")
+		}
+		return &FsImageStore{Dir: dir}, nil
+	case IMAGE_STORE_S3:
+		return NewS3ImageStoreFromEnv()
+	}
+	return nil, fmt.Errorf("unknown image store %s", name)
+}
+
+// imageStoreFor returns the store an image's bytes were written to.
+func imageStoreFor(image *ImageModel) (ImageStore, error) {
+	name := image.Store
+	if name == "" {
+		// rows from before stores existed
+		name = IMAGE_STORE_DB
+	}
+	if name == imageStore.Name() {
+		return imageStore, nil
+	}
+	imageStoresLock.Lock()
+	defer imageStoresLock.Unlock()
+	if store, ok := imageStores[name]; ok {
+		return store, nil
+	}
+	store, err := NewImageStore(name)
+	if err != nil {
+		return nil, err
+	}
+	imageStores[name] = store
+	return store, nil
+}
+
+// new random object key, so keys don't depend on row IDs
+func newImageKey(name string) (string, error) {
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(raw) + filepath.Ext(name), nil
+}
+
+// putImage writes data to the configured store and creates the image record,
+// filling in where the bytes went and what they are.
+func putImage(db *gorm.DB, image *ImageModel, data []byte) error {
+	// location and other metadata must never be stored
+	data = stripJpegMetadata(data)
+	image.Store = imageStore.Name()
+	image.ContentType = http.DetectContentType(data)
+	image.ContentHash = imageContentHash(data)
+	image.ByteSize = int64(len(data))
+	if err := imageStore.Put(image, data); err != nil {
+		return err
+	}
+	if err := db.Create(image).Error; err != nil {
+		if err := imageStore.Delete(image); err != nil {
+			fmt.Printf("Failed cleaning up image %s: %v\n", image.Key, err)
+		}
+		return err
+	}
+	return nil
+}
+
+func imageContentHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// LoadImage returns an image record and its bytes.
+func LoadImage(db *gorm.DB, id uint) (*ImageModel, []byte, error) {
+	var image ImageModel
+	if err := db.First(&image, id).Error; err != nil {
+		return nil, nil, err
+	}
+	data, err := ReadImage(&image)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &image, data, nil
+}
+
+// ReadImage fetches the bytes of an image record from its store.
+func ReadImage(image *ImageModel) ([]byte, error) {
+	store, err := imageStoreFor(image)
+	if err != nil {
+		return nil, err
+	}
+	return store.Get(image)
+}
+
+// ensureImageMetadata fills in the content type and hash of images stored
+// before they were recorded.
+func ensureImageMetadata(db *gorm.DB, image *ImageModel, data []byte) error {
+	if image.ContentHash != "" && image.ContentType != "" {
+		return nil
+	}
+	image.ContentType = http.DetectContentType(data)
+	image.ContentHash = imageContentHash(data)
+	return db.Model(&ImageModel{}).Where("id = ?", image.ID).UpdateColumns(map[string]interface{}{
+		"content_type": image.ContentType,
+		"content_hash": image.ContentHash,
+	}).Error
+}
+
+// DeleteImage removes an image's bytes and its record, along with any resized
+// copies. Missing images are not an error. Rows are deleted for good, so
+// those only soft deleted before are purged too.
+func DeleteImage(db *gorm.DB, id uint) error {
+	var image ImageModel
+	err := db.Unscoped().First(&image, id).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var variantIds []uint
+	if err := db.Unscoped().Model(&ImageModel{}).Where("original_id = ?", id).Pluck("id", &variantIds).Error; err != nil {
+		return err
+	}
+	for _, variantId := range variantIds {
+		if err := DeleteImage(db, variantId); err != nil {
+			return err
+		}
+	}
+	store, err := imageStoreFor(&image)
+	if err != nil {
+		return err
+	}
+	if err := store.Delete(&image); err != nil {
+		return err
+	}
+	return db.Unscoped().Delete(&image).Error
+}
+
+// MigrateImages moves every image held by from into to. Each row is pointed
+// at its new copy before the old copy is removed, so an interrupted migration
+// can simply be run again. With keepSource the old copies are left in place.
+func MigrateImages(db *gorm.DB, from ImageStore, to ImageStore, keepSource bool) (int, error) {
+	if from.Name() == to.Name() {
+		return 0, errors.New("source and destination stores are the same")
+	}
+	query := db.Where("store = ?", from.Name())
+	if from.Name() == IMAGE_STORE_DB {
+		query = db.Where("store = ? OR store = '' OR store IS NULL", from.Name())
+	}
+	var ids []uint
+	if err := query.Model(&ImageModel{}).Order("id asc").Pluck("id", &ids).Error; err != nil {
+		return 0, err
+	}
+	fmt.Printf("Migrating %d image(s) from %s to %s\n", len(ids), from.Name(), to.Name())
+
+	moved := 0
+	for _, id := range ids {
+		// one at a time, so blobs aren't all held in memory
+		var image ImageModel
+		if err := db.First(&image, id).Error; err != nil {
+			return moved, err
+		}
+		source := image
+		data, err := from.Get(&source)
+		if err != nil {
+			return moved, fmt.Errorf("image %d: %w", id, err)
+		}
+		image.Key = ""
+		image.Data = nil
+		if err := to.Put(&image, data); err != nil {
+			return moved, fmt.Errorf("image %d: %w", id, err)
+		}
+		err = db.Model(&ImageModel{}).Where("id = ?", id).UpdateColumns(map[string]interface{}{
+			"store": to.Name(),
+			"key":   image.Key,
+			"data":  image.Data,
+		}).Error
+		if err != nil {
+			return moved, fmt.Errorf("image %d: %w", id, err)
+		}
+		// the DB copy is dropped by the update above
+		if !keepSource && from.Name() != IMAGE_STORE_DB {
+			if err := from.Delete(&source); err != nil {
+				fmt.Printf("Failed removing image %d from %s: %v\n", id, from.Name(), err)
+			}
+		}
+		moved++
+	}
+	fmt.Printf("Migrated %d image(s)\n", moved)
+	return moved, nil
+}
+
+func (s *DbImageStore) Name() string {
+	return IMAGE_STORE_DB
+}
+
+func (s *DbImageStore) Put(image *ImageModel, data []byte) error {
+	image.Data = data
+	return nil
+}
+
+func (s *DbImageStore) Get(image *ImageModel) ([]byte, error) {
+	return image.Data, nil
+}
+
+// the bytes go with the row
+func (s *DbImageStore) Delete(image *ImageModel) error {
+	return nil
+}
+
+func (s *FsImageStore) Name() string {
+	return IMAGE_STORE_FS
+}
+
+// path of a key under Dir, refusing keys that would escape it
+func (s *FsImageStore) path(key string) (string, error) {
+	if key == "" || strings.ContainsAny(key, `/\`) || key == "." || key == ".." {
+		return "", fmt.Errorf("invalid image key %q", key)
+	}
+	return filepath.Join(s.Dir, key), nil
+}
+
+func (s *FsImageStore) Put(image *ImageModel, data []byte) error {
+	key, err := newImageKey(image.Name)
+	if err != nil {
+		return err
+	}
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.Dir, 0755); err != nil {
+		return err
+	}
+	// write then rename, so a reader never sees a partial file
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	image.Key = key
+	return nil
+}
+
+func (s *FsImageStore) Get(image *ImageModel) ([]byte, error) {
+	path, err := s.path(image.Key)
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadFile(path)
+}
+
+func (s *FsImageStore) Delete(image *ImageModel) error {
+	path, err := s.path(image.Key)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,74 @@
+package app
+
+import (
+	"image"
+	"sync"
+	"testing"
+
+	"gorm.io/gorm"
+)
+
+func TestImageStoreForConcurrentUse(t *testing.T) {
+	t.Setenv("IMAGE_STORE_DIR", t.TempDir())
+	InitImageStore(&DbImageStore{})
+
+	var wg sync.WaitGroup
+	stores := make([]ImageStore, 20)
+	for i := range stores {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			store, err := imageStoreFor(&ImageModel{Store: IMAGE_STORE_FS})
+			if err != nil {
+				t.Error(err)
+			}
+			stores[i] = store
+		}(i)
+	}
+	wg.Wait()
+	for _, store := range stores {
+		if store != stores[0] {
+			t.Fatal("expected a single fs store to be built and shared")
+		}
+	}
+
+	store, err := imageStoreFor(&ImageModel{})
+	if err != nil || store.Name() != IMAGE_STORE_DB {
+		t.Errorf("rows without a store should read from the database, got %v, %v", store, err)
+	}
+}
+
+// saveTestImage stores an image with all its variants.
+func saveTestImage(t *testing.T, db *gorm.DB) *ImageModel {
+	t.Helper()
+	queue := useImageVariantQueue(t, 1)
+	original, err := SaveImageVariants(db, image.NewRGBA(image.Rect(0, 0, 1000, 600)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job := <-queue
+	generateQueuedImageVariants(job.db, job.id)
+	return original
+}
+
+func TestDeleteImageRemovesRows(t *testing.T) {
+	db := newTestDb(t)
+	original := saveTestImage(t, db)
+	kept := saveTestImage(t, db)
+
+	if err := DeleteImage(db, original.ID); err != nil {
+		t.Fatal(err)
+	}
+	var count int64
+	db.Unscoped().Model(&ImageModel{}).Where("id = ? OR original_id = ?", original.ID, original.ID).Count(&count)
+	if count != 0 {
+		t.Errorf("%d rows left of a deleted image", count)
+	}
+	db.Unscoped().Model(&ImageModel{}).Where("id = ? OR original_id = ?", kept.ID, kept.ID).Count(&count)
+	if count != int64(len(imageSizes)) {
+		t.Errorf("%d rows of another image, expected %d", count, len(imageSizes))
+	}
+	if err := DeleteImage(db, original.ID); err != nil {
+		t.Errorf("deleting a missing image: %v", err)
+	}
+}
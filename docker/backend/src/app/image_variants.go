@@ -0,0 +1,337 @@
+// resized copies of uploaded images
+package app
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	IMAGE_SIZE_THUMB  = "thumb"
+	IMAGE_SIZE_MEDIUM = "medium"
+	IMAGE_SIZE_FULL   = "full"
+)
+
+var IMAGE_JPEG_QUALITY = 75
+
+// longest edge in pixels of each size; originals larger than full are
+// scaled down too
+var imageSizes = []struct {
+	name    string
+	maxEdge int
+}{
+	{IMAGE_SIZE_THUMB, 200},
+	{IMAGE_SIZE_MEDIUM, 800},
+	{IMAGE_SIZE_FULL, 2048},
+}
+
+func isValidImageSize(size string) bool {
+	for _, imageSize := range imageSizes {
+		if imageSize.name == size {
+			return true
+		}
+	}
+	return false
+}
+
+// resizeImage scales img down so its longest edge is at most maxEdge,
+// averaging the source pixels covered by each destination pixel. Images that
+// already fit are returned as is.
+func resizeImage(img image.Image, maxEdge int) image.Image {
+	bounds := img.Bounds()
+	srcW, srcH := bounds.Dx(), bounds.Dy()
+	if srcW <= maxEdge && srcH <= maxEdge {
+		return img
+	}
+	dstW, dstH := maxEdge, maxEdge
+	if srcW > srcH {
+		dstH = srcH * maxEdge / srcW
+	} else {
+		dstW = srcW * maxEdge / srcH
+	}
+	if dstW < 1 {
+		dstW = 1
+	}
+	if dstH < 1 {
+		dstH = 1
+	}
+
+	// work on the pixels directly; img.At per pixel is far too slow
+	src, ok := img.(*image.RGBA)
+	if !ok {
+		src = image.NewRGBA(image.Rect(0, 0, srcW, srcH))
+		draw.Draw(src, src.Bounds(), img, bounds.Min, draw.Src)
+	}
+	srcBounds := src.Bounds()
+
+	dst := image.NewRGBA(image.Rect(0, 0, dstW, dstH))
+	for y := 0; y < dstH; y++ {
+		y0 := srcBounds.Min.Y + y*srcH/dstH
+		y1 := srcBounds.Min.Y + (y+1)*srcH/dstH
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < dstW; x++ {
+			x0 := srcBounds.Min.X + x*srcW/dstW
+			x1 := srcBounds.Min.X + (x+1)*srcW/dstW
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+			var sum [4]int
+			for sy := y0; sy < y1; sy++ {
+				row := src.Pix[src.PixOffset(x0, sy):src.PixOffset(x1, sy)]
+				for i := 0; i < len(row); i += 4 {
+					sum[0] += int(row[i])
+					sum[1] += int(row[i+1])
+					sum[2] += int(row[i+2])
+					sum[3] += int(row[i+3])
+				}
+			}
+			n := (y1 - y0) * (x1 - x0)
+			pixel := dst.Pix[dst.PixOffset(x, y):]
+			for c := 0; c < 4; c++ {
+				pixel[c] = uint8(sum[c] / n)
+			}
+		}
+	}
+	return dst
+}
+
+func encodeJpeg(img image.Image) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: IMAGE_JPEG_QUALITY}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// workers generating the variants of new uploads, and how many uploads may
+// wait for one; uploads beyond that are left to the backfill
+var IMAGE_VARIANT_WORKERS = 2
+var IMAGE_VARIANT_QUEUE_SIZE = 100
+
+type imageVariantJob struct {
+	db *gorm.DB
+	id uint
+}
+
+var imageVariantQueue chan imageVariantJob
+var startImageVariantWorkers sync.Once
+
+// SaveImageVariants stores img as the full size JPEG that plants refer to,
+// recording capturedAt. The other sizes hang off it by OriginalID
+// and are generated in the background; until then FindImageVariant stands in
+// the full size.
+func SaveImageVariants(db *gorm.DB, img image.Image, capturedAt *time.Time) (*ImageModel, error) {
+	img = resizeImage(img, imageSizes[len(imageSizes)-1].maxEdge)
+	data, err := encodeJpeg(img)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("Encoded %s %s image: %dx%d, %d bytes\n", IMAGE_SIZE_FULL, IMAGE_TYPE_JPEG, img.Bounds().Dx(), img.Bounds().Dy(), len(data))
+	original := &ImageModel{Name: "image.jpg", CapturedAt: capturedAt}
+	if err := putImage(db, original, data); err != nil {
+		return nil, err
+	}
+	if !queueImageVariants(db, original.ID) {
+		fmt.Printf("Variant queue is full, leaving image %d to the backfill\n", original.ID)
+	}
+	return original, nil
+}
+
+// queueImageVariants queues image id to have its variants generated, starting
+// the workers on first use. It returns false if the queue is full.
+func queueImageVariants(db *gorm.DB, id uint) bool {
+	startImageVariantWorkers.Do(func() {
+		imageVariantQueue = make(chan imageVariantJob, IMAGE_VARIANT_QUEUE_SIZE)
+		for i := 0; i < IMAGE_VARIANT_WORKERS; i++ {
+			go imageVariantWorker(imageVariantQueue)
+		}
+	})
+	select {
+	case imageVariantQueue <- imageVariantJob{db, id}:
+		return true
+	default:
+		return false
+	}
+}
+
+func imageVariantWorker(queue chan imageVariantJob) {
+	for job := range queue {
+		generateQueuedImageVariants(job.db, job.id)
+	}
+}
+
+// generateQueuedImageVariants loads and generates the variants of a new
+// image. Only workers hold decoded images, so memory is bounded by their
+// number and not by how many uploads are waiting. Whatever it fails to
+// generate is left to the backfill-image-variants command.
+func generateQueuedImageVariants(db *gorm.DB, id uint) {
+	missing, err := missingImageVariants(db, id)
+	if err == nil && len(missing) > 0 {
+		var data []byte
+		_, data, err = LoadImage(db, id)
+		if err == nil {
+			var img image.Image
+			img, _, err = image.Decode(bytes.NewReader(data))
+			if err == nil {
+				_, err = generateImageVariants(db, id, img, missing)
+			}
+		}
+	}
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		fmt.Printf("Failed generating variants of image %d: %v\n", id, err)
+	}
+
+	// the upload is discarded if what it was for failed to save
+	var count int64
+	if err := db.Model(&ImageModel{}).Where("id = ?", id).Count(&count).Error; err != nil || count > 0 {
+		return
+	}
+	var variantIds []uint
+	if err := db.Model(&ImageModel{}).Where("original_id = ?", id).Pluck("id", &variantIds).Error; err != nil {
+		fmt.Printf("Failed finding variants of discarded image %d: %v\n", id, err)
+		return
+	}
+	for _, variantId := range variantIds {
+		if err := DeleteImage(db, variantId); err != nil {
+			fmt.Printf("Failed cleaning up image %d: %v\n", variantId, err)
+		}
+	}
+}
+
+func saveImageVariant(db *gorm.DB, originalId uint, size string, extension string, data []byte) (*ImageModel, error) {
+	variant := &ImageModel{
+		Name:       fmt.Sprintf("image-%s%s", size, extension),
+		OriginalID: originalId,
+		Size:       size,
+	}
+	if err := putImage(db, variant, data); err != nil {
+		return nil, err
+	}
+	return variant, nil
+}
+
+// FindImageVariant returns the record for image id at the given size. exact
+// is false if the size hasn't been generated and the full size was returned
+// instead.
+func FindImageVariant(db *gorm.DB, id uint, size string) (*ImageModel, bool, error) {
+	if !isValidImageSize(size) {
+		return nil, false, errors.New("Invalid image size.")
+	}
+	var image ImageModel
+	if size != IMAGE_SIZE_FULL {
+		// variants from before content types were recorded are all JPEG
+		err := db.Where("original_id = ? AND size = ? AND (content_type IS NULL OR content_type <> ?)", id, size, IMAGE_TYPE_WEBP).First(&image).Error
+		if err == nil {
+			return &image, true, nil
+		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, false, err
+		}
+	}
+	if err := db.First(&image, id).Error; err != nil {
+		return nil, false, err
+	}
+	return &image, size == IMAGE_SIZE_FULL, nil
+}
+
+// BackfillImageVariants generates missing variants for images stored before
+// variants existed.
+func BackfillImageVariants(db *gorm.DB) (int, error) {
+	var ids []uint
+	err := db.Model(&ImageModel{}).
+		Where("original_id = 0 OR original_id IS NULL").
+		Order("id asc").
+		Pluck("id", &ids).Error
+	if err != nil {
+		return 0, err
+	}
+	fmt.Printf("Checking %d image(s) for missing variants\n", len(ids))
+
+	generated := 0
+	for _, id := range ids {
+		missing, err := missingImageVariants(db, id)
+		if err != nil {
+			return generated, err
+		}
+		if len(missing) == 0 {
+			continue
+		}
+
+		_, data, err := LoadImage(db, id)
+		if err != nil {
+			fmt.Printf("Skipping image %d, failed loading: %v\n", id, err)
+			continue
+		}
+		img, _, err := image.Decode(bytes.NewReader(data))
+		if err != nil {
+			fmt.Printf("Skipping image %d, failed decoding: %v\n", id, err)
+			continue
+		}
+		n, err := generateImageVariants(db, id, img, missing)
+		generated += n
+		if err != nil {
+			return generated, err
+		}
+	}
+	fmt.Printf("Generated %d image variant(s)\n", generated)
+	return generated, nil
+}
+
+// missingImageVariants lists the sizes image id has yet to get.
+func missingImageVariants(db *gorm.DB, id uint) ([]string, error) {
+	var existing []ImageModel
+	err := db.Select("size", "content_type").Where("original_id = ?", id).Find(&existing).Error
+	if err != nil {
+		return nil, err
+	}
+	var missing []string
+	for _, size := range imageSizes {
+		// the original is the full size
+		if size.name == IMAGE_SIZE_FULL {
+			continue
+		}
+		found := false
+		for _, variant := range existing {
+			if variant.Size == size.name && variant.ContentType != IMAGE_TYPE_WEBP {
+				found = true
+			}
+		}
+		if !found {
+			missing = append(missing, size.name)
+		}
+	}
+	return missing, nil
+}
+
+// generateImageVariants stores the missing sizes of image id, scaled from
+// img, and returns how many it stored.
+func generateImageVariants(db *gorm.DB, id uint, img image.Image, missing []string) (int, error) {
+	generated := 0
+	// largest first, so smaller sizes can be scaled from the previous one
+	for i := len(imageSizes) - 1; i >= 0; i-- {
+		size := imageSizes[i]
+		img = resizeImage(img, size.maxEdge)
+		if !containsString(missing, size.name) {
+			continue
+		}
+		data, err := encodeJpeg(img)
+		if err != nil {
+			return generated, err
+		}
+		if _, err := saveImageVariant(db, id, size.name, ".jpg", data); err != nil {
+			return generated, err
+		}
+		generated++
+	}
+	return generated, nil
+}
@@ -0,0 +1,194 @@
+package app
+
+import (
+	"image"
+	"image/color"
+	"sync"
+	"testing"
+)
+
+// the average of the source pixels each destination pixel covers, the slow way
+func referenceResize(img image.Image, dstW int, dstH int) *image.RGBA {
+	bounds := img.Bounds()
+	srcW, srcH := bounds.Dx(), bounds.Dy()
+	dst := image.NewRGBA(image.Rect(0, 0, dstW, dstH))
+	for y := 0; y < dstH; y++ {
+		y0, y1 := bounds.Min.Y+y*srcH/dstH, bounds.Min.Y+(y+1)*srcH/dstH
+		for x := 0; x < dstW; x++ {
+			x0, x1 := bounds.Min.X+x*srcW/dstW, bounds.Min.X+(x+1)*srcW/dstW
+			var sum [4]int
+			for sy := y0; sy < max(y1, y0+1); sy++ {
+				for sx := x0; sx < max(x1, x0+1); sx++ {
+					c := color.RGBAModel.Convert(img.At(sx, sy)).(color.RGBA)
+					sum[0] += int(c.R)
+					sum[1] += int(c.G)
+					sum[2] += int(c.B)
+					sum[3] += int(c.A)
+				}
+			}
+			n := (max(y1, y0+1) - y0) * (max(x1, x0+1) - x0)
+			dst.SetRGBA(x, y, color.RGBA{uint8(sum[0] / n), uint8(sum[1] / n), uint8(sum[2] / n), uint8(sum[3] / n)})
+		}
+	}
+	return dst
+}
+
+func TestResizeImage(t *testing.T) {
+	gradient := func(img interface{ Set(int, int, color.Color) }, bounds image.Rectangle) {
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				img.Set(x, y, color.NRGBA{uint8(x * 7), uint8(y * 3), uint8(x ^ y), uint8(128 + x%128)})
+			}
+		}
+	}
+	rgba := image.NewRGBA(image.Rect(0, 0, 301, 97))
+	gradient(rgba, rgba.Bounds())
+	nrgba := image.NewNRGBA(image.Rect(0, 0, 97, 301))
+	gradient(nrgba, nrgba.Bounds())
+	// a sub-image, so its bounds don't start at the origin
+	offset := rgba.SubImage(image.Rect(50, 10, 250, 90))
+	ycbcr := image.NewYCbCr(image.Rect(0, 0, 640, 480), image.YCbCrSubsampleRatio420)
+	for i := range ycbcr.Y {
+		ycbcr.Y[i] = uint8(i)
+	}
+
+	cases := []struct {
+		name       string
+		img        image.Image
+		maxEdge    int
+		dstW, dstH int
+	}{
+		{"wide", rgba, 100, 100, 32},
+		{"tall", nrgba, 100, 32, 100},
+		{"offset", offset, 64, 64, 25},
+		{"ycbcr", ycbcr, 200, 200, 150},
+		{"thin", image.NewRGBA(image.Rect(0, 0, 1000, 1)), 10, 10, 1},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			resized := resizeImage(c.img, c.maxEdge)
+			if resized.Bounds() != image.Rect(0, 0, c.dstW, c.dstH) {
+				t.Fatalf("bounds %v, expected %dx%d", resized.Bounds(), c.dstW, c.dstH)
+			}
+			expected := referenceResize(c.img, c.dstW, c.dstH)
+			got := resized.(*image.RGBA)
+			for i := range expected.Pix {
+				if diff := int(got.Pix[i]) - int(expected.Pix[i]); diff < -1 || diff > 1 {
+					t.Fatalf("pixel byte %d is %d, expected %d", i, got.Pix[i], expected.Pix[i])
+				}
+			}
+		})
+	}
+
+	small := image.NewRGBA(image.Rect(0, 0, 10, 10))
+	if resizeImage(small, 10) != image.Image(small) {
+		t.Error("images that fit should be returned as is")
+	}
+}
+
+// useImageVariantQueue swaps in a queue of size that no worker reads.
+func useImageVariantQueue(t *testing.T, size int) chan imageVariantJob {
+	startImageVariantWorkers.Do(func() {})
+	saved := imageVariantQueue
+	imageVariantQueue = make(chan imageVariantJob, size)
+	t.Cleanup(func() {
+		imageVariantQueue = saved
+		if saved == nil {
+			startImageVariantWorkers = sync.Once{}
+		}
+	})
+	return imageVariantQueue
+}
+
+func TestImageVariantQueue(t *testing.T) {
+	db := newTestDb(t)
+	queue := useImageVariantQueue(t, 1)
+	img := image.NewRGBA(image.Rect(0, 0, 1000, 600))
+
+	queued, err := SaveImageVariants(db, img, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the queue is full, so this one is left to the backfill
+	left, err := SaveImageVariants(db, img, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(queue) != 1 {
+		t.Fatalf("%d uploads queued, expected 1", len(queue))
+	}
+	job := <-queue
+	if job.id != queued.ID {
+		t.Fatalf("queued image %d, expected %d", job.id, queued.ID)
+	}
+
+	generateQueuedImageVariants(job.db, job.id)
+	if missing, err := missingImageVariants(db, queued.ID); err != nil || len(missing) > 0 {
+		t.Errorf("still missing %v, %v", missing, err)
+	}
+	if missing, err := missingImageVariants(db, left.ID); err != nil || len(missing) == 0 {
+		t.Errorf("expected the upload that wasn't queued to have no variants, %v", err)
+	}
+	if generated, err := BackfillImageVariants(db); err != nil || generated == 0 {
+		t.Errorf("backfill generated %d, %v", generated, err)
+	}
+}
+
+func TestImageVariantsOfDiscardedUpload(t *testing.T) {
+	db := newTestDb(t)
+	queue := useImageVariantQueue(t, 1)
+	img := image.NewRGBA(image.Rect(0, 0, 1000, 600))
+
+	original, err := SaveImageVariants(db, img, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job := <-queue
+	generateQueuedImageVariants(job.db, job.id)
+	if err := DeleteImage(db, original.ID); err != nil {
+		t.Fatal(err)
+	}
+	// a worker that gets to it after it was discarded cleans up its variants
+	generateQueuedImageVariants(job.db, job.id)
+	var count int64
+	db.Unscoped().Model(&ImageModel{}).Where("original_id = ?", original.ID).Count(&count)
+	if count != 0 {
+		t.Errorf("%d variants left of a discarded upload", count)
+	}
+}
+
+func TestFindImageVariant(t *testing.T) {
+	db := newTestDb(t)
+	useImageVariantQueue(t, 1)
+	original, err := SaveImageVariants(db, image.NewRGBA(image.Rect(0, 0, 1000, 600)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// left from when WebP was served
+	webp := &ImageModel{Name: "image-thumb.webp", OriginalID: original.ID, Size: IMAGE_SIZE_THUMB}
+	if err := db.Create(webp).Error; err != nil {
+		t.Fatal(err)
+	}
+	db.Model(webp).Update("content_type", IMAGE_TYPE_WEBP)
+
+	img, exact, err := FindImageVariant(db, original.ID, IMAGE_SIZE_THUMB)
+	if err != nil || exact || img.ID != original.ID {
+		t.Errorf("expected the full size to stand in for a missing thumbnail, got %d, %t, %v", img.ID, exact, err)
+	}
+	if err := dropWebpImageVariants(db); err != nil {
+		t.Fatal(err)
+	}
+	var count int64
+	db.Unscoped().Model(&ImageModel{}).Where("content_type = ?", IMAGE_TYPE_WEBP).Count(&count)
+	if count != 0 {
+		t.Errorf("%d WebP variants left", count)
+	}
+
+	if _, err := generateImageVariants(db, original.ID, image.NewRGBA(image.Rect(0, 0, 1000, 600)), []string{IMAGE_SIZE_THUMB}); err != nil {
+		t.Fatal(err)
+	}
+	img, exact, err = FindImageVariant(db, original.ID, IMAGE_SIZE_THUMB)
+	if err != nil || !exact || img.ContentType != IMAGE_TYPE_JPEG || img.Size != IMAGE_SIZE_THUMB {
+		t.Errorf("expected the JPEG thumbnail, got %+v, %t, %v", img, exact, err)
+	}
+}
@@ -0,0 +1,165 @@
+// outbound email delivery
+package app
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+type EmailMessage struct {
+	To        string
+	ToName    string
+	Subject   string
+	PlainText string
+	Html      string
+}
+
+// Mailer delivers a rendered email message.
+type Mailer interface {
+	Send(msg *EmailMessage) error
+}
+
+// SmtpMailer sends mail through an SMTP relay, upgrading to TLS when the
+// server supports STARTTLS.
+type SmtpMailer struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	From     string
+}
+
+// FileMailer writes each message to Dir as an .eml file, or to stdout if Dir
+// is empty. Useful for local development where no relay is available.
+type FileMailer struct {
+	Dir string
+}
+
+var mailer Mailer = &FileMailer{}
+
+func InitMailer(m Mailer) {
+	mailer = m
+}
+
+// NewMailerFromEnv builds an SmtpMailer if SMTP_HOST is set. Only with
+// DEBUG=true may SMTP_HOST be left unset, for a FileMailer writing to
+// EMAIL_SINK_DIR; anywhere else that would quietly drop every email.
+func NewMailerFromEnv() (Mailer, error) {
+	host := os.Getenv("SMTP_HOST")
+	if host == "" {
+		if os.Getenv("DEBUG") != "true" {
+			return nil, errors.New("SMTP_HOST must be set unless DEBUG=true")
+		}
+		fmt.Printf("SMTP_HOST not set, writing emails to '%s'\n", os.Getenv("EMAIL_SINK_DIR"))
+		return &FileMailer{Dir: os.Getenv("EMAIL_SINK_DIR")}, nil
+	}
+	port := 587
+	if os.Getenv("SMTP_PORT") != "" {
+		var err error
+		port, err = strconv.Atoi(os.Getenv("SMTP_PORT"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid SMTP_PORT %s", os.Getenv("SMTP_PORT"))
+		}
+	}
+	from := os.Getenv("EMAIL_SENDER_ADDRESS")
+	if from == "" {
+		return nil, errors.New("EMAIL_SENDER_ADDRESS must be set when SMTP_HOST is set")
+	}
+	return &SmtpMailer{
+		Host:     host,
+		Port:     port,
+		Username: os.Getenv("SMTP_USERNAME"),
+		Password: os.Getenv("SMTP_PASSWORD"),
+		From:     from,
+	}, nil
+}
+
+func (m *SmtpMailer) Send(msg *EmailMessage) error {
+	body, err := buildMimeMessage(m.From, msg)
+	if err != nil {
+		return err
+	}
+	var auth smtp.Auth
+	if m.Username != "" {
+		auth = smtp.PlainAuth("", m.Username, m.Password, m.Host)
+	}
+	addr := fmt.Sprintf("%s:%d", m.Host, m.Port)
+	return smtp.SendMail(addr, auth, m.From, []string{msg.To}, body)
+}
+
+func (m *FileMailer) Send(msg *EmailMessage) error {
+	body, err := buildMimeMessage("plantmindr@localhost", msg)
+	if err != nil {
+		return err
+	}
+	if m.Dir == "" {
+		fmt.Printf("---- email to %s ----\n%s\n---- end email ----\n", msg.To, body)
+		return nil
+	}
+	if err := os.MkdirAll(m.Dir, 0755); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%d-%s.eml", time.Now().UnixNano(), msg.To)
+	return os.WriteFile(filepath.Join(m.Dir, name), body, 0644)
+}
+
+// buildMimeMessage renders msg as a multipart/alternative message with a
+// plain text and an HTML part.
+func buildMimeMessage(from string, msg *EmailMessage) ([]byte, error) {
+	var buf bytes.Buffer
+	writer := multipart.NewWriter(&buf)
+
+	to := mail.Address{Name: msg.ToName, Address: msg.To}
+	fmt.Fprintf(&buf, "From: %s\r\n", from)
+	fmt.Fprintf(&buf, "To: %s\r\n", to.String())
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mimeEncodeHeader(msg.Subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&buf, "Content-Type: multipart/alternative; boundary=%s\r\n\r\n", writer.Boundary())
+
+	parts := []struct {
+		contentType string
+		content     string
+	}{
+		{"text/plain; charset=UTF-8", msg.PlainText},
+		{"text/html; charset=UTF-8", msg.Html},
+	}
+	for _, part := range parts {
+		if part.content == "" {
+			continue
+		}
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Type", part.contentType)
+		header.Set("Content-Transfer-Encoding", "quoted-printable")
+		w, err := writer.CreatePart(header)
+		if err != nil {
+			return nil, err
+		}
+		qp := quotedprintable.NewWriter(w)
+		if _, err := qp.Write([]byte(part.content)); err != nil {
+			return nil, err
+		}
+		if err := qp.Close(); err != nil {
+			return nil, err
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func mimeEncodeHeader(value string) string {
+	return mime.QEncoding.Encode("UTF-8", value)
+}
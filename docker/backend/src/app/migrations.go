@@ -0,0 +1,311 @@
+// one-shot data migrations, run from InitModels
+package app
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+var careDateColumns = []string{
+	"last_water_date",
+	"last_fertilize_date",
+	"last_moist_date",
+	"last_water_notify_date",
+	"last_fertilize_notify_date",
+	"last_moist_notify_date",
+}
+
+// formats the notify dates were written in, via time.Time.String()
+var legacyTimestampLayouts = []string{
+	"2006-01-02 15:04:05.999999999 -0700 MST",
+	"2006-01-02 15:04:05 -0700 MST",
+}
+
+// parseLegacyCareDate understands every format care and notify dates were
+// ever stored in as strings.
+func parseLegacyCareDate(value string) (time.Time, error) {
+	date, err := parseCareDate(value)
+	if err == nil {
+		return date, nil
+	}
+	// drop the monotonic clock reading time.Time.String() can append
+	if i := strings.Index(value, " m="); i >= 0 {
+		value = value[:i]
+	}
+	for _, layout := range legacyTimestampLayouts {
+		date, err = time.Parse(layout, value)
+		if err == nil {
+			return date, nil
+		}
+	}
+	return date, err
+}
+
+// legacyCareDateColumns returns the care date columns of plant_models that
+// are still strings.
+func legacyCareDateColumns(db *gorm.DB) ([]string, error) {
+	if !db.Migrator().HasTable(&PlantModel{}) {
+		return nil, nil
+	}
+	columnTypes, err := db.Migrator().ColumnTypes(&PlantModel{})
+	if err != nil {
+		return nil, err
+	}
+	var legacy []string
+	for _, columnType := range columnTypes {
+		for _, column := range careDateColumns {
+			typeName := strings.ToUpper(columnType.DatabaseTypeName())
+			if columnType.Name() == column && (strings.Contains(typeName, "TEXT") || strings.Contains(typeName, "CHAR")) {
+				legacy = append(legacy, column)
+			}
+		}
+	}
+	return legacy, nil
+}
+
+// migrateCareDates converts string care date columns to timestamps. The old
+// columns are renamed to <column>_legacy and kept, so that any value that
+// could not be parsed is still available after the migration reports it.
+// Runs in a transaction so a failure leaves the string columns untouched.
+func migrateCareDates(db *gorm.DB) error {
+	return db.Transaction(migrateCareDatesTx)
+}
+
+func migrateCareDatesTx(db *gorm.DB) error {
+	legacy, err := legacyCareDateColumns(db)
+	if err != nil {
+		return err
+	}
+	if len(legacy) == 0 {
+		return nil
+	}
+	log := func(format string, args ...interface{}) {
+		fmt.Printf("[migrateCareDates] "+format+"\n", args...)
+	}
+	log("Converting %v to timestamps", legacy)
+
+	for _, column := range legacy {
+		if err := db.Migrator().RenameColumn(&PlantModel{}, column, column+"_legacy"); err != nil {
+			return err
+		}
+	}
+	for _, column := range legacy {
+		if err := db.Migrator().AddColumn(&PlantModel{}, column); err != nil {
+			return err
+		}
+	}
+
+	rows, err := db.Table("plant_models").Select(append([]string{"id"}, legacyColumnNames(legacy)...)).Rows()
+	if err != nil {
+		return err
+	}
+	type conversion struct {
+		id      uint
+		updates map[string]interface{}
+	}
+	var conversions []conversion
+	converted := 0
+	failed := 0
+	for rows.Next() {
+		var id uint
+		values := make([]*string, len(legacy))
+		dest := []interface{}{&id}
+		for i := range values {
+			dest = append(dest, &values[i])
+		}
+		if err := rows.Scan(dest...); err != nil {
+			rows.Close()
+			return err
+		}
+		updates := map[string]interface{}{}
+		for i, column := range legacy {
+			if values[i] == nil || strings.TrimSpace(*values[i]) == "" {
+				continue
+			}
+			date, err := parseLegacyCareDate(strings.TrimSpace(*values[i]))
+			if err != nil {
+				log("Plant %d: could not convert %s=%q, left NULL (original kept in %s_legacy)", id, column, *values[i], column)
+				failed++
+				continue
+			}
+			updates[column] = NewCareDate(date)
+			converted++
+		}
+		if len(updates) > 0 {
+			conversions = append(conversions, conversion{id: id, updates: updates})
+		}
+	}
+	rows.Close()
+
+	for _, c := range conversions {
+		err := db.Model(&PlantModel{}).Where("id = ?", c.id).UpdateColumns(c.updates).Error
+		if err != nil {
+			return err
+		}
+	}
+	log("Converted %d value(s), %d could not be converted", converted, failed)
+	return nil
+}
+
+func legacyColumnNames(columns []string) []string {
+	var names []string
+	for _, column := range columns {
+		names = append(names, column+"_legacy")
+	}
+	return names
+}
+
+// backfillPlantPhotos starts the photo history of plants whose cover image
+// predates it. Runs after AutoMigrate, and does nothing once every cover has
+// a photo.
+func backfillPlantPhotos(db *gorm.DB) error {
+	var plants []PlantModel
+	err := db.Where("image_id <> 0").
+		Where("NOT EXISTS (SELECT 1 FROM plant_photo_models WHERE plant_photo_models.image_id = plant_models.image_id AND plant_photo_models.deleted_at IS NULL)").
+		Find(&plants).Error
+	if err != nil {
+		return err
+	}
+	for _, plant := range plants {
+		photo := PlantPhotoModel{PlantID: int(plant.ID), ImageID: uint(plant.ImageId), TakenAt: plant.UpdatedAt}
+		if err := db.Create(&photo).Error; err != nil {
+			return err
+		}
+	}
+	if len(plants) > 0 {
+		fmt.Printf("[backfillPlantPhotos] Added cover photos of %d plant(s) to their history\n", len(plants))
+	}
+	return nil
+}
+
+// backfillCareDueDates sets the due dates of plants stored before they were
+// kept. Runs after AutoMigrate; afterwards it only looks at plants whose moist
+// check predates their last watering, which have no due date to set.
+func backfillCareDueDates(db *gorm.DB) error {
+	var plants []PlantModel
+	err := db.Where("(water_due_date IS NULL AND last_water_date IS NOT NULL AND watering_frequency > 0) OR " +
+		"(fertilize_due_date IS NULL AND last_fertilize_date IS NOT NULL AND fertilizing_frequency > 0) OR " +
+		"(moist_check_due_date IS NULL AND last_moist_date IS NOT NULL)").
+		Find(&plants).Error
+	if err != nil {
+		return err
+	}
+	updated := 0
+	for i := range plants {
+		before := plants[i]
+		setCareDueDates(&plants[i])
+		if before.WaterDueDate.Equal(plants[i].WaterDueDate) && before.FertilizeDueDate.Equal(plants[i].FertilizeDueDate) && before.MoistCheckDueDate.Equal(plants[i].MoistCheckDueDate) {
+			continue
+		}
+		if err := saveCareDueDates(db, &plants[i]); err != nil {
+			return err
+		}
+		updated++
+	}
+	if updated > 0 {
+		fmt.Printf("[backfillCareDueDates] Set the care due dates of %d plant(s)\n", updated)
+	}
+	return nil
+}
+
+// dropWebpImageVariants deletes the WebP variants generated while images were
+// also served as WebP. Only JPEG is served now, so they are never read. Runs
+// after AutoMigrate, and does nothing once they are gone.
+func dropWebpImageVariants(db *gorm.DB) error {
+	var ids []uint
+	err := db.Model(&ImageModel{}).Where("original_id > 0 AND content_type = ?", IMAGE_TYPE_WEBP).Pluck("id", &ids).Error
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if err := DeleteImage(db, id); err != nil {
+			return err
+		}
+	}
+	if len(ids) > 0 {
+		fmt.Printf("[dropWebpImageVariants] Deleted %d WebP image variant(s)\n", len(ids))
+	}
+	return nil
+}
+
+// exemptOverQuotaAccounts lifts the plant limit of accounts on the default
+// tier that have more plants than it allows, which they could only have
+// stored before limits existed, so they can keep adding plants. Accounts with
+// an assigned quota are left to admins. Runs after AutoMigrate, and does
+// nothing once every such account has been exempted.
+func exemptOverQuotaAccounts(db *gorm.DB) error {
+	limit := QUOTA_TIERS[DEFAULT_QUOTA_TIER].Plants
+	if limit <= 0 {
+		return nil
+	}
+	var userIds []uint
+	err := db.Model(&PlantModel{}).
+		Where("user_id <> 0 AND user_id NOT IN (?)", db.Model(&QuotaModel{}).Select("user_id")).
+		Group("user_id").
+		Having("COUNT(*) > ?", limit).
+		Pluck("user_id", &userIds).Error
+	if err != nil {
+		return err
+	}
+	noLimit := 0
+	for _, userId := range userIds {
+		quota := QuotaModel{UserID: userId, Tier: DEFAULT_QUOTA_TIER, MaxPlants: &noLimit}
+		if err := db.Create(&quota).Error; err != nil {
+			return err
+		}
+		fmt.Printf("[exemptOverQuotaAccounts] Lifted the plant limit of user %d, who has more than %d plants\n", userId, limit)
+	}
+	return nil
+}
+
+// tables whose rows were owned by an email before they were owned by a user
+// ID, and the column that held the email. Care events belong to whoever gave
+// the care.
+var ownerEmailColumns = []struct {
+	table  string
+	column string
+}{
+	{"plant_models", "email"},
+	{"comment_models", "email"},
+	{"quota_models", "email"},
+	{"notification_preferences_models", "email"},
+	{"calendar_token_models", "email"},
+	{"care_event_models", "actor_email"},
+}
+
+// migrateOwnerIds sets user_id on rows that only have the email of their
+// owner, from the account registered with that email. The email and username
+// columns are left in place. Runs after AutoMigrate, and does nothing once
+// every row whose owner still has an account has been converted.
+func migrateOwnerIds(db *gorm.DB) error {
+	if !db.Migrator().HasTable("users") {
+		return nil
+	}
+	for _, owner := range ownerEmailColumns {
+		table, column := owner.table, owner.column
+		if !db.Migrator().HasTable(table) || !db.Migrator().HasColumn(table, column) {
+			continue
+		}
+		unconverted := db.Table(table).Where(fmt.Sprintf("(user_id IS NULL OR user_id = 0) AND %s IS NOT NULL AND %s <> ''", column, column))
+		result := unconverted.Session(&gorm.Session{}).
+			Where(fmt.Sprintf("%s IN (SELECT email FROM users WHERE deleted_at IS NULL)", column)).
+			UpdateColumn("user_id", gorm.Expr(fmt.Sprintf("(SELECT MIN(id) FROM users WHERE users.email = %s.%s AND deleted_at IS NULL)", table, column)))
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected > 0 {
+			fmt.Printf("[migrateOwnerIds] Set the owner ID of %d row(s) of %s\n", result.RowsAffected, table)
+		}
+		var orphaned int64
+		if err := unconverted.Session(&gorm.Session{}).Count(&orphaned).Error; err != nil {
+			return err
+		}
+		if orphaned > 0 {
+			fmt.Printf("[migrateOwnerIds] %d row(s) of %s belong to emails with no account\n", orphaned, table)
+		}
+	}
+	return nil
+}
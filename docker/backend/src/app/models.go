@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 type PlantLogModel struct {
@@ -17,14 +18,28 @@ type PlantLogModel struct {
 type ImageModel struct {
 	gorm.Model
 	Name string
-	Data []byte
+	// the ImageStore holding the bytes, and where in it they are
+	Store string
+	Key   string
+	// only used by the db store
+	Data        []byte
+	ContentType string
+	// hex sha256 of the bytes, used as the ETag
+	ContentHash string
+	// length of the bytes
+	ByteSize int64
+	// when the photo was taken, from its EXIF metadata
+	CapturedAt *time.Time
+	// set on resized copies, to the full size image and the copy's size
+	OriginalID uint `gorm:"index"`
+	Size       string
 }
 
 type CommentModel struct {
 	gorm.Model
 	PlantID  int    `json:"plantId"`
-	Email    string `json:"-"`
-	Username string `json:"username"`
+	UserID   uint   `json:"userId" gorm:"index"`
+	Username string `json:"username" gorm:"-"`
 	Content  string `json:"content"`
 	Viewed   bool   `json:"viewed"`
 	// allow JSON POST to leave these empty
@@ -35,31 +50,38 @@ type CommentModel struct {
 
 type PlantModel struct {
 	gorm.Model
-	Email                   string          `json:"-"`
-	Username                string          `json:"username"`
-	Name                    string          `json:"name"`
-	WateringFrequency       int             `json:"wateringFrequency"`
-	FertilizingFrequency    int             `json:"fertilizingFrequency"`
-	LastWaterDate           string          `json:"lastWaterDate"`
-	LastFertilizeDate       string          `json:"lastFertilizeDate"`
-	LastMoistDate           string          `json:"lastMoistDate"`
-	LastWaterNotifyDate     string          `json:"lastWaterNotifyDate"`
-	LastFertilizeNotifyDate string          `json:"lastFertilizeNotifyDate"`
-	LastMoistNotifyDate     string          `json:"lastMoistNotifyDate"`
-	SkippedLastFertilize    bool            `json:"skippedLastFertilize"`
-	Tag                     string          `json:"tag"`
-	ImageId                 int             `json:"imageId"`
-	IsPublic                bool            `json:"isPublic"`
-	DoNotify                bool            `json:"doNotify"`
-	Logs                    []PlantLogModel `json:"logs" gorm:"foreignKey:PlantID"`
-	Comments                []CommentModel  `json:"comments" gorm:"foreignKey:PlantID"`
-	Notes                   string          `json:"notes"`
+	UserID                  uint              `json:"userId" gorm:"index"`
+	Username                string            `json:"username" gorm:"-"`
+	HouseholdID             uint              `json:"householdId" gorm:"index"`
+	Name                    string            `json:"name"`
+	WateringFrequency       int               `json:"wateringFrequency"`
+	FertilizingFrequency    int               `json:"fertilizingFrequency"`
+	LastWaterDate           CareDate          `json:"lastWaterDate"`
+	LastFertilizeDate       CareDate          `json:"lastFertilizeDate"`
+	LastMoistDate           CareDate          `json:"lastMoistDate"`
+	LastWaterNotifyDate     CareDate          `json:"lastWaterNotifyDate"`
+	LastFertilizeNotifyDate CareDate          `json:"lastFertilizeNotifyDate"`
+	LastMoistNotifyDate     CareDate          `json:"lastMoistNotifyDate"`
+	SkippedLastFertilize    bool              `json:"skippedLastFertilize"`
+	Tag                     string            `json:"tag"`
+	ImageId                 int               `json:"imageId"`
+	IsPublic                bool              `json:"isPublic"`
+	DoNotify                bool              `json:"doNotify"`
+	Logs                    []PlantLogModel   `json:"logs" gorm:"foreignKey:PlantID"`
+	Comments                []CommentModel    `json:"comments" gorm:"foreignKey:PlantID"`
+	Photos                  []PlantPhotoModel `json:"photos" gorm:"foreignKey:PlantID"`
+	Notes                   string            `json:"notes"`
+	Version                 int               `json:"version" gorm:"not null;default:1"`
+	// when care is next due, kept up to date by setCareDueDates
+	WaterDueDate      CareDate `json:"-" gorm:"index"`
+	FertilizeDueDate  CareDate `json:"-" gorm:"index"`
+	MoistCheckDueDate CareDate `json:"-" gorm:"index"`
 }
 
 // render a plant
 func (i PlantModel) String() string {
 	return fmt.Sprintf(
-		"ID: %d, %d/%d/%d - %d:%d:%d, name=%s, waterFrequency=%d, fertilizeFrequency=%d, lastWateringDate=%s, lastFertlizeDate=%s, lastFertilizeNotifyDate=%s, lastWaterNotifyDate=%s, skippedLastFertilize=%v, username=%s, isPublic=%t, doNotify=%t\n",
+		"ID: %d, %d/%d/%d - %d:%d:%d, name=%s, waterFrequency=%d, fertilizeFrequency=%d, lastWateringDate=%s, lastFertlizeDate=%s, lastFertilizeNotifyDate=%s, lastWaterNotifyDate=%s, skippedLastFertilize=%v, userId=%d, isPublic=%t, doNotify=%t\n",
 		i.ID,
 		i.CreatedAt.Year(),
 		i.CreatedAt.Month(),
@@ -75,22 +97,31 @@ func (i PlantModel) String() string {
 		i.LastFertilizeNotifyDate,
 		i.LastWaterNotifyDate,
 		i.SkippedLastFertilize,
-		i.Username,
+		i.UserID,
 		i.IsPublic,
 		i.DoNotify,
 	)
 }
 
+// deleteOldestPlantLog makes room for one more log entry within the owner's
+// log retention.
 func deleteOldestPlantLog(db *gorm.DB, plant *PlantModel) error {
+	limits, err := GetQuotaLimits(db, plant.UserID)
+	if err != nil {
+		return err
+	}
+	if limits.PlantLogs <= 0 {
+		return nil
+	}
 	var count int64
 	result := db.Model(&PlantLogModel{}).Where("plant_id = ?", plant.ID).Count(&count)
 	if result.Error != nil {
 		return result.Error
 	}
 
-	if count > 10 {
+	if count >= int64(limits.PlantLogs) {
 		var oldestLogs []PlantLogModel
-		result = db.Where("plant_id = ?", plant.ID).Order("created_at asc").Limit(int(count) - 10).Find(&oldestLogs)
+		result = db.Where("plant_id = ?", plant.ID).Order("created_at asc").Limit(int(count) - limits.PlantLogs + 1).Find(&oldestLogs)
 		if result.Error != nil {
 			return result.Error
 		}
@@ -108,96 +139,137 @@ func deleteOldestPlantLog(db *gorm.DB, plant *PlantModel) error {
 	return nil
 }
 
-func addPlantLog(db *gorm.DB, plant *PlantModel, logMsg string) {
-	deleteOldestPlantLog(db, plant)
+func addPlantLog(db *gorm.DB, plant *PlantModel, logMsg string) error {
+	if err := deleteOldestPlantLog(db, plant); err != nil {
+		return err
+	}
 	plantLog := PlantLogModel{
 		Log: logMsg,
 	}
-	db.Model(plant).Association("Logs").Append(&plantLog)
+	return db.Model(plant).Association("Logs").Append(&plantLog)
+}
+
+// InvalidPlantError is returned for plants that can't be saved as given, as
+// opposed to ones that failed to be stored.
+type InvalidPlantError struct {
+	Reason string
+}
+
+func (e *InvalidPlantError) Error() string {
+	return e.Reason
 }
 
-func validatePlantInfo(plantName string, wateringFrequency int, lastWaterDate string, lastFertilizeDate string) error {
+func validatePlantInfo(plantName string, wateringFrequency int, lastWaterDate CareDate, lastFertilizeDate CareDate) error {
 	if plantName == "" {
-		return errors.New("Invalid plant name.")
+		return &InvalidPlantError{"Invalid plant name."}
 	}
 	if wateringFrequency == 0 {
-		return errors.New("Invalid watering frequency.")
+		return &InvalidPlantError{"Invalid watering frequency."}
 	}
-	if lastWaterDate == "" {
-		return errors.New("Invalid last watering date.")
+	if !lastWaterDate.Valid {
+		return &InvalidPlantError{"Invalid last watering date."}
 	}
-	if lastFertilizeDate == "" {
-		return errors.New("Invalid last fertilize date.")
+	if !lastFertilizeDate.Valid {
+		return &InvalidPlantError{"Invalid last fertilize date."}
 	}
 	return nil
 }
 
-func UpdatePlant(db *gorm.DB, plant *PlantModel, isNewImage bool) error {
+// ErrPlantModified is returned when a plant was edited after the version an
+// update was based on.
+var ErrPlantModified = errors.New("This plant was changed elsewhere, reload it and try again.")
+
+// UpdatePlant applies an edit to a plant, recording what changed in its log
+// and care events. A new image becomes the cover and joins the photo history.
+// Everything is written in one transaction, so a failure changes nothing.
+// If plant.Version is set, the edit only goes through while the stored plant
+// is still at that version; otherwise ErrPlantModified is returned.
+func UpdatePlant(db *gorm.DB, plant *PlantModel, isNewImage bool, actorId uint) error {
 	err := validatePlantInfo(plant.Name, plant.WateringFrequency, plant.LastWaterDate, plant.LastFertilizeDate)
 	if err != nil {
 		return err
 	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		return updatePlant(tx, plant, isNewImage, actorId)
+	})
+}
+
+func updatePlant(tx *gorm.DB, plant *PlantModel, isNewImage bool, actorId uint) error {
 	var existingplant PlantModel
-	existingplant.ID = plant.ID
-	db.Preload("Logs").First(&existingplant)
+	if err := tx.Preload("Logs").First(&existingplant, plant.ID).Error; err != nil {
+		return err
+	}
 	fmt.Printf("Existing plant: %s\n", existingplant)
-	// imageId exists by now since we process the image before calling this function to update the plant
-	if existingplant.ImageId != 0 && isNewImage {
-		fmt.Printf("isNewImage=%t, Must first remove old plant image ID=%d\n", isNewImage, existingplant.ImageId)
-		db.Delete(&ImageModel{}, existingplant.ImageId)
+	if plant.Version != 0 && plant.Version != existingplant.Version {
+		return ErrPlantModified
+	}
+	// imageId exists by now since we process the image before calling this function to update the plant.
+	// The old image stays in the plant's photo history; the new one becomes the cover.
+	if isNewImage && plant.ImageId != 0 {
+		fmt.Printf("isNewImage=%t, adding image ID=%d to photo history\n", isNewImage, plant.ImageId)
+		photo := PlantPhotoModel{PlantID: int(existingplant.ID), ImageID: uint(plant.ImageId), TakenAt: photoTakenAt(tx, uint(plant.ImageId))}
+		if err := tx.Create(&photo).Error; err != nil {
+			return err
+		}
 	}
 
 	// handle resetting notification dates
-	if existingplant.LastWaterDate != plant.LastWaterDate || existingplant.LastMoistDate != plant.LastMoistDate {
+	if !existingplant.LastWaterDate.Equal(plant.LastWaterDate) || !existingplant.LastMoistDate.Equal(plant.LastMoistDate) {
 		fmt.Println("Resetting LastWaterNotifyDate since the soil is either moist or the plant was watered!")
-		existingplant.LastWaterNotifyDate = ""
+		existingplant.LastWaterNotifyDate = CareDate{}
+	}
+	if !existingplant.LastMoistDate.Equal(plant.LastMoistDate) {
+		existingplant.LastMoistNotifyDate = CareDate{}
 	}
-	if existingplant.LastFertilizeDate != plant.LastFertilizeDate {
+	if !existingplant.LastFertilizeDate.Equal(plant.LastFertilizeDate) {
 		fmt.Println("Resetting LastFertilizeNotifyDate something has changed!")
-		existingplant.LastFertilizeNotifyDate = ""
+		existingplant.LastFertilizeNotifyDate = CareDate{}
 	}
 
 	// update the plant log
+	var logMsgs []string
 	if existingplant.IsPublic != plant.IsPublic {
-		logMsg := fmt.Sprintf("Plant changed from public=%t to public=%t", existingplant.IsPublic, plant.IsPublic)
-		addPlantLog(db, &existingplant, logMsg)
+		logMsgs = append(logMsgs, fmt.Sprintf("Plant changed from public=%t to public=%t", existingplant.IsPublic, plant.IsPublic))
 	}
 	if existingplant.Name != plant.Name {
-		logMsg := fmt.Sprintf("Name changed from %s to %s", existingplant.Name, plant.Name)
-		addPlantLog(db, &existingplant, logMsg)
+		logMsgs = append(logMsgs, fmt.Sprintf("Name changed from %s to %s", existingplant.Name, plant.Name))
 	}
-	if existingplant.LastMoistDate != plant.LastMoistDate {
-		logMsg := fmt.Sprintf("Last soil moist date changed from %s to %s", existingplant.LastMoistDate, plant.LastMoistDate)
-		addPlantLog(db, &existingplant, logMsg)
+	// care changes are recorded as structured events rather than log lines
+	var careEvents []*CareEventModel
+	if !existingplant.LastMoistDate.Equal(plant.LastMoistDate) && plant.LastMoistDate.Valid {
+		careEvents = append(careEvents, careEventAt(&existingplant, EVENT_MOIST_CHECK, plant.LastMoistDate, actorId))
 	}
-	if existingplant.LastWaterDate != plant.LastWaterDate {
-		logMsg := fmt.Sprintf("Last water date changed from %s to %s", existingplant.LastWaterDate, plant.LastWaterDate)
-		addPlantLog(db, &existingplant, logMsg)
+	if !existingplant.LastWaterDate.Equal(plant.LastWaterDate) {
+		careEvents = append(careEvents, careEventAt(&existingplant, EVENT_WATERED, plant.LastWaterDate, actorId))
 	}
-	if existingplant.LastFertilizeDate != plant.LastFertilizeDate {
-		logMsg := ""
+	if !existingplant.LastFertilizeDate.Equal(plant.LastFertilizeDate) {
 		if plant.SkippedLastFertilize {
-			logMsg = fmt.Sprintf("Fertilizing skipped, last fertilize date changed from %s to %s", existingplant.LastFertilizeDate, plant.LastFertilizeDate)
+			careEvents = append(careEvents, careEventAt(&existingplant, EVENT_SKIPPED_FERTILIZE, plant.LastFertilizeDate, actorId))
 		} else {
-			logMsg = fmt.Sprintf("Last fertilize date changed from %s to %s", existingplant.LastFertilizeDate, plant.LastFertilizeDate)
+			careEvents = append(careEvents, careEventAt(&existingplant, EVENT_FERTILIZED, plant.LastFertilizeDate, actorId))
+		}
+	}
+	for _, careEvent := range careEvents {
+		if err := AddCareEvent(tx, careEvent); err != nil {
+			return err
 		}
-		addPlantLog(db, &existingplant, logMsg)
 	}
 	if existingplant.WateringFrequency != plant.WateringFrequency {
-		logMsg := fmt.Sprintf("Watering frequency changed from %d to %d days", existingplant.WateringFrequency, plant.WateringFrequency)
-		addPlantLog(db, &existingplant, logMsg)
+		logMsgs = append(logMsgs, fmt.Sprintf("Watering frequency changed from %d to %d days", existingplant.WateringFrequency, plant.WateringFrequency))
 	}
 	if existingplant.Tag != plant.Tag {
-		logMsg := fmt.Sprintf("Tag changed from %s to %s", existingplant.Tag, plant.Tag)
-		addPlantLog(db, &existingplant, logMsg)
+		logMsgs = append(logMsgs, fmt.Sprintf("Tag changed from %s to %s", existingplant.Tag, plant.Tag))
 	}
 	if existingplant.FertilizingFrequency != plant.FertilizingFrequency {
-		logMsg := fmt.Sprintf("Fertilizing frequency changed from %d to %d days", existingplant.FertilizingFrequency, plant.FertilizingFrequency)
-		addPlantLog(db, &existingplant, logMsg)
+		logMsgs = append(logMsgs, fmt.Sprintf("Fertilizing frequency changed from %d to %d days", existingplant.FertilizingFrequency, plant.FertilizingFrequency))
 	}
 	if existingplant.Notes != plant.Notes {
-		logMsg := fmt.Sprintf("Notes changed from %s to %s", existingplant.Notes, plant.Notes)
-		addPlantLog(db, &existingplant, logMsg)
+		logMsgs = append(logMsgs, fmt.Sprintf("Notes changed from %s to %s", existingplant.Notes, plant.Notes))
+	}
+	for _, logMsg := range logMsgs {
+		if err := addPlantLog(tx, &existingplant, logMsg); err != nil {
+			return err
+		}
 	}
 	existingplant.DoNotify = plant.DoNotify
 	existingplant.IsPublic = plant.IsPublic
@@ -211,58 +283,99 @@ func UpdatePlant(db *gorm.DB, plant *PlantModel, isNewImage bool) error {
 	existingplant.LastFertilizeDate = plant.LastFertilizeDate
 	existingplant.SkippedLastFertilize = plant.SkippedLastFertilize
 	existingplant.Notes = plant.Notes
-	db.Save(existingplant)
+	setCareDueDates(&existingplant)
+	// logs were appended above. The version check makes the write fail if
+	// another edit got in since the plant was read.
+	version := existingplant.Version
+	existingplant.Version++
+	result := tx.Model(&existingplant).Where("version = ?", version).Select("*").Omit(clause.Associations).Updates(&existingplant)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrPlantModified
+	}
 	return nil
 }
 
+// AddPlant creates a plant, with its first log entry and, if it has an image,
+// its first photo, in one transaction. A QuotaExceededError is returned if the
+// owner is at their plant limit.
 func AddPlant(db *gorm.DB, plant *PlantModel) error {
 	err := validatePlantInfo(plant.Name, plant.WateringFrequency, plant.LastWaterDate, plant.LastFertilizeDate)
 	if err != nil {
 		return err
 	}
-	// Delete old records if the limit has been reached
-	var count int64
-	db.Model(&PlantModel{}).Count(&count)
-	if count > 500 {
-		fmt.Printf("DB has %d plants.", count)
-		var plants []PlantModel
-		db.Order("id asc").Limit(int(count) - 500).Find(&plants)
-		db.Delete(&plants)
-	}
-	plant.LastWaterNotifyDate = ""
-	plant.LastFertilizeNotifyDate = ""
-	plant.LastMoistDate = ""
-	plant.Notes = ""
-	plant.Logs = []PlantLogModel{
-		{Log: "Created plant!"},
-	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := checkPlantQuota(tx, plant.UserID); err != nil {
+			return err
+		}
+		plant.LastWaterNotifyDate = CareDate{}
+		plant.LastFertilizeNotifyDate = CareDate{}
+		plant.LastMoistDate = CareDate{}
+		plant.LastMoistNotifyDate = CareDate{}
+		plant.Notes = ""
+		setCareDueDates(plant)
+		plant.Logs = []PlantLogModel{
+			{Log: "Created plant!"},
+		}
+
+		log.Printf("Adding plant %v", plant)
 
-	log.Printf("Adding plant %v", plant)
+		if err := tx.Create(plant).Error; err != nil {
+			return err
+		}
+		if plant.ImageId != 0 {
+			photo := PlantPhotoModel{PlantID: int(plant.ID), ImageID: uint(plant.ImageId), TakenAt: photoTakenAt(tx, uint(plant.ImageId))}
+			if err := tx.Create(&photo).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
 
-	err = db.Create(&plant).Error
+// DeletePlant removes a plant with its photos and care history in one
+// transaction. Its images, which may live outside the database, are removed
+// once that has committed; failing to remove one is only logged.
+func DeletePlant(db *gorm.DB, plant *PlantModel) error {
+	// including a cover image that predates photo history
+	imageIds := []uint{uint(plant.ImageId)}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var photoImageIds []uint
+		if err := tx.Model(&PlantPhotoModel{}).Where("plant_id = ?", plant.ID).Pluck("image_id", &photoImageIds).Error; err != nil {
+			return err
+		}
+		imageIds = append(imageIds, photoImageIds...)
+		if err := tx.Where("plant_id = ?", plant.ID).Delete(&PlantPhotoModel{}).Error; err != nil {
+			return err
+		}
+		// care events are deleted for good, as when they expire
+		if err := tx.Unscoped().Where("plant_id = ?", plant.ID).Delete(&CareEventModel{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&PlantModel{}, plant.ID).Error
+	})
 	if err != nil {
 		return err
 	}
-	db.Save(plant)
+	for _, imageId := range imageIds {
+		if err := DeleteImage(db, imageId); err != nil {
+			fmt.Printf("Failed deleting image %d of deleted plant %d: %v\n", imageId, plant.ID, err)
+		}
+	}
 	return nil
 }
 
-func AddComment(db *gorm.DB, content string, email string, username string, plantId int) error {
-	// Delete old records if the limit has been reached
-	var count int64
-	db.Model(&CommentModel{}).Count(&count)
-	if count > 50 {
-		fmt.Printf("DB has %d plants.", count)
-		var comments []CommentModel
-		db.Order("id asc").Limit(int(count) - 50).Find(&comments)
-		db.Delete(&comments)
+func AddComment(db *gorm.DB, content string, userId uint, plantId int) error {
+	if err := checkCommentQuota(db, userId); err != nil {
+		return err
 	}
 	comment := &CommentModel{
-		Content:  content,
-		Username: username,
-		Email:    email,
-		PlantID:  plantId,
-		Viewed:   false,
+		Content: content,
+		UserID:  userId,
+		PlantID: plantId,
+		Viewed:  false,
 	}
 	err := db.Create(&comment).Error
 	if err != nil {
@@ -278,6 +391,16 @@ func InitModels(db *gorm.DB, dropTables bool) {
 		&PlantModel{},
 		&CommentModel{},
 		&ImageModel{},
+		&OutboxEmailModel{},
+		&NotificationPreferencesModel{},
+		&CareEventModel{},
+		&CalendarTokenModel{},
+		&PlantPhotoModel{},
+		&QuotaModel{},
+		&HouseholdModel{},
+		&HouseholdMemberModel{},
+		&HouseholdInviteModel{},
+		&SitterGrantModel{},
 	}
 
 	if dropTables {
@@ -287,9 +410,33 @@ func InitModels(db *gorm.DB, dropTables bool) {
 		}
 	}
 
+	if err := migrateCareDates(db); err != nil {
+		log.Printf("Failed migrating care dates: %v", err)
+	}
+
 	log.Printf("Initializing models...\n")
 
 	for _, model := range models {
 		db.AutoMigrate(model)
 	}
+
+	if err := migrateOwnerIds(db); err != nil {
+		log.Printf("Failed migrating owners to user IDs: %v", err)
+	}
+
+	if err := backfillPlantPhotos(db); err != nil {
+		log.Printf("Failed backfilling plant photos: %v", err)
+	}
+
+	if err := backfillCareDueDates(db); err != nil {
+		log.Printf("Failed backfilling care due dates: %v", err)
+	}
+
+	if err := dropWebpImageVariants(db); err != nil {
+		log.Printf("Failed deleting WebP image variants: %v", err)
+	}
+
+	if err := exemptOverQuotaAccounts(db); err != nil {
+		log.Printf("Failed exempting accounts over their plant limit: %v", err)
+	}
 }
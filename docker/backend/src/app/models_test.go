@@ -0,0 +1,44 @@
+package app
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// only edits that can't be saved as given are InvalidPlantErrors, which the
+// API answers with 400; other failures are the server's
+func TestUpdatePlantErrors(t *testing.T) {
+	db := newTestDb(t)
+	userId := createTestUser(t, db, "alice")
+	lastCare := NewCareDate(time.Now().AddDate(0, 0, -1))
+	plant := createTestPlant(t, db, PlantModel{UserID: userId, Name: "fern", WateringFrequency: 7, LastWaterDate: lastCare, LastFertilizeDate: lastCare})
+
+	invalid := plant
+	invalid.Name = ""
+	var invalidErr *InvalidPlantError
+	if err := UpdatePlant(db, &invalid, false, userId); !errors.As(err, &invalidErr) {
+		t.Errorf("expected an InvalidPlantError for a missing name, got %v", err)
+	}
+
+	stale := plant
+	stale.Version = plant.Version + 1
+	if err := UpdatePlant(db, &stale, false, userId); !errors.Is(err, ErrPlantModified) {
+		t.Errorf("expected ErrPlantModified, got %v", err)
+	}
+
+	missing := plant
+	missing.ID = plant.ID + 100
+	err := UpdatePlant(db, &missing, false, userId)
+	if !errors.Is(err, gorm.ErrRecordNotFound) || errors.As(err, &invalidErr) {
+		t.Errorf("expected a missing plant not to be an InvalidPlantError, got %v", err)
+	}
+
+	valid := plant
+	valid.Name = "maidenhair fern"
+	if err := UpdatePlant(db, &valid, false, userId); err != nil {
+		t.Errorf("valid edit refused: %v", err)
+	}
+}
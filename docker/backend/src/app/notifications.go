@@ -0,0 +1,170 @@
+// per-user notification preferences
+package app
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	NOTIFY_IMMEDIATE = "immediate"
+	NOTIFY_DAILY     = "daily"
+	NOTIFY_WEEKLY    = "weekly"
+)
+
+var DEFAULT_TIME_ZONE = "America/New_York"
+
+type NotificationPreferencesModel struct {
+	gorm.Model
+	UserID    uint   `json:"-" gorm:"uniqueIndex"`
+	Frequency string `json:"frequency"`
+	// quiet hours are local hours [start, end), disabled when equal
+	QuietHoursStart int        `json:"quietHoursStart"`
+	QuietHoursEnd   int        `json:"quietHoursEnd"`
+	TimeZone        string     `json:"timeZone"`
+	DigestHour      int        `json:"digestHour"`
+	DigestWeekday   int        `json:"digestWeekday"`
+	LastDigestAt    *time.Time `json:"lastDigestAt"`
+}
+
+func defaultNotificationPreferences(userId uint) NotificationPreferencesModel {
+	return NotificationPreferencesModel{
+		UserID:          userId,
+		Frequency:       NOTIFY_DAILY,
+		QuietHoursStart: 22,
+		QuietHoursEnd:   7,
+		TimeZone:        DEFAULT_TIME_ZONE,
+		DigestHour:      8,
+		DigestWeekday:   int(time.Saturday),
+	}
+}
+
+// GetNotificationPreferences loads a user's preferences, falling back to the
+// defaults (with a zero ID) if the user never saved any.
+func GetNotificationPreferences(db *gorm.DB, userId uint, prefs *NotificationPreferencesModel) error {
+	result := db.Where("user_id = ?", userId).Limit(1).Find(prefs)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		*prefs = defaultNotificationPreferences(userId)
+	}
+	return nil
+}
+
+func validateNotificationPreferences(prefs *NotificationPreferencesModel) error {
+	switch prefs.Frequency {
+	case NOTIFY_IMMEDIATE, NOTIFY_DAILY, NOTIFY_WEEKLY:
+	default:
+		return errors.New("Invalid notification frequency.")
+	}
+	if prefs.QuietHoursStart < 0 || prefs.QuietHoursStart > 23 || prefs.QuietHoursEnd < 0 || prefs.QuietHoursEnd > 23 {
+		return errors.New("Invalid quiet hours.")
+	}
+	if prefs.DigestHour < 0 || prefs.DigestHour > 23 {
+		return errors.New("Invalid digest hour.")
+	}
+	if prefs.DigestWeekday < 0 || prefs.DigestWeekday > 6 {
+		return errors.New("Invalid digest weekday.")
+	}
+	// digests are held back during quiet hours, so one due inside them would
+	// never be sent
+	if prefs.Frequency != NOTIFY_IMMEDIATE && prefs.inQuietHours(prefs.DigestHour) {
+		return errors.New("The digest hour can't be during quiet hours.")
+	}
+	if _, err := time.LoadLocation(prefs.TimeZone); err != nil || prefs.TimeZone == "" {
+		return errors.New("Invalid time zone.")
+	}
+	return nil
+}
+
+func UpdateNotificationPreferences(db *gorm.DB, userId uint, prefs *NotificationPreferencesModel) error {
+	if err := validateNotificationPreferences(prefs); err != nil {
+		return err
+	}
+	var existing NotificationPreferencesModel
+	if err := GetNotificationPreferences(db, userId, &existing); err != nil {
+		return err
+	}
+	existing.Frequency = prefs.Frequency
+	existing.QuietHoursStart = prefs.QuietHoursStart
+	existing.QuietHoursEnd = prefs.QuietHoursEnd
+	existing.TimeZone = prefs.TimeZone
+	existing.DigestHour = prefs.DigestHour
+	existing.DigestWeekday = prefs.DigestWeekday
+	if err := db.Save(&existing).Error; err != nil {
+		return err
+	}
+	*prefs = existing
+	return nil
+}
+
+func (p *NotificationPreferencesModel) location() *time.Location {
+	loc, err := time.LoadLocation(p.TimeZone)
+	if err != nil {
+		fmt.Printf("Invalid time zone %s for user %d, using %s\n", p.TimeZone, p.UserID, DEFAULT_TIME_ZONE)
+		loc, _ = time.LoadLocation(DEFAULT_TIME_ZONE)
+	}
+	return loc
+}
+
+func (p *NotificationPreferencesModel) inQuietHours(hour int) bool {
+	if p.QuietHoursStart == p.QuietHoursEnd {
+		return false
+	}
+	if p.QuietHoursStart < p.QuietHoursEnd {
+		return hour >= p.QuietHoursStart && hour < p.QuietHoursEnd
+	}
+	// wraps past midnight
+	return hour >= p.QuietHoursStart || hour < p.QuietHoursEnd
+}
+
+// digestHour is the local hour digests go out from. Preferences saved before
+// it was validated may put it in quiet hours, which then delay it to their end.
+func (p *NotificationPreferencesModel) digestHour() int {
+	if p.inQuietHours(p.DigestHour) {
+		return p.QuietHoursEnd
+	}
+	return p.DigestHour
+}
+
+// isDigestDue reports whether a care email may be sent to this user at now.
+func (p *NotificationPreferencesModel) isDigestDue(now time.Time) bool {
+	loc := p.location()
+	local := now.In(loc)
+	if p.inQuietHours(local.Hour()) {
+		return false
+	}
+	if p.Frequency == NOTIFY_IMMEDIATE {
+		return true
+	}
+	if local.Hour() < p.digestHour() {
+		return false
+	}
+	if p.Frequency == NOTIFY_WEEKLY && int(local.Weekday()) != p.DigestWeekday {
+		return false
+	}
+	if p.LastDigestAt == nil {
+		return true
+	}
+	last := p.LastDigestAt.In(loc)
+	return last.Year() != local.Year() || last.YearDay() != local.YearDay()
+}
+
+// recordDigestSent stores when a user's last digest went out, leaving the
+// rest of their preferences alone so that it can't undo a concurrent update.
+func recordDigestSent(db *gorm.DB, prefs *NotificationPreferencesModel, sentAt time.Time) error {
+	prefs.LastDigestAt = &sentAt
+	if prefs.ID == 0 {
+		// the defaults were in use; save them, unless the user just did
+		return db.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "user_id"}},
+			DoUpdates: clause.Assignments(map[string]interface{}{"last_digest_at": sentAt}),
+		}).Create(prefs).Error
+	}
+	return db.Model(&NotificationPreferencesModel{}).Where("id = ?", prefs.ID).UpdateColumn("last_digest_at", sentAt).Error
+}
@@ -0,0 +1,223 @@
+package app
+
+import (
+	"testing"
+	"time"
+	_ "time/tzdata"
+)
+
+func mustLoadLocation(t *testing.T, name string) *time.Location {
+	t.Helper()
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return loc
+}
+
+func TestInQuietHours(t *testing.T) {
+	cases := []struct {
+		start, end int
+		quiet      []int
+	}{
+		{22, 7, []int{22, 23, 0, 1, 2, 3, 4, 5, 6}},
+		{1, 5, []int{1, 2, 3, 4}},
+		{0, 1, []int{0}},
+		{23, 0, []int{23}},
+		{9, 9, nil},
+	}
+	for _, c := range cases {
+		prefs := NotificationPreferencesModel{QuietHoursStart: c.start, QuietHoursEnd: c.end}
+		quiet := map[int]bool{}
+		for _, hour := range c.quiet {
+			quiet[hour] = true
+		}
+		for hour := 0; hour < 24; hour++ {
+			if prefs.inQuietHours(hour) != quiet[hour] {
+				t.Errorf("quiet hours %d-%d, hour %d: got %t", c.start, c.end, hour, !quiet[hour])
+			}
+		}
+	}
+}
+
+func TestIsDigestDue(t *testing.T) {
+	newYork := mustLoadLocation(t, "America/New_York")
+	at := func(loc *time.Location, year int, month time.Month, day, hour, min int) time.Time {
+		return time.Date(year, month, day, hour, min, 0, 0, loc)
+	}
+	ptr := func(t time.Time) *time.Time { return &t }
+	daily := func() NotificationPreferencesModel {
+		prefs := defaultNotificationPreferences(1)
+		prefs.Frequency = NOTIFY_DAILY
+		return prefs
+	}
+
+	cases := []struct {
+		name     string
+		prefs    func() NotificationPreferencesModel
+		now      time.Time
+		expected bool
+	}{
+		{"daily before the digest hour", daily, at(newYork, 2026, 6, 1, 7, 30), false},
+		{"daily at the digest hour", daily, at(newYork, 2026, 6, 1, 8, 0), true},
+		{"daily later in the day", daily, at(newYork, 2026, 6, 1, 15, 0), true},
+		{"daily in quiet hours", daily, at(newYork, 2026, 6, 1, 23, 0), false},
+		{"daily already sent today", func() NotificationPreferencesModel {
+			prefs := daily()
+			prefs.LastDigestAt = ptr(at(newYork, 2026, 6, 1, 8, 0))
+			return prefs
+		}, at(newYork, 2026, 6, 1, 15, 0), false},
+		{"daily sent yesterday", func() NotificationPreferencesModel {
+			prefs := daily()
+			prefs.LastDigestAt = ptr(at(newYork, 2026, 5, 31, 8, 0))
+			return prefs
+		}, at(newYork, 2026, 6, 1, 8, 0), true},
+		// days are the user's, not UTC's: 21:30 in New York is the next day in UTC
+		{"daily sent earlier the same local day", func() NotificationPreferencesModel {
+			prefs := daily()
+			prefs.LastDigestAt = ptr(at(time.UTC, 2026, 6, 1, 12, 0))
+			return prefs
+		}, at(time.UTC, 2026, 6, 2, 1, 30), false},
+		{"daily sent the previous local day, same UTC day", func() NotificationPreferencesModel {
+			prefs := daily()
+			prefs.LastDigestAt = ptr(at(time.UTC, 2026, 6, 2, 1, 0))
+			return prefs
+		}, at(time.UTC, 2026, 6, 2, 12, 0), true},
+		{"the digest hour follows the time zone", func() NotificationPreferencesModel {
+			prefs := daily()
+			prefs.TimeZone = "Asia/Tokyo"
+			return prefs
+		}, at(newYork, 2026, 6, 1, 15, 0), false},
+		{"weekly on another day", func() NotificationPreferencesModel {
+			prefs := daily()
+			prefs.Frequency = NOTIFY_WEEKLY
+			prefs.DigestWeekday = int(time.Saturday)
+			return prefs
+		}, at(newYork, 2026, 6, 1, 9, 0), false},
+		{"weekly on its day", func() NotificationPreferencesModel {
+			prefs := daily()
+			prefs.Frequency = NOTIFY_WEEKLY
+			prefs.DigestWeekday = int(time.Saturday)
+			return prefs
+		}, at(newYork, 2026, 6, 6, 9, 0), true},
+		{"immediate outside quiet hours", func() NotificationPreferencesModel {
+			prefs := daily()
+			prefs.Frequency = NOTIFY_IMMEDIATE
+			prefs.LastDigestAt = ptr(at(newYork, 2026, 6, 1, 7, 0))
+			return prefs
+		}, at(newYork, 2026, 6, 1, 7, 5), true},
+		{"immediate in quiet hours", func() NotificationPreferencesModel {
+			prefs := daily()
+			prefs.Frequency = NOTIFY_IMMEDIATE
+			return prefs
+		}, at(newYork, 2026, 6, 1, 3, 0), false},
+		// saved before the digest hour was validated
+		{"digest hour in quiet hours waits for their end", func() NotificationPreferencesModel {
+			prefs := daily()
+			prefs.DigestHour = 23
+			return prefs
+		}, at(newYork, 2026, 6, 1, 7, 0), true},
+		{"the quiet hours follow daylight saving time", daily, at(time.UTC, 2026, 1, 15, 11, 30), false},
+		{"an unknown time zone falls back to the default", func() NotificationPreferencesModel {
+			prefs := daily()
+			prefs.TimeZone = "Mars/Olympus_Mons"
+			return prefs
+		}, at(newYork, 2026, 6, 1, 8, 0), true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			prefs := c.prefs()
+			if due := prefs.isDigestDue(c.now); due != c.expected {
+				t.Errorf("due at %v: got %t", c.now.In(newYork), due)
+			}
+		})
+	}
+}
+
+func TestValidateNotificationPreferences(t *testing.T) {
+	valid := defaultNotificationPreferences(1)
+	if err := validateNotificationPreferences(&valid); err != nil {
+		t.Fatalf("defaults are invalid: %v", err)
+	}
+	cases := map[string]func(p *NotificationPreferencesModel){
+		"frequency":             func(p *NotificationPreferencesModel) { p.Frequency = "hourly" },
+		"quiet hours":           func(p *NotificationPreferencesModel) { p.QuietHoursEnd = 24 },
+		"digest hour":           func(p *NotificationPreferencesModel) { p.DigestHour = -1 },
+		"weekday":               func(p *NotificationPreferencesModel) { p.DigestWeekday = 7 },
+		"time zone":             func(p *NotificationPreferencesModel) { p.TimeZone = "Nowhere/Special" },
+		"empty time zone":       func(p *NotificationPreferencesModel) { p.TimeZone = "" },
+		"digest in quiet hours": func(p *NotificationPreferencesModel) { p.DigestHour = 23 },
+		"digest at quiet start": func(p *NotificationPreferencesModel) { p.DigestHour = 22 },
+	}
+	for name, change := range cases {
+		prefs := defaultNotificationPreferences(1)
+		change(&prefs)
+		if err := validateNotificationPreferences(&prefs); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+
+	// immediate emails have no digest hour
+	prefs := defaultNotificationPreferences(1)
+	prefs.Frequency = NOTIFY_IMMEDIATE
+	prefs.DigestHour = 23
+	if err := validateNotificationPreferences(&prefs); err != nil {
+		t.Errorf("immediate with a digest hour in quiet hours: %v", err)
+	}
+}
+
+func TestRecordDigestSent(t *testing.T) {
+	db := newTestDb(t)
+	userId := createTestUser(t, db, "alice")
+	sentAt := time.Date(2026, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	// the defaults are saved along with the digest time
+	var prefs NotificationPreferencesModel
+	if err := GetNotificationPreferences(db, userId, &prefs); err != nil || prefs.ID != 0 {
+		t.Fatalf("%+v %v", prefs, err)
+	}
+	if err := recordDigestSent(db, &prefs, sentAt); err != nil {
+		t.Fatal(err)
+	}
+	var saved NotificationPreferencesModel
+	if err := GetNotificationPreferences(db, userId, &saved); err != nil || saved.ID == 0 || saved.LastDigestAt == nil || !saved.LastDigestAt.Equal(sentAt) {
+		t.Fatalf("%+v %v", saved, err)
+	}
+
+	// a change saved while the digest was sent is kept
+	stale := saved
+	saved.Frequency = NOTIFY_WEEKLY
+	if err := UpdateNotificationPreferences(db, userId, &saved); err != nil {
+		t.Fatal(err)
+	}
+	if err := recordDigestSent(db, &stale, sentAt.Add(24*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	saved = NotificationPreferencesModel{}
+	if err := GetNotificationPreferences(db, userId, &saved); err != nil {
+		t.Fatal(err)
+	}
+	if saved.Frequency != NOTIFY_WEEKLY || !saved.LastDigestAt.Equal(sentAt.Add(24*time.Hour)) {
+		t.Errorf("%+v", saved)
+	}
+
+	// defaults the user saved in the meantime aren't overwritten
+	otherId := createTestUser(t, db, "bob")
+	var defaults NotificationPreferencesModel
+	GetNotificationPreferences(db, otherId, &defaults)
+	chosen := defaultNotificationPreferences(otherId)
+	chosen.Frequency = NOTIFY_IMMEDIATE
+	if err := UpdateNotificationPreferences(db, otherId, &chosen); err != nil {
+		t.Fatal(err)
+	}
+	if err := recordDigestSent(db, &defaults, sentAt); err != nil {
+		t.Fatal(err)
+	}
+	var other NotificationPreferencesModel
+	if err := GetNotificationPreferences(db, otherId, &other); err != nil {
+		t.Fatal(err)
+	}
+	if other.Frequency != NOTIFY_IMMEDIATE || other.LastDigestAt == nil {
+		t.Errorf("%+v", other)
+	}
+}
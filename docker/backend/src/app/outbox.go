@@ -0,0 +1,202 @@
+// durable outbound email queue
+package app
+
+import (
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	OUTBOX_PENDING = "pending"
+	OUTBOX_SENT    = "sent"
+	OUTBOX_DEAD    = "dead"
+)
+
+var OUTBOX_POLL_INTERVAL = 30 * time.Second
+var OUTBOX_MAX_ATTEMPTS = 8
+var OUTBOX_BASE_BACKOFF = 1 * time.Minute
+var OUTBOX_MAX_BACKOFF = 6 * time.Hour
+
+// how long a claimed message is hidden from other workers while it is sent
+var OUTBOX_LEASE = 5 * time.Minute
+
+// how long sent and dead messages are kept, since they can hold password
+// reset links and other tokens; zero keeps them forever
+var OUTBOX_RETENTION = 7 * 24 * time.Hour
+
+type OutboxEmailModel struct {
+	gorm.Model
+	To            string     `json:"to"`
+	ToName        string     `json:"toName"`
+	Subject       string     `json:"subject"`
+	PlainText     string     `json:"-"`
+	Html          string     `json:"-"`
+	Status        string     `json:"status" gorm:"index"`
+	Attempts      int        `json:"attempts"`
+	NextAttemptAt time.Time  `json:"nextAttemptAt" gorm:"index"`
+	LastError     string     `json:"lastError"`
+	SentAt        *time.Time `json:"sentAt"`
+}
+
+// queueEmail stores msg in the outbox; the outbox worker delivers it.
+func queueEmail(db *gorm.DB, msg *EmailMessage) error {
+	outboxEmail := OutboxEmailModel{
+		To:            msg.To,
+		ToName:        msg.ToName,
+		Subject:       msg.Subject,
+		PlainText:     msg.PlainText,
+		Html:          msg.Html,
+		Status:        OUTBOX_PENDING,
+		NextAttemptAt: time.Now(),
+	}
+	if err := db.Create(&outboxEmail).Error; err != nil {
+		return err
+	}
+	fmt.Printf("Queued email id=%d to %s (%s)\n", outboxEmail.ID, outboxEmail.To, outboxEmail.Subject)
+	return nil
+}
+
+// outboxBackoff returns the delay before retrying a message that has failed
+// attempts times.
+func outboxBackoff(attempts int) time.Duration {
+	backoff := OUTBOX_BASE_BACKOFF
+	for i := 1; i < attempts; i++ {
+		backoff *= 2
+		if backoff >= OUTBOX_MAX_BACKOFF {
+			return OUTBOX_MAX_BACKOFF
+		}
+	}
+	return backoff
+}
+
+// StartOutboxWorker delivers queued emails until stopCh is closed.
+func StartOutboxWorker(stopCh chan bool, db *gorm.DB) {
+	fmt.Printf("Starting outbox worker, interval=%v\n", OUTBOX_POLL_INTERVAL)
+	ticker := time.NewTicker(OUTBOX_POLL_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			drainOutbox(db)
+		case <-stopCh:
+			fmt.Println("Stopping outbox worker...")
+			return
+		}
+	}
+}
+
+// drainOutbox attempts delivery of every message that is due.
+func drainOutbox(db *gorm.DB) {
+	var due []OutboxEmailModel
+	err := db.Where("status = ? AND next_attempt_at <= ?", OUTBOX_PENDING, time.Now()).
+		Order("next_attempt_at asc").
+		Limit(100).
+		Find(&due).Error
+	if err != nil {
+		fmt.Printf("Failed loading outbox: %v\n", err)
+		return
+	}
+	for i := range due {
+		deliverOutboxEmail(db, &due[i])
+	}
+}
+
+// deliverOutboxEmail claims a message by pushing out its next attempt time,
+// so that other replicas skip it, then sends it and records the outcome.
+func deliverOutboxEmail(db *gorm.DB, outboxEmail *OutboxEmailModel) {
+	result := db.Model(&OutboxEmailModel{}).
+		Where("id = ? AND status = ? AND next_attempt_at = ?", outboxEmail.ID, OUTBOX_PENDING, outboxEmail.NextAttemptAt).
+		UpdateColumn("next_attempt_at", time.Now().Add(OUTBOX_LEASE))
+	if result.Error != nil {
+		fmt.Printf("Failed claiming email id=%d: %v\n", outboxEmail.ID, result.Error)
+		return
+	}
+	if result.RowsAffected == 0 {
+		// someone else got it
+		return
+	}
+
+	err := mailer.Send(&EmailMessage{
+		To:        outboxEmail.To,
+		ToName:    outboxEmail.ToName,
+		Subject:   outboxEmail.Subject,
+		PlainText: outboxEmail.PlainText,
+		Html:      outboxEmail.Html,
+	})
+	attempts := outboxEmail.Attempts + 1
+	if err == nil {
+		now := time.Now()
+		fmt.Printf("Sent email id=%d to %s\n", outboxEmail.ID, outboxEmail.To)
+		err := db.Model(&OutboxEmailModel{}).Where("id = ?", outboxEmail.ID).Updates(map[string]interface{}{
+			"status":     OUTBOX_SENT,
+			"attempts":   attempts,
+			"sent_at":    &now,
+			"last_error": "",
+		}).Error
+		if err != nil {
+			// the lease will run out and the email will be sent again
+			fmt.Printf("Failed marking email id=%d to %s as sent, it may be sent twice: %v\n", outboxEmail.ID, outboxEmail.To, err)
+		}
+		return
+	}
+
+	updates := map[string]interface{}{
+		"attempts":   attempts,
+		"last_error": err.Error(),
+	}
+	if attempts >= OUTBOX_MAX_ATTEMPTS {
+		fmt.Printf("Giving up on email id=%d to %s after %d attempts: %v\n", outboxEmail.ID, outboxEmail.To, attempts, err)
+		updates["status"] = OUTBOX_DEAD
+	} else {
+		backoff := outboxBackoff(attempts)
+		fmt.Printf("Failed sending email id=%d to %s (attempt %d), retrying in %v: %v\n", outboxEmail.ID, outboxEmail.To, attempts, backoff, err)
+		updates["next_attempt_at"] = time.Now().Add(backoff)
+	}
+	if err := db.Model(&OutboxEmailModel{}).Where("id = ?", outboxEmail.ID).Updates(updates).Error; err != nil {
+		fmt.Printf("Failed recording the failed attempt for email id=%d: %v\n", outboxEmail.ID, err)
+	}
+}
+
+// pruneOutbox deletes messages that were sent or given up on longer ago than
+// the retention period.
+func pruneOutbox(db *gorm.DB) {
+	if OUTBOX_RETENTION <= 0 {
+		return
+	}
+	cutoff := time.Now().Add(-OUTBOX_RETENTION)
+	result := db.Unscoped().
+		Where("(status = ? AND sent_at < ?) OR (status = ? AND updated_at < ?)", OUTBOX_SENT, cutoff, OUTBOX_DEAD, cutoff).
+		Delete(&OutboxEmailModel{})
+	if result.Error != nil {
+		fmt.Printf("Failed pruning the outbox: %v\n", result.Error)
+		return
+	}
+	if result.RowsAffected > 0 {
+		fmt.Printf("Pruned %d outbox emails older than %v\n", result.RowsAffected, cutoff)
+	}
+}
+
+// GetOutboxEmails lists the most recent messages with the given status.
+func GetOutboxEmails(db *gorm.DB, status string, outboxEmails *[]OutboxEmailModel) error {
+	return db.Where("status = ?", status).Order("updated_at desc").Limit(100).Find(outboxEmails).Error
+}
+
+// RetryOutboxEmail puts a message back in the queue with a fresh attempt count.
+func RetryOutboxEmail(db *gorm.DB, id int) error {
+	result := db.Model(&OutboxEmailModel{}).Where("id = ? AND status <> ?", id, OUTBOX_SENT).Updates(map[string]interface{}{
+		"status":          OUTBOX_PENDING,
+		"attempts":        0,
+		"next_attempt_at": time.Now(),
+		"last_error":      "",
+	})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("no unsent email with id %d", id)
+	}
+	return nil
+}
@@ -0,0 +1,193 @@
+package app
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeMailer records what it is asked to send, failing while fail is set.
+type fakeMailer struct {
+	lock sync.Mutex
+	sent []*EmailMessage
+	fail error
+}
+
+func (m *fakeMailer) Send(msg *EmailMessage) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.fail != nil {
+		return m.fail
+	}
+	m.sent = append(m.sent, msg)
+	return nil
+}
+
+func useFakeMailer(t *testing.T) *fakeMailer {
+	fake := &fakeMailer{}
+	previous := mailer
+	mailer = fake
+	t.Cleanup(func() { mailer = previous })
+	return fake
+}
+
+func TestOutboxBackoff(t *testing.T) {
+	cases := []struct {
+		attempts int
+		expected time.Duration
+	}{
+		{1, time.Minute},
+		{2, 2 * time.Minute},
+		{3, 4 * time.Minute},
+		{9, 256 * time.Minute},
+		{10, OUTBOX_MAX_BACKOFF},
+		{100, OUTBOX_MAX_BACKOFF},
+	}
+	for _, c := range cases {
+		if backoff := outboxBackoff(c.attempts); backoff != c.expected {
+			t.Errorf("backoff after %d attempts is %v, want %v", c.attempts, backoff, c.expected)
+		}
+	}
+}
+
+func TestOutboxDelivery(t *testing.T) {
+	db := newTestDb(t)
+	fake := useFakeMailer(t)
+	if err := queueEmail(db, &EmailMessage{To: "a@example.com", Subject: "hello", PlainText: "hi"}); err != nil {
+		t.Fatal(err)
+	}
+	drainOutbox(db)
+
+	if len(fake.sent) != 1 || fake.sent[0].To != "a@example.com" || fake.sent[0].Subject != "hello" {
+		t.Fatalf("sent %+v", fake.sent)
+	}
+	var outboxEmail OutboxEmailModel
+	db.First(&outboxEmail)
+	if outboxEmail.Status != OUTBOX_SENT || outboxEmail.Attempts != 1 || outboxEmail.SentAt == nil {
+		t.Errorf("after sending: %+v", outboxEmail)
+	}
+
+	// sent messages are not sent again
+	drainOutbox(db)
+	if len(fake.sent) != 1 {
+		t.Errorf("sent %d times", len(fake.sent))
+	}
+}
+
+func TestOutboxRetriesUntilDead(t *testing.T) {
+	db := newTestDb(t)
+	fake := useFakeMailer(t)
+	fake.fail = errors.New("relay down")
+	if err := queueEmail(db, &EmailMessage{To: "a@example.com", Subject: "hello"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var outboxEmail OutboxEmailModel
+	for attempt := 1; attempt <= OUTBOX_MAX_ATTEMPTS; attempt++ {
+		before := time.Now()
+		drainOutbox(db)
+		db.First(&outboxEmail)
+		if outboxEmail.Attempts != attempt || outboxEmail.LastError != "relay down" {
+			t.Fatalf("attempt %d: %+v", attempt, outboxEmail)
+		}
+		if attempt < OUTBOX_MAX_ATTEMPTS {
+			if outboxEmail.Status != OUTBOX_PENDING {
+				t.Fatalf("attempt %d: status %s", attempt, outboxEmail.Status)
+			}
+			if wait := outboxEmail.NextAttemptAt.Sub(before); wait < outboxBackoff(attempt) || wait > outboxBackoff(attempt)+time.Minute {
+				t.Errorf("attempt %d: retrying in %v, want %v", attempt, wait, outboxBackoff(attempt))
+			}
+			// not due yet
+			drainOutbox(db)
+			var unchanged OutboxEmailModel
+			db.First(&unchanged)
+			if unchanged.Attempts != attempt {
+				t.Fatalf("attempt %d: retried before its backoff", attempt)
+			}
+			db.Model(&outboxEmail).UpdateColumn("next_attempt_at", time.Now().Add(-time.Second))
+		}
+	}
+	if outboxEmail.Status != OUTBOX_DEAD {
+		t.Fatalf("status %s after %d attempts", outboxEmail.Status, OUTBOX_MAX_ATTEMPTS)
+	}
+
+	fake.fail = nil
+	if err := RetryOutboxEmail(db, int(outboxEmail.ID)); err != nil {
+		t.Fatal(err)
+	}
+	drainOutbox(db)
+	db.First(&outboxEmail)
+	if outboxEmail.Status != OUTBOX_SENT || len(fake.sent) != 1 {
+		t.Errorf("after retrying: %+v, sent %d", outboxEmail, len(fake.sent))
+	}
+	if err := RetryOutboxEmail(db, int(outboxEmail.ID)); err == nil {
+		t.Error("expected sent emails not to be retried")
+	}
+}
+
+// a message claimed by another worker is left to it
+func TestOutboxClaim(t *testing.T) {
+	db := newTestDb(t)
+	fake := useFakeMailer(t)
+	if err := queueEmail(db, &EmailMessage{To: "a@example.com", Subject: "hello"}); err != nil {
+		t.Fatal(err)
+	}
+	var first, second OutboxEmailModel
+	db.First(&first)
+	db.First(&second)
+
+	deliverOutboxEmail(db, &first)
+	deliverOutboxEmail(db, &second)
+	if len(fake.sent) != 1 {
+		t.Errorf("sent %d times", len(fake.sent))
+	}
+
+	// a claim hides the message until the lease runs out
+	if err := queueEmail(db, &EmailMessage{To: "b@example.com", Subject: "hello"}); err != nil {
+		t.Fatal(err)
+	}
+	var claimed OutboxEmailModel
+	db.Where("\"to\" = ?", "b@example.com").First(&claimed)
+	db.Model(&claimed).UpdateColumn("next_attempt_at", time.Now().Add(OUTBOX_LEASE))
+	drainOutbox(db)
+	if len(fake.sent) != 1 {
+		t.Errorf("sent a claimed message")
+	}
+}
+
+func TestPruneOutbox(t *testing.T) {
+	db := newTestDb(t)
+	old := time.Now().Add(-OUTBOX_RETENTION - time.Hour)
+	recent := time.Now().Add(-time.Hour)
+	emails := []OutboxEmailModel{
+		{To: "old-sent", Status: OUTBOX_SENT, SentAt: &old},
+		{To: "recent-sent", Status: OUTBOX_SENT, SentAt: &recent},
+		{To: "old-dead", Status: OUTBOX_DEAD},
+		{To: "recent-dead", Status: OUTBOX_DEAD},
+		{To: "old-pending", Status: OUTBOX_PENDING},
+	}
+	for i := range emails {
+		if err := db.Create(&emails[i]).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Model(&OutboxEmailModel{}).Where("\"to\" IN ?", []string{"old-dead", "old-pending"}).UpdateColumn("updated_at", old)
+
+	pruneOutbox(db)
+	var kept []OutboxEmailModel
+	db.Unscoped().Order("id").Find(&kept)
+	var left []string
+	for _, outboxEmail := range kept {
+		left = append(left, outboxEmail.To)
+	}
+	expected := []string{"recent-sent", "recent-dead", "old-pending"}
+	if len(left) != len(expected) {
+		t.Fatalf("left %v, want %v", left, expected)
+	}
+	for i := range expected {
+		if left[i] != expected[i] {
+			t.Fatalf("left %v, want %v", left, expected)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+// chronological photo history of a plant
+package app
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// PlantPhotoModel is one photo in a plant's history. The plant's ImageId is
+// its cover photo, which is always one of these.
+type PlantPhotoModel struct {
+	gorm.Model
+	PlantID int       `json:"plantId" gorm:"index"`
+	ImageID uint      `json:"imageId" gorm:"index"`
+	TakenAt time.Time `json:"takenAt" gorm:"index"`
+	Caption string    `json:"caption"`
+	// optionally, the care this photo shows, e.g. a repotting
+	CareEventID *uint `json:"careEventId"`
+	IsCover     bool  `json:"isCover" gorm:"-"`
+}
+
+// validateCareEventLink checks an optional care event belongs to the plant.
+func validateCareEventLink(db *gorm.DB, plantId int, careEventId *uint) error {
+	if careEventId == nil {
+		return nil
+	}
+	var count int64
+	err := db.Model(&CareEventModel{}).Where("id = ? AND plant_id = ?", *careEventId, plantId).Count(&count).Error
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return errors.New("Invalid care event ID.")
+	}
+	return nil
+}
+
+// photoTakenAt is when an image was captured, if its metadata said, or now.
+func photoTakenAt(db *gorm.DB, imageId uint) time.Time {
+	var image ImageModel
+	err := db.Select("id", "captured_at").First(&image, imageId).Error
+	if err != nil || image.CapturedAt == nil {
+		return time.Now()
+	}
+	return *image.CapturedAt
+}
+
+// AddPlantPhoto records an uploaded image in a plant's history. The first
+// photo of a plant becomes its cover, as does any photo if makeCover is set.
+func AddPlantPhoto(db *gorm.DB, plant *PlantModel, photo *PlantPhotoModel, makeCover bool) error {
+	photo.PlantID = int(plant.ID)
+	if err := validateCareEventLink(db, photo.PlantID, photo.CareEventID); err != nil {
+		return err
+	}
+	if photo.TakenAt.IsZero() {
+		photo.TakenAt = photoTakenAt(db, photo.ImageID)
+	}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(photo).Error; err != nil {
+			return err
+		}
+		if makeCover || plant.ImageId == 0 {
+			return setPlantCover(tx, plant, photo.ImageID)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	photo.IsCover = uint(plant.ImageId) == photo.ImageID
+	return nil
+}
+
+// GetPlantPhotos returns a plant's photos, oldest first.
+func GetPlantPhotos(db *gorm.DB, plant *PlantModel, photos *[]PlantPhotoModel) error {
+	err := db.Where("plant_id = ?", plant.ID).Order("taken_at asc").Order("id asc").Find(photos).Error
+	if err != nil {
+		return err
+	}
+	for i := range *photos {
+		(*photos)[i].IsCover = uint(plant.ImageId) == (*photos)[i].ImageID
+	}
+	return nil
+}
+
+func getPlantPhoto(db *gorm.DB, plant *PlantModel, photoId int, photo *PlantPhotoModel) error {
+	return db.Where("id = ? AND plant_id = ?", photoId, plant.ID).First(photo).Error
+}
+
+// UpdatePlantPhoto changes a photo's caption and linked care event.
+func UpdatePlantPhoto(db *gorm.DB, plant *PlantModel, photoId int, caption string, careEventId *uint, photo *PlantPhotoModel) error {
+	if err := getPlantPhoto(db, plant, photoId, photo); err != nil {
+		return err
+	}
+	if err := validateCareEventLink(db, photo.PlantID, careEventId); err != nil {
+		return err
+	}
+	photo.Caption = caption
+	photo.CareEventID = careEventId
+	err := db.Model(photo).Updates(map[string]interface{}{
+		"caption":       caption,
+		"care_event_id": careEventId,
+	}).Error
+	if err != nil {
+		return err
+	}
+	photo.IsCover = uint(plant.ImageId) == photo.ImageID
+	return nil
+}
+
+// SetPlantCoverPhoto makes one of a plant's photos its cover.
+func SetPlantCoverPhoto(db *gorm.DB, plant *PlantModel, photoId int) error {
+	var photo PlantPhotoModel
+	if err := getPlantPhoto(db, plant, photoId, &photo); err != nil {
+		return err
+	}
+	return setPlantCover(db, plant, photo.ImageID)
+}
+
+func setPlantCover(db *gorm.DB, plant *PlantModel, imageId uint) error {
+	// a new cover is an edit, so edits based on the old one are stale
+	err := db.Model(&PlantModel{}).Where("id = ?", plant.ID).UpdateColumns(map[string]interface{}{
+		"image_id": imageId,
+		"version":  gorm.Expr("version + 1"),
+	}).Error
+	if err != nil {
+		return err
+	}
+	plant.ImageId = int(imageId)
+	plant.Version++
+	return nil
+}
+
+// DeletePlantPhoto removes a photo and its image. If it was the cover, the
+// most recent remaining photo becomes the cover.
+func DeletePlantPhoto(db *gorm.DB, plant *PlantModel, photoId int) error {
+	var photo PlantPhotoModel
+	if err := getPlantPhoto(db, plant, photoId, &photo); err != nil {
+		return err
+	}
+	if err := db.Delete(&photo).Error; err != nil {
+		return err
+	}
+	if uint(plant.ImageId) == photo.ImageID {
+		var latest PlantPhotoModel
+		err := db.Where("plant_id = ?", plant.ID).Order("taken_at desc").Order("id desc").First(&latest).Error
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+		if err := setPlantCover(db, plant, latest.ImageID); err != nil {
+			return err
+		}
+	}
+	return DeleteImage(db, photo.ImageID)
+}
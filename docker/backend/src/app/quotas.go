@@ -0,0 +1,308 @@
+// per-user limits on stored plants and comments, and how much history is kept
+package app
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	QUOTA_TIER_FREE      = "free"
+	QUOTA_TIER_UNLIMITED = "unlimited"
+
+	QUOTA_PLANTS   = "plants"
+	QUOTA_COMMENTS = "comments"
+)
+
+// QuotaLimits caps what one user may store. Zero means no limit.
+type QuotaLimits struct {
+	Plants   int `json:"plants"`
+	Comments int `json:"comments"`
+	// log entries kept per plant; older ones are pruned instead of refusing
+	// the write
+	PlantLogs int `json:"plantLogs"`
+	// days a comment is kept; older ones are pruned, so Comments limits how
+	// many may be posted in that time
+	CommentRetentionDays int `json:"commentRetentionDays"`
+}
+
+var QUOTA_TIERS = map[string]QuotaLimits{
+	QUOTA_TIER_FREE:      {Plants: 100, Comments: 1000, PlantLogs: 10, CommentRetentionDays: 365},
+	QUOTA_TIER_UNLIMITED: {PlantLogs: 100},
+}
+
+// tier for accounts without a QuotaModel
+var DEFAULT_QUOTA_TIER = QUOTA_TIER_FREE
+
+// QuotaModel puts an account on a tier, optionally overriding its limits.
+type QuotaModel struct {
+	gorm.Model
+	UserID uint `json:"userId" gorm:"uniqueIndex"`
+	// identifies the account when an admin assigns a quota
+	Email string `json:"email" gorm:"-"`
+	Tier  string `json:"tier"`
+	// nil uses the tier's limit
+	MaxPlants            *int `json:"maxPlants"`
+	MaxComments          *int `json:"maxComments"`
+	PlantLogs            *int `json:"plantLogs"`
+	CommentRetentionDays *int `json:"commentRetentionDays"`
+}
+
+// QuotaExceededError is returned for writes that would take a user past one
+// of their limits.
+type QuotaExceededError struct {
+	Resource string
+	Limit    int
+}
+
+func (e *QuotaExceededError) Error() string {
+	return fmt.Sprintf("You have reached your limit of %d %s.", e.Limit, e.Resource)
+}
+
+// QuotaCount is how much of one limit a user has used.
+type QuotaCount struct {
+	Used  int64 `json:"used"`
+	Limit int   `json:"limit"`
+}
+
+type QuotaUsage struct {
+	UserID               uint       `json:"userId"`
+	Email                string     `json:"email"`
+	Username             string     `json:"username"`
+	Tier                 string     `json:"tier"`
+	Plants               QuotaCount `json:"plants"`
+	Comments             QuotaCount `json:"comments"`
+	PlantLogs            int        `json:"plantLogs"`
+	CommentRetentionDays int        `json:"commentRetentionDays"`
+}
+
+// GetQuota loads the quota for a user, falling back to the default tier (with
+// a zero ID) if none was assigned.
+func GetQuota(db *gorm.DB, userId uint, quota *QuotaModel) error {
+	result := db.Where("user_id = ?", userId).Limit(1).Find(quota)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		*quota = QuotaModel{UserID: userId, Tier: DEFAULT_QUOTA_TIER}
+	}
+	return nil
+}
+
+// Limits returns the tier's limits with the account's overrides applied.
+func (q *QuotaModel) Limits() QuotaLimits {
+	limits, ok := QUOTA_TIERS[q.Tier]
+	if !ok {
+		fmt.Printf("Unknown quota tier %s for user %d, using %s\n", q.Tier, q.UserID, DEFAULT_QUOTA_TIER)
+		limits = QUOTA_TIERS[DEFAULT_QUOTA_TIER]
+	}
+	if q.MaxPlants != nil {
+		limits.Plants = *q.MaxPlants
+	}
+	if q.MaxComments != nil {
+		limits.Comments = *q.MaxComments
+	}
+	if q.PlantLogs != nil {
+		limits.PlantLogs = *q.PlantLogs
+	}
+	if q.CommentRetentionDays != nil {
+		limits.CommentRetentionDays = *q.CommentRetentionDays
+	}
+	return limits
+}
+
+// GetQuotaLimits returns the limits that apply to a user.
+func GetQuotaLimits(db *gorm.DB, userId uint) (QuotaLimits, error) {
+	var quota QuotaModel
+	if err := GetQuota(db, userId, &quota); err != nil {
+		return QuotaLimits{}, err
+	}
+	return quota.Limits(), nil
+}
+
+func countPlants(db *gorm.DB, userId uint) (int64, error) {
+	var count int64
+	err := db.Model(&PlantModel{}).Where("user_id = ?", userId).Count(&count).Error
+	return count, err
+}
+
+func countComments(db *gorm.DB, userId uint) (int64, error) {
+	var count int64
+	err := db.Model(&CommentModel{}).Where("user_id = ?", userId).Count(&count).Error
+	return count, err
+}
+
+// checkQuota refuses one more of resource once count reaches limit.
+func checkQuota(resource string, limit int, count func() (int64, error)) error {
+	if limit <= 0 {
+		return nil
+	}
+	used, err := count()
+	if err != nil {
+		return err
+	}
+	if used >= int64(limit) {
+		return &QuotaExceededError{Resource: resource, Limit: limit}
+	}
+	return nil
+}
+
+// checkPlantQuota reports whether a user may add another plant.
+func checkPlantQuota(db *gorm.DB, userId uint) error {
+	limits, err := GetQuotaLimits(db, userId)
+	if err != nil {
+		return err
+	}
+	return checkQuota(QUOTA_PLANTS, limits.Plants, func() (int64, error) { return countPlants(db, userId) })
+}
+
+// checkCommentQuota reports whether a user may post another comment.
+func checkCommentQuota(db *gorm.DB, userId uint) error {
+	limits, err := GetQuotaLimits(db, userId)
+	if err != nil {
+		return err
+	}
+	return checkQuota(QUOTA_COMMENTS, limits.Comments, func() (int64, error) { return countComments(db, userId) })
+}
+
+// GetQuotaUsage fills usage with what a user has stored against their limits.
+func GetQuotaUsage(db *gorm.DB, userId uint, usage *QuotaUsage) error {
+	var quota QuotaModel
+	if err := GetQuota(db, userId, &quota); err != nil {
+		return err
+	}
+	limits := quota.Limits()
+	plants, err := countPlants(db, userId)
+	if err != nil {
+		return err
+	}
+	comments, err := countComments(db, userId)
+	if err != nil {
+		return err
+	}
+	// accounts that were deleted still show, without contact details
+	user, err := userById(db, userId)
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return err
+	}
+	*usage = QuotaUsage{
+		UserID:               userId,
+		Email:                user.Email,
+		Username:             user.Username,
+		Tier:                 quota.Tier,
+		Plants:               QuotaCount{Used: plants, Limit: limits.Plants},
+		Comments:             QuotaCount{Used: comments, Limit: limits.Comments},
+		PlantLogs:            limits.PlantLogs,
+		CommentRetentionDays: limits.CommentRetentionDays,
+	}
+	return nil
+}
+
+// GetAllQuotaUsage lists the usage of everyone who has stored anything or
+// been assigned a quota.
+func GetAllQuotaUsage(db *gorm.DB, usages *[]QuotaUsage) error {
+	seen := map[uint]bool{}
+	var userIds []uint
+	for _, model := range []interface{}{&PlantModel{}, &CommentModel{}, &QuotaModel{}} {
+		var found []uint
+		if err := db.Model(model).Where("user_id <> 0").Distinct("user_id").Pluck("user_id", &found).Error; err != nil {
+			return err
+		}
+		for _, userId := range found {
+			if !seen[userId] {
+				seen[userId] = true
+				userIds = append(userIds, userId)
+			}
+		}
+	}
+	sort.Slice(userIds, func(i, j int) bool { return userIds[i] < userIds[j] })
+
+	*usages = []QuotaUsage{}
+	for _, userId := range userIds {
+		var usage QuotaUsage
+		if err := GetQuotaUsage(db, userId, &usage); err != nil {
+			return err
+		}
+		*usages = append(*usages, usage)
+	}
+	return nil
+}
+
+func validateQuota(quota *QuotaModel) error {
+	if _, ok := QUOTA_TIERS[quota.Tier]; !ok {
+		return errors.New("Invalid quota tier.")
+	}
+	for _, limit := range []*int{quota.MaxPlants, quota.MaxComments, quota.PlantLogs, quota.CommentRetentionDays} {
+		if limit != nil && *limit < 0 {
+			return errors.New("Invalid quota limit.")
+		}
+	}
+	return nil
+}
+
+// UpdateQuota assigns an account, given by ID or email, its tier and
+// overrides.
+func UpdateQuota(db *gorm.DB, quota *QuotaModel) error {
+	if err := validateQuota(quota); err != nil {
+		return err
+	}
+	if quota.UserID == 0 {
+		if quota.Email == "" {
+			return errors.New("Missing user.")
+		}
+		userId, err := userIdForEmail(db, quota.Email)
+		if err != nil {
+			return err
+		}
+		quota.UserID = userId
+	}
+	var existing QuotaModel
+	if err := GetQuota(db, quota.UserID, &existing); err != nil {
+		return err
+	}
+	existing.Tier = quota.Tier
+	existing.MaxPlants = quota.MaxPlants
+	existing.MaxComments = quota.MaxComments
+	existing.PlantLogs = quota.PlantLogs
+	existing.CommentRetentionDays = quota.CommentRetentionDays
+	if err := db.Save(&existing).Error; err != nil {
+		return err
+	}
+	*quota = existing
+	return nil
+}
+
+// pruneComments deletes each author's comments older than their comment
+// retention.
+func pruneComments(db *gorm.DB) {
+	var userIds []uint
+	if err := db.Model(&CommentModel{}).Distinct("user_id").Pluck("user_id", &userIds).Error; err != nil {
+		fmt.Printf("Failed finding comment authors to prune: %v\n", err)
+		return
+	}
+	var pruned int64
+	for _, userId := range userIds {
+		limits, err := GetQuotaLimits(db, userId)
+		if err != nil {
+			fmt.Printf("Failed loading the quota of user %d: %v\n", userId, err)
+			continue
+		}
+		if limits.CommentRetentionDays <= 0 {
+			continue
+		}
+		cutoff := time.Now().AddDate(0, 0, -limits.CommentRetentionDays)
+		result := db.Unscoped().Where("user_id = ? AND created_at < ?", userId, cutoff).Delete(&CommentModel{})
+		if result.Error != nil {
+			fmt.Printf("Failed pruning comments of user %d: %v\n", userId, result.Error)
+			continue
+		}
+		pruned += result.RowsAffected
+	}
+	if pruned > 0 {
+		fmt.Printf("Pruned %d comment(s) past their retention\n", pruned)
+	}
+}
@@ -0,0 +1,163 @@
+package app
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+func intPtr(value int) *int {
+	return &value
+}
+
+// useQuotaTier swaps in limits for a tier for the length of a test.
+func useQuotaTier(t *testing.T, tier string, limits QuotaLimits) {
+	saved := QUOTA_TIERS[tier]
+	QUOTA_TIERS[tier] = limits
+	t.Cleanup(func() { QUOTA_TIERS[tier] = saved })
+}
+
+func addTestPlant(db *gorm.DB, userId uint) error {
+	lastCare := NewCareDate(time.Now())
+	return AddPlant(db, &PlantModel{UserID: userId, Name: "fern", WateringFrequency: 7, LastWaterDate: lastCare, LastFertilizeDate: lastCare})
+}
+
+func TestPlantQuota(t *testing.T) {
+	db := newTestDb(t)
+	useQuotaTier(t, QUOTA_TIER_FREE, QuotaLimits{Plants: 2})
+	alice := createTestUser(t, db, "alice")
+	bob := createTestUser(t, db, "bob")
+	carol := createTestUser(t, db, "carol")
+	if err := UpdateQuota(db, &QuotaModel{UserID: bob, Tier: QUOTA_TIER_FREE, MaxPlants: intPtr(3)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := UpdateQuota(db, &QuotaModel{UserID: carol, Tier: QUOTA_TIER_UNLIMITED}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		userId uint
+		limit  int
+	}{{alice, 2}, {bob, 3}, {carol, 0}} {
+		for i := 0; i < 5; i++ {
+			err := addTestPlant(db, c.userId)
+			var quotaErr *QuotaExceededError
+			if c.limit > 0 && i >= c.limit {
+				if !errors.As(err, &quotaErr) || quotaErr.Resource != QUOTA_PLANTS || quotaErr.Limit != c.limit {
+					t.Errorf("user %d, plant %d: expected the limit of %d plants, got %v", c.userId, i+1, c.limit, err)
+				}
+			} else if err != nil {
+				t.Errorf("user %d, plant %d: %v", c.userId, i+1, err)
+			}
+		}
+	}
+
+	var usage QuotaUsage
+	if err := GetQuotaUsage(db, bob, &usage); err != nil {
+		t.Fatal(err)
+	}
+	if usage.Plants != (QuotaCount{Used: 3, Limit: 3}) || usage.Tier != QUOTA_TIER_FREE {
+		t.Errorf("usage %+v", usage)
+	}
+}
+
+func TestCommentQuota(t *testing.T) {
+	db := newTestDb(t)
+	alice := createTestUser(t, db, "alice")
+	if err := UpdateQuota(db, &QuotaModel{UserID: alice, Tier: QUOTA_TIER_FREE, MaxComments: intPtr(1)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := AddComment(db, "lovely", alice, 1); err != nil {
+		t.Fatal(err)
+	}
+	var quotaErr *QuotaExceededError
+	if err := AddComment(db, "still lovely", alice, 1); !errors.As(err, &quotaErr) || quotaErr.Resource != QUOTA_COMMENTS {
+		t.Errorf("expected the comment limit, got %v", err)
+	}
+}
+
+func TestUpdateQuotaValidation(t *testing.T) {
+	db := newTestDb(t)
+	alice := createTestUser(t, db, "alice")
+	for _, quota := range []QuotaModel{
+		{UserID: alice, Tier: "gold"},
+		{UserID: alice, Tier: QUOTA_TIER_FREE, MaxPlants: intPtr(-1)},
+		{UserID: alice, Tier: QUOTA_TIER_FREE, CommentRetentionDays: intPtr(-1)},
+		{Tier: QUOTA_TIER_FREE},
+	} {
+		if err := UpdateQuota(db, &quota); err == nil {
+			t.Errorf("expected %+v to be refused", quota)
+		}
+	}
+}
+
+func TestPruneComments(t *testing.T) {
+	db := newTestDb(t)
+	alice := createTestUser(t, db, "alice")
+	bob := createTestUser(t, db, "bob")
+	carol := createTestUser(t, db, "carol")
+	if err := UpdateQuota(db, &QuotaModel{UserID: bob, Tier: QUOTA_TIER_UNLIMITED}); err != nil {
+		t.Fatal(err)
+	}
+	if err := UpdateQuota(db, &QuotaModel{UserID: carol, Tier: QUOTA_TIER_FREE, CommentRetentionDays: intPtr(30)}); err != nil {
+		t.Fatal(err)
+	}
+	freeRetention := QUOTA_TIERS[QUOTA_TIER_FREE].CommentRetentionDays
+	for _, userId := range []uint{alice, bob, carol} {
+		for _, days := range []int{freeRetention + 1, 60, 1} {
+			createdAt := time.Now().AddDate(0, 0, -days)
+			comment := CommentModel{UserID: userId, PlantID: 1, Content: "lovely", CreatedAt: &createdAt}
+			if err := db.Create(&comment).Error; err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	pruneComments(db)
+	for _, c := range []struct {
+		userId uint
+		kept   int64
+	}{{alice, 2}, {bob, 3}, {carol, 1}} {
+		count, err := countComments(db, c.userId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != c.kept {
+			t.Errorf("user %d has %d comments left, expected %d", c.userId, count, c.kept)
+		}
+	}
+}
+
+func TestExemptOverQuotaAccounts(t *testing.T) {
+	db := newTestDb(t)
+	useQuotaTier(t, QUOTA_TIER_FREE, QuotaLimits{Plants: 2})
+	alice := createTestUser(t, db, "alice")
+	bob := createTestUser(t, db, "bob")
+	carol := createTestUser(t, db, "carol")
+	// stored before limits existed
+	for userId, plants := range map[uint]int{alice: 3, bob: 2, carol: 3} {
+		for i := 0; i < plants; i++ {
+			createTestPlant(t, db, PlantModel{UserID: userId, Name: "fern", WateringFrequency: 7})
+		}
+	}
+	if err := UpdateQuota(db, &QuotaModel{UserID: carol, Tier: QUOTA_TIER_FREE, MaxPlants: intPtr(3)}); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := exemptOverQuotaAccounts(db); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := addTestPlant(db, alice); err != nil {
+		t.Errorf("expected alice to be exempt, got %v", err)
+	}
+	var quotaErr *QuotaExceededError
+	for _, userId := range []uint{bob, carol} {
+		if err := addTestPlant(db, userId); !errors.As(err, &quotaErr) {
+			t.Errorf("expected user %d to keep their limit, got %v", userId, err)
+		}
+	}
+}
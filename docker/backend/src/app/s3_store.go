@@ -0,0 +1,231 @@
+// S3-compatible object storage for images, signed with AWS Signature V4
+package app
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// S3ImageStore keeps image bytes as objects in Bucket. Endpoint may point at
+// any S3-compatible service, e.g. a local MinIO, in which case PathStyle
+// addressing is usually needed.
+type S3ImageStore struct {
+	Endpoint        string
+	Region          string
+	Bucket          string
+	Prefix          string
+	AccessKeyId     string
+	SecretAccessKey string
+	PathStyle       bool
+	Client          *http.Client
+}
+
+// NewS3ImageStoreFromEnv reads S3_ENDPOINT, S3_REGION, S3_BUCKET, S3_PREFIX,
+// S3_ACCESS_KEY_ID, S3_SECRET_ACCESS_KEY and S3_PATH_STYLE.
+func NewS3ImageStoreFromEnv() (*S3ImageStore, error) {
+	store := &S3ImageStore{
+		Endpoint:        os.Getenv("S3_ENDPOINT"),
+		Region:          os.Getenv("S3_REGION"),
+		Bucket:          os.Getenv("S3_BUCKET"),
+		Prefix:          os.Getenv("S3_PREFIX"),
+		AccessKeyId:     os.Getenv("S3_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("S3_SECRET_ACCESS_KEY"),
+		PathStyle:       os.Getenv("S3_PATH_STYLE") == "true",
+	}
+	if store.Bucket == "" {
+		return nil, errors.New("S3_BUCKET must be set for the s3 image store")
+	}
+	if store.Region == "" {
+		store.Region = "us-east-1"
+	}
+	if store.Endpoint == "" {
+		store.Endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", store.Region)
+	}
+	if store.AccessKeyId == "" || store.SecretAccessKey == "" {
+		return nil, errors.New("S3_ACCESS_KEY_ID and S3_SECRET_ACCESS_KEY must be set for the s3 image store")
+	}
+	return store, nil
+}
+
+func (s *S3ImageStore) Name() string {
+	return IMAGE_STORE_S3
+}
+
+func (s *S3ImageStore) Put(image *ImageModel, data []byte) error {
+	key, err := newImageKey(image.Name)
+	if err != nil {
+		return err
+	}
+	key = s.Prefix + key
+	_, err = s.do("PUT", key, data, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	image.Key = key
+	return nil
+}
+
+func (s *S3ImageStore) Get(image *ImageModel) ([]byte, error) {
+	return s.do("GET", image.Key, nil, http.StatusOK)
+}
+
+func (s *S3ImageStore) Delete(image *ImageModel) error {
+	// S3 answers 204 whether or not the object existed
+	_, err := s.do("DELETE", image.Key, nil, http.StatusNoContent)
+	return err
+}
+
+// objectUrl addresses key in the bucket, path or virtual-host style.
+func (s *S3ImageStore) objectUrl(key string) (*url.URL, error) {
+	if key == "" {
+		return nil, errors.New("empty image key")
+	}
+	u, err := url.Parse(s.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	escapedKey := s3Escape(key, false)
+	if s.PathStyle {
+		u.Path = "/" + s.Bucket + "/" + key
+		u.RawPath = "/" + s3Escape(s.Bucket, true) + "/" + escapedKey
+	} else {
+		u.Host = s.Bucket + "." + u.Host
+		u.Path = "/" + key
+		u.RawPath = "/" + escapedKey
+	}
+	return u, nil
+}
+
+func (s *S3ImageStore) do(method string, key string, body []byte, expectedStatus int) ([]byte, error) {
+	u, err := s.objectUrl(key)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if body == nil {
+		req.Body = nil
+		req.ContentLength = 0
+	} else if method == "PUT" {
+		req.Header.Set("Content-Type", "application/octet-stream")
+	}
+	s.sign(req, body, time.Now())
+
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != expectedStatus {
+		return nil, fmt.Errorf("s3 %s %s: %s: %s", method, key, resp.Status, strings.TrimSpace(string(respBody)))
+	}
+	return respBody, nil
+}
+
+// s3Escape URI-encodes per the SigV4 rules; slashes are kept in object keys.
+func s3Escape(value string, encodeSlash bool) string {
+	var b strings.Builder
+	for _, c := range []byte(value) {
+		switch {
+		case c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z', c >= '0' && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hmacSha256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// sign adds an AWS Signature Version 4 Authorization header to req.
+func (s *S3ImageStore) sign(req *http.Request, body []byte, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	payloadHash := sha256Hex(body)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	canonicalRequest, signedHeaders := s3CanonicalRequest(req, payloadHash)
+
+	scope := day + "/" + s.Region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	signingKey := hmacSha256([]byte("AWS4"+s.SecretAccessKey), day)
+	signingKey = hmacSha256(signingKey, s.Region)
+	signingKey = hmacSha256(signingKey, "s3")
+	signingKey = hmacSha256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSha256(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.AccessKeyId, scope, signedHeaders, signature))
+}
+
+// s3CanonicalRequest returns the SigV4 canonical form of req, signing every
+// header it has, and the list of those headers.
+func s3CanonicalRequest(req *http.Request, payloadHash string) (string, string) {
+	// net/http sends Host from the URL rather than the header map
+	headerNames := []string{"host"}
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		lower := strings.ToLower(name)
+		headerNames = append(headerNames, lower)
+		headers[lower] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	sort.Strings(headerNames)
+	var canonicalHeaders strings.Builder
+	for _, name := range headerNames {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(headerNames, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	return canonicalRequest, signedHeaders
+}
@@ -0,0 +1,147 @@
+// periodic care reminder scheduler
+package app
+
+import (
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+var DEFAULT_REMINDER_INTERVAL = 1 * time.Hour
+
+// StartTimer checks every plant for overdue care once per interval, sends
+// reminder emails and prunes expired care events, outbox emails and comments,
+// until stopCh is closed.
+func StartTimer(stopCh chan bool, db *gorm.DB, interval time.Duration) {
+	if interval <= 0 {
+		interval = DEFAULT_REMINDER_INTERVAL
+	}
+	fmt.Printf("Starting care reminder timer, interval=%v\n", interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			checkPlantsNeedingCare(db)
+			pruneCareEvents(db)
+			pruneOutbox(db)
+			pruneComments(db)
+		case <-stopCh:
+			fmt.Println("Stopping timer...")
+			return
+		}
+	}
+}
+
+// a plant that is due for care, and what it needs
+type duePlant struct {
+	Plant           *PlantModel
+	NeedsWater      bool
+	NeedsFertilizer bool
+}
+
+// checkPlantsNeedingCare groups every overdue plant that has not already been
+// notified by owner, and sends each owner a single digest when their
+// notification preferences allow it.
+func checkPlantsNeedingCare(db *gorm.DB) {
+	var plants []PlantModel
+	if err := db.Where("do_notify = ?", true).Find(&plants).Error; err != nil {
+		fmt.Printf("Failed loading plants for care reminders: %v\n", err)
+		return
+	}
+
+	duePlantsByOwner := map[uint][]duePlant{}
+	for i := range plants {
+		plant := &plants[i]
+		needsWaterCare, needsFertilizeCare := plantNeedsCare(plant)
+		if !needsWaterCare && !needsFertilizeCare {
+			continue
+		}
+		duePlantsByOwner[plant.UserID] = append(duePlantsByOwner[plant.UserID], duePlant{
+			Plant:           plant,
+			NeedsWater:      needsWaterCare,
+			NeedsFertilizer: needsFertilizeCare,
+		})
+	}
+
+	now := time.Now()
+	for userId, duePlants := range duePlantsByOwner {
+		// reminders go to the owner's current email
+		owner, err := userById(db, userId)
+		if err != nil {
+			fmt.Printf("Failed finding the owner of %d due plant(s), user %d: %v\n", len(duePlants), userId, err)
+			continue
+		}
+		email := owner.Email
+		for _, due := range duePlants {
+			due.Plant.Username = owner.Username
+		}
+		var prefs NotificationPreferencesModel
+		if err := GetNotificationPreferences(db, userId, &prefs); err != nil {
+			fmt.Printf("Failed loading notification preferences for %s: %v\n", email, err)
+			continue
+		}
+		if !prefs.isDigestDue(now) {
+			continue
+		}
+		fmt.Printf("Sending care digest to %s for %d plant(s)\n", email, len(duePlants))
+		if err := sendCareDigest(db, email, duePlants); err != nil {
+			fmt.Printf("Failed queueing care digest for %s: %v\n", email, err)
+			continue
+		}
+		for _, due := range duePlants {
+			if err := markPlantNotified(db, due.Plant, due.NeedsWater, due.NeedsFertilizer); err != nil {
+				fmt.Printf("Failed recording notify dates for plant %d: %v\n", due.Plant.ID, err)
+			}
+		}
+		if err := recordDigestSent(db, &prefs, now); err != nil {
+			fmt.Printf("Failed recording digest time for %s: %v\n", email, err)
+		}
+	}
+}
+
+// plantNeedsCare reports whether a plant is due for water and/or fertilizer
+// and has not yet been notified about it.
+func plantNeedsCare(plant *PlantModel) (bool, bool) {
+	needsWaterCare := false
+	needsFertilizeCare := false
+
+	if dueDate, ok := moistCheckDueDate(plant); ok && !plant.LastMoistNotifyDate.Valid && time.Now().After(dueDate) {
+		needsWaterCare = true
+	}
+	if !plant.LastWaterNotifyDate.Valid && needsCare(plant.LastWaterDate, plant.WateringFrequency) {
+		needsWaterCare = true
+	}
+	if !plant.LastFertilizeNotifyDate.Valid && plant.FertilizingFrequency > 0 {
+		needsFertilizeCare = needsCare(plant.LastFertilizeDate, plant.FertilizingFrequency)
+	}
+	return needsWaterCare, needsFertilizeCare
+}
+
+// markPlantNotified writes only the notify date columns, and only if the care
+// dates we checked are still current. This keeps the scheduler from clobbering
+// edits made through UpdatePlant while a reminder was being sent.
+func markPlantNotified(db *gorm.DB, plant *PlantModel, needsWater bool, needsFertilizer bool) error {
+	now := NewCareDate(time.Now())
+	updates := map[string]interface{}{}
+	if needsFertilizer {
+		updates["last_fertilize_notify_date"] = now
+	}
+	if needsWater {
+		updates["last_water_notify_date"] = now
+		updates["last_moist_notify_date"] = now
+	}
+	result := db.Model(&PlantModel{}).
+		Where("id = ? AND last_water_date IS NOT DISTINCT FROM ? AND last_fertilize_date IS NOT DISTINCT FROM ? AND last_moist_date IS NOT DISTINCT FROM ?",
+			plant.ID, plant.LastWaterDate, plant.LastFertilizeDate, plant.LastMoistDate).
+		UpdateColumns(updates)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		fmt.Printf("Plant %d changed while sending its reminder, leaving notify dates alone\n", plant.ID)
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package app
+
+import (
+	"testing"
+	"time"
+)
+
+func daysAgo(days float64) CareDate {
+	return NewCareDate(time.Now().Add(-time.Duration(days * 24 * float64(time.Hour))))
+}
+
+func TestPlantNeedsCare(t *testing.T) {
+	cases := []struct {
+		name            string
+		plant           PlantModel
+		needsWater      bool
+		needsFertilizer bool
+	}{
+		{"nothing due", PlantModel{WateringFrequency: 7, LastWaterDate: daysAgo(1)}, false, false},
+		{"water within grace", PlantModel{WateringFrequency: 7, LastWaterDate: daysAgo(9)}, false, false},
+		{"water overdue", PlantModel{WateringFrequency: 7, LastWaterDate: daysAgo(11)}, true, false},
+		{"water already notified", PlantModel{WateringFrequency: 7, LastWaterDate: daysAgo(11), LastWaterNotifyDate: daysAgo(1)}, false, false},
+		{"no watering schedule", PlantModel{WateringFrequency: 0, LastWaterDate: daysAgo(100)}, false, false},
+		{"fertilizer overdue", PlantModel{FertilizingFrequency: 30, LastFertilizeDate: daysAgo(40)}, false, true},
+		{"no fertilizing schedule", PlantModel{FertilizingFrequency: 0, LastFertilizeDate: daysAgo(400)}, false, false},
+		{"moist check due", PlantModel{WateringFrequency: 7, LastWaterDate: daysAgo(3), LastMoistDate: daysAgo(2)}, true, false},
+		{"moist check recent", PlantModel{WateringFrequency: 7, LastWaterDate: daysAgo(3), LastMoistDate: daysAgo(0.5)}, false, false},
+		{"moist check notified", PlantModel{WateringFrequency: 7, LastWaterDate: daysAgo(3), LastMoistDate: daysAgo(2), LastMoistNotifyDate: daysAgo(1)}, false, false},
+		{"moist check before watering", PlantModel{WateringFrequency: 7, LastWaterDate: daysAgo(2), LastMoistDate: daysAgo(3)}, false, false},
+		{"moist check without watering", PlantModel{LastMoistDate: daysAgo(2)}, true, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			needsWater, needsFertilizer := plantNeedsCare(&c.plant)
+			if needsWater != c.needsWater || needsFertilizer != c.needsFertilizer {
+				t.Errorf("got water=%t fertilizer=%t, want water=%t fertilizer=%t", needsWater, needsFertilizer, c.needsWater, c.needsFertilizer)
+			}
+		})
+	}
+}
+
+// every new moist check gets its own reminder
+func TestMoistCheckRemindsAgain(t *testing.T) {
+	db := newTestDb(t)
+	userId := createTestUser(t, db, "alice")
+	plant := createTestPlant(t, db, PlantModel{UserID: userId, Name: "fern", WateringFrequency: 7, LastWaterDate: daysAgo(5), LastFertilizeDate: daysAgo(5), LastMoistDate: daysAgo(4)})
+
+	remind := func() bool {
+		plant = reloadTestPlant(t, db, plant.ID)
+		needsWater, _ := plantNeedsCare(&plant)
+		if needsWater {
+			if err := markPlantNotified(db, &plant, true, false); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return needsWater
+	}
+	if !remind() {
+		t.Fatal("expected a reminder for the first moist check")
+	}
+	if remind() {
+		t.Fatal("expected only one reminder per moist check")
+	}
+
+	event := CareEventModel{Kind: EVENT_MOIST_CHECK, OccurredAt: daysAgo(2).Time}
+	if err := RecordCareAction(db, &plant, &event); err != nil {
+		t.Fatal(err)
+	}
+	if !remind() {
+		t.Fatal("expected a reminder for a moist check logged as an action")
+	}
+
+	plant = reloadTestPlant(t, db, plant.ID)
+	plant.LastMoistDate = daysAgo(1.5)
+	if err := UpdatePlant(db, &plant, false, userId); err != nil {
+		t.Fatal(err)
+	}
+	if !remind() {
+		t.Fatal("expected a reminder for a moist check logged by editing the plant")
+	}
+
+	// watering after the check makes it moot
+	event = CareEventModel{Kind: EVENT_WATERED, OccurredAt: daysAgo(1).Time}
+	if err := RecordCareAction(db, &plant, &event); err != nil {
+		t.Fatal(err)
+	}
+	plant = reloadTestPlant(t, db, plant.ID)
+	if plant.LastMoistDate.Valid || plant.LastMoistNotifyDate.Valid {
+		t.Errorf("watering left moist check %s, notified %s", plant.LastMoistDate, plant.LastMoistNotifyDate)
+	}
+}
@@ -0,0 +1,321 @@
+// plant-sitter grants: time-boxed access for someone else to log care
+package app
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// longest a sitter may be given access for
+var MAX_SITTER_GRANT_DURATION = 90 * 24 * time.Hour
+
+var ErrSitterForbidden = errors.New("You can only hand over the care of your own plants.")
+var ErrInvalidGrant = errors.New("This plant-sitting access is invalid, has expired or was revoked.")
+var ErrPlantNotInGrant = errors.New("This plant isn't part of your plant-sitting access.")
+
+// SitterGrantModel lets a sitter log care actions on some of a user's plants
+// until it expires or is revoked. The sitter is either an account, or anyone
+// holding the grant's link; only a hash of the link's token is stored.
+type SitterGrantModel struct {
+	gorm.Model
+	UserID    uint         `json:"userId" gorm:"index"`
+	SitterID  uint         `json:"sitterId" gorm:"index"`
+	Label     string       `json:"label"`
+	TokenHash string       `json:"-" gorm:"index"`
+	ExpiresAt time.Time    `json:"expiresAt"`
+	RevokedAt *time.Time   `json:"revokedAt"`
+	Plants    []PlantModel `json:"plants" gorm:"many2many:sitter_grant_plants"`
+	Sitter    string       `json:"sitter" gorm:"-"`
+	Link      string       `json:"link,omitempty" gorm:"-"`
+}
+
+// SitterGrantRequest describes a grant to create. Without an email, the grant
+// is for whoever holds its link.
+type SitterGrantRequest struct {
+	Email     string    `json:"email"`
+	Label     string    `json:"label"`
+	PlantIDs  []uint    `json:"plantIds"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+func hashSitterToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func (g *SitterGrantModel) isActive(now time.Time) bool {
+	return g.RevokedAt == nil && now.Before(g.ExpiresAt)
+}
+
+// name the sitter goes by in care history
+func (g *SitterGrantModel) sitterName() string {
+	if g.Label != "" {
+		return g.Label
+	}
+	if g.Sitter != "" {
+		return g.Sitter
+	}
+	return "Plant sitter"
+}
+
+// resolveSitterNames fills in the current usernames of the grants' sitters
+// and of their plants' owners.
+func resolveSitterNames(db *gorm.DB, grants []SitterGrantModel) error {
+	var ids []uint
+	for i := range grants {
+		ids = append(ids, grants[i].SitterID)
+		for j := range grants[i].Plants {
+			ids = append(ids, grants[i].Plants[j].UserID)
+		}
+	}
+	users, err := usersById(db, ids)
+	if err != nil {
+		return err
+	}
+	for i := range grants {
+		grants[i].Sitter = users[grants[i].SitterID].Username
+		for j := range grants[i].Plants {
+			grants[i].Plants[j].Username = users[grants[i].Plants[j].UserID].Username
+		}
+	}
+	return nil
+}
+
+// noteSitterAccess adds a note about a grant to the care history of each of
+// its plants.
+func noteSitterAccess(db *gorm.DB, grant *SitterGrantModel, actor userContact, note string) error {
+	for i := range grant.Plants {
+		event := CareEventModel{
+			PlantID: int(grant.Plants[i].ID),
+			Kind:    EVENT_NOTE,
+			UserID:  actor.ID,
+			Note:    note,
+			GrantID: grant.ID,
+		}
+		if err := AddCareEvent(db, &event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CreateSitterGrant gives a sitter access to care for some of a user's plants.
+// Only the plants' owners may hand them over. For link grants, grant.Link is
+// set to the only copy of the link.
+func CreateSitterGrant(db *gorm.DB, userId uint, request *SitterGrantRequest, grant *SitterGrantModel) error {
+	now := time.Now()
+	if !request.ExpiresAt.After(now) {
+		return errors.New("Access must expire in the future.")
+	}
+	if request.ExpiresAt.After(now.Add(MAX_SITTER_GRANT_DURATION)) {
+		return fmt.Errorf("Access can last at most %d days.", int(MAX_SITTER_GRANT_DURATION.Hours()/24))
+	}
+	if len(request.PlantIDs) == 0 {
+		return errors.New("Choose at least one plant.")
+	}
+	granter, err := userById(db, userId)
+	if err != nil {
+		return err
+	}
+
+	var plants []PlantModel
+	if err := db.Where("id IN ?", request.PlantIDs).Find(&plants).Error; err != nil {
+		return err
+	}
+	if len(plants) != len(uniqueIds(request.PlantIDs)) {
+		return gorm.ErrRecordNotFound
+	}
+	for i := range plants {
+		role, err := plantRole(db, &plants[i], userId)
+		if err != nil {
+			return err
+		}
+		if !hasRole(role, ROLE_OWNER) {
+			return ErrSitterForbidden
+		}
+	}
+
+	*grant = SitterGrantModel{
+		UserID:    userId,
+		Label:     strings.TrimSpace(request.Label),
+		ExpiresAt: request.ExpiresAt,
+		Plants:    plants,
+	}
+	token := ""
+	if email := strings.TrimSpace(request.Email); email != "" {
+		sitterId, err := userIdForEmail(db, email)
+		if err != nil {
+			return err
+		}
+		if sitterId == userId {
+			return errors.New("You can't be your own plant sitter.")
+		}
+		grant.SitterID = sitterId
+		sitter, err := userById(db, sitterId)
+		if err != nil {
+			return err
+		}
+		grant.Sitter = sitter.Username
+	} else {
+		raw := make([]byte, 32)
+		if _, err := rand.Read(raw); err != nil {
+			return err
+		}
+		token = base64.RawURLEncoding.EncodeToString(raw)
+		grant.TokenHash = hashSitterToken(token)
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		// the plants exist already, only link them
+		if err := tx.Omit("Plants.*").Create(grant).Error; err != nil {
+			return err
+		}
+		note := fmt.Sprintf("%s may care for this plant until %s", grant.sitterName(), grant.ExpiresAt.UTC().Format(time.RFC1123))
+		return noteSitterAccess(tx, grant, granter, note)
+	})
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		grant.Link = fmt.Sprintf("%s/sitting?token=%s", siteUrl(), token)
+	}
+	return nil
+}
+
+func uniqueIds(ids []uint) []uint {
+	seen := map[uint]bool{}
+	var unique []uint
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			unique = append(unique, id)
+		}
+	}
+	return unique
+}
+
+// GetSitterGrants lists the grants a user has given, newest first.
+func GetSitterGrants(db *gorm.DB, userId uint, grants *[]SitterGrantModel) error {
+	*grants = []SitterGrantModel{}
+	if err := db.Preload("Plants").Where("user_id = ?", userId).Order("id desc").Find(grants).Error; err != nil {
+		return err
+	}
+	return resolveSitterNames(db, *grants)
+}
+
+// RevokeSitterGrant ends a grant early. Only the user who gave it may.
+func RevokeSitterGrant(db *gorm.DB, grantId uint, userId uint) error {
+	var grant SitterGrantModel
+	if err := db.Preload("Plants").Where("id = ? AND user_id = ?", grantId, userId).First(&grant).Error; err != nil {
+		return err
+	}
+	if grant.RevokedAt != nil {
+		return nil
+	}
+	grants := []SitterGrantModel{grant}
+	if err := resolveSitterNames(db, grants); err != nil {
+		return err
+	}
+	grant = grants[0]
+	granter, err := userById(db, userId)
+	if err != nil {
+		return err
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&grant).Update("revoked_at", time.Now()).Error; err != nil {
+			return err
+		}
+		return noteSitterAccess(tx, &grant, granter, fmt.Sprintf("%s can no longer care for this plant", grant.sitterName()))
+	})
+}
+
+// GetSittingGrants lists the live grants given to a sitter.
+func GetSittingGrants(db *gorm.DB, sitterId uint, grants *[]SitterGrantModel) error {
+	*grants = []SitterGrantModel{}
+	err := db.Preload("Plants").
+		Where("sitter_id = ? AND revoked_at IS NULL AND expires_at > ?", sitterId, time.Now()).
+		Order("expires_at asc").Find(grants).Error
+	if err != nil {
+		return err
+	}
+	return resolveSitterNames(db, *grants)
+}
+
+// GetSitterGrantForSitter loads a live grant given to a sitter.
+func GetSitterGrantForSitter(db *gorm.DB, grantId uint, sitterId uint, grant *SitterGrantModel) error {
+	err := db.Preload("Plants").Where("id = ? AND sitter_id = ?", grantId, sitterId).First(grant).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return ErrInvalidGrant
+	}
+	if err != nil {
+		return err
+	}
+	return checkSitterGrant(db, grant)
+}
+
+// GetSitterGrantByToken loads the live grant a link's token is for.
+func GetSitterGrantByToken(db *gorm.DB, token string, grant *SitterGrantModel) error {
+	err := db.Preload("Plants").Where("token_hash = ?", hashSitterToken(token)).First(grant).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return ErrInvalidGrant
+	}
+	if err != nil {
+		return err
+	}
+	return checkSitterGrant(db, grant)
+}
+
+func checkSitterGrant(db *gorm.DB, grant *SitterGrantModel) error {
+	if !grant.isActive(time.Now()) {
+		return ErrInvalidGrant
+	}
+	grants := []SitterGrantModel{*grant}
+	if err := resolveSitterNames(db, grants); err != nil {
+		return err
+	}
+	*grant = grants[0]
+	return nil
+}
+
+// RecordSitterCare logs a care action by a sitter on one of a grant's plants.
+// The care is attributed to sitter, or by name to the grant's sitter if sitter
+// is unset, and linked to the grant in the plant's history.
+func RecordSitterCare(db *gorm.DB, grant *SitterGrantModel, sitter userContact, plant *PlantModel, event *CareEventModel) error {
+	if !grant.isActive(time.Now()) {
+		return ErrInvalidGrant
+	}
+	found := false
+	for i := range grant.Plants {
+		if grant.Plants[i].ID == uint(event.PlantID) {
+			*plant = grant.Plants[i]
+			found = true
+		}
+	}
+	if !found {
+		return ErrPlantNotInGrant
+	}
+	// the granter may have given the plant away since
+	role, err := plantRole(db, plant, grant.UserID)
+	if err != nil {
+		return err
+	}
+	if !hasRole(role, ROLE_OWNER) {
+		return ErrInvalidGrant
+	}
+	event.GrantID = grant.ID
+	event.UserID = sitter.ID
+	event.Actor = ""
+	if sitter.ID == 0 {
+		// link sitters have no account to name them by
+		event.Actor = grant.sitterName()
+	}
+	return RecordCareAction(db, plant, event)
+}
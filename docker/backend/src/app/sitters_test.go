@@ -0,0 +1,138 @@
+package app
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSitterGrantLink(t *testing.T) {
+	db := newTestDb(t)
+	alice := createTestUser(t, db, "alice")
+	plant := createTestPlant(t, db, PlantModel{UserID: alice, Name: "fern", WateringFrequency: 7})
+
+	var grant SitterGrantModel
+	request := SitterGrantRequest{Label: "neighbour", PlantIDs: []uint{plant.ID}, ExpiresAt: time.Now().Add(time.Hour)}
+	if err := CreateSitterGrant(db, alice, &request, &grant); err != nil {
+		t.Fatal(err)
+	}
+	// the link opens the frontend's sitting page
+	link, err := url.Parse(grant.Link)
+	if err != nil || !strings.HasPrefix(grant.Link, siteUrl()+"/") || link.Path != "/sitting" {
+		t.Fatalf("link %q", grant.Link)
+	}
+	token := link.Query().Get("token")
+
+	var loaded SitterGrantModel
+	if err := GetSitterGrantByToken(db, token, &loaded); err != nil {
+		t.Fatal(err)
+	}
+	if loaded.ID != grant.ID || len(loaded.Plants) != 1 {
+		t.Errorf("loaded %+v", loaded)
+	}
+	if err := GetSitterGrantByToken(db, token+"x", &loaded); !errors.Is(err, ErrInvalidGrant) {
+		t.Errorf("expected ErrInvalidGrant for a wrong token, got %v", err)
+	}
+}
+
+func TestSitterGrantExpiry(t *testing.T) {
+	db := newTestDb(t)
+	alice := createTestUser(t, db, "alice")
+	bob := createTestUser(t, db, "bob")
+	lastWater := NewCareDate(time.Now().AddDate(0, 0, -3))
+	plant := createTestPlant(t, db, PlantModel{UserID: alice, Name: "fern", WateringFrequency: 7, LastWaterDate: lastWater, LastFertilizeDate: lastWater})
+	other := createTestPlant(t, db, PlantModel{UserID: alice, Name: "ivy", WateringFrequency: 7})
+
+	var grant SitterGrantModel
+	request := SitterGrantRequest{Email: "bob@example.com", PlantIDs: []uint{plant.ID}, ExpiresAt: time.Now().Add(time.Hour)}
+	if err := CreateSitterGrant(db, alice, &request, &grant); err != nil {
+		t.Fatal(err)
+	}
+	var sitting []SitterGrantModel
+	if err := GetSittingGrants(db, bob, &sitting); err != nil || len(sitting) != 1 {
+		t.Fatalf("bob is sitting %d grant(s), %v", len(sitting), err)
+	}
+	if err := GetSitterGrantForSitter(db, grant.ID, alice, &grant); !errors.Is(err, ErrInvalidGrant) {
+		t.Errorf("expected ErrInvalidGrant for someone else's grant, got %v", err)
+	}
+	if err := GetSitterGrantForSitter(db, grant.ID, bob, &grant); err != nil {
+		t.Fatal(err)
+	}
+
+	sitter := userContact{ID: bob, Email: "bob@example.com", Username: "bob"}
+	var cared PlantModel
+	event := CareEventModel{PlantID: int(other.ID), Kind: EVENT_WATERED}
+	if err := RecordSitterCare(db, &grant, sitter, &cared, &event); !errors.Is(err, ErrPlantNotInGrant) {
+		t.Errorf("expected ErrPlantNotInGrant, got %v", err)
+	}
+	event = CareEventModel{PlantID: int(plant.ID), Kind: EVENT_WATERED}
+	if err := RecordSitterCare(db, &grant, sitter, &cared, &event); err != nil {
+		t.Fatal(err)
+	}
+	if !cared.LastWaterDate.Time.After(lastWater.Time) || event.GrantID != grant.ID || event.UserID != bob {
+		t.Errorf("care recorded as %+v on %+v", event, cared)
+	}
+
+	// a grant loaded just before it expired can't be used after
+	grant.ExpiresAt = time.Now().Add(-time.Second)
+	event = CareEventModel{PlantID: int(plant.ID), Kind: EVENT_WATERED}
+	if err := RecordSitterCare(db, &grant, sitter, &cared, &event); !errors.Is(err, ErrInvalidGrant) {
+		t.Errorf("expected ErrInvalidGrant for an expired grant, got %v", err)
+	}
+	db.Model(&SitterGrantModel{}).Where("id = ?", grant.ID).Update("expires_at", grant.ExpiresAt)
+	if err := GetSitterGrantForSitter(db, grant.ID, bob, &grant); !errors.Is(err, ErrInvalidGrant) {
+		t.Errorf("expected ErrInvalidGrant once expired, got %v", err)
+	}
+	if err := GetSittingGrants(db, bob, &sitting); err != nil || len(sitting) != 0 {
+		t.Errorf("bob is still sitting %d grant(s), %v", len(sitting), err)
+	}
+}
+
+func TestRevokeSitterGrant(t *testing.T) {
+	db := newTestDb(t)
+	alice := createTestUser(t, db, "alice")
+	bob := createTestUser(t, db, "bob")
+	plant := createTestPlant(t, db, PlantModel{UserID: alice, Name: "fern", WateringFrequency: 7})
+
+	var grant SitterGrantModel
+	request := SitterGrantRequest{PlantIDs: []uint{plant.ID}, ExpiresAt: time.Now().Add(time.Hour)}
+	if err := CreateSitterGrant(db, alice, &request, &grant); err != nil {
+		t.Fatal(err)
+	}
+	link, _ := url.Parse(grant.Link)
+	if err := RevokeSitterGrant(db, grant.ID, bob); err == nil {
+		t.Error("expected only the granter to revoke")
+	}
+	if err := RevokeSitterGrant(db, grant.ID, alice); err != nil {
+		t.Fatal(err)
+	}
+	if err := GetSitterGrantByToken(db, link.Query().Get("token"), &grant); !errors.Is(err, ErrInvalidGrant) {
+		t.Errorf("expected ErrInvalidGrant once revoked, got %v", err)
+	}
+}
+
+func TestCreateSitterGrantValidation(t *testing.T) {
+	db := newTestDb(t)
+	alice := createTestUser(t, db, "alice")
+	bob := createTestUser(t, db, "bob")
+	plant := createTestPlant(t, db, PlantModel{UserID: alice, Name: "fern", WateringFrequency: 7})
+	soon := time.Now().Add(time.Hour)
+
+	for name, c := range map[string]struct {
+		userId  uint
+		request SitterGrantRequest
+	}{
+		"expired":    {alice, SitterGrantRequest{PlantIDs: []uint{plant.ID}, ExpiresAt: time.Now().Add(-time.Hour)}},
+		"too long":   {alice, SitterGrantRequest{PlantIDs: []uint{plant.ID}, ExpiresAt: time.Now().Add(MAX_SITTER_GRANT_DURATION + time.Hour)}},
+		"no plants":  {alice, SitterGrantRequest{ExpiresAt: soon}},
+		"not owner":  {bob, SitterGrantRequest{PlantIDs: []uint{plant.ID}, ExpiresAt: soon}},
+		"themselves": {alice, SitterGrantRequest{Email: "alice@example.com", PlantIDs: []uint{plant.ID}, ExpiresAt: soon}},
+	} {
+		var grant SitterGrantModel
+		if err := CreateSitterGrant(db, c.userId, &c.request, &grant); err == nil {
+			t.Errorf("%s: expected the grant to be refused", name)
+		}
+	}
+}
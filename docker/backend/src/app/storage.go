@@ -2,9 +2,15 @@
 package app
 
 import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/waterproofpatch/go_authentication/authentication"
 	"gorm.io/gorm"
 )
 
@@ -32,22 +38,304 @@ func checkDBConnection(db *gorm.DB) error {
 	return fmt.Errorf("database connection failed after 5 attempts")
 }
 
-func GetPlants(db *gorm.DB, email string, plants *[]PlantModel) error {
+func GetPlants(db *gorm.DB, userId uint, plants *[]PlantModel) error {
 	// Use the helper function to check the database connection
 	if err := checkDBConnection(db); err != nil {
 		return err
 	}
 
-	if email == "" {
+	if userId == 0 {
 		db.Where("is_public = ?", true).Preload("Logs").Preload("Comments").Find(&plants)
 	} else {
-		db.Where("email = ? OR is_public = ?", email, true).Preload("Logs").Preload("Comments").Find(&plants)
+		db.Where("user_id = ? OR is_public = ? OR household_id IN (?)", userId, true, userHouseholdIds(db, userId)).Preload("Logs").Preload("Comments").Find(&plants)
 	}
 	if db.Error != nil {
 		fmt.Println("Had an error getting plants:", db.Error)
 		return db.Error
 	}
+	if err := resolvePlantNames(db, *plants); err != nil {
+		return err
+	}
 	// print the number of plants we got
 	fmt.Printf("Got %d plants\n", len(*plants))
 	return nil
 }
+
+var DEFAULT_PLANT_PAGE_SIZE = 50
+var MAX_PLANT_PAGE_SIZE = 200
+
+// PlantQuery describes which plants to list and in what order.
+type PlantQuery struct {
+	Name       string
+	Tags       []string
+	Owners     []string
+	NeedsCare  bool
+	Visibility string
+	Sort       string
+	Cursor     string
+	Limit      int
+	// associations to preload, see PLANT_INCLUDES
+	Include []string
+}
+
+type PlantPage struct {
+	Plants     []PlantModel `json:"plants"`
+	NextCursor string       `json:"nextCursor"`
+}
+
+// a sortable column, and how to carry a plant's value of it in a cursor
+type plantSort struct {
+	column string
+	desc   bool
+	key    plantSortKey
+}
+
+// plantSortKey reads a sort column's value off a plant, and turns it back into
+// something to compare the column with. Nullable columns sort their NULLs
+// after every value, and read them as "".
+type plantSortKey struct {
+	value    func(plant *PlantModel) string
+	parse    func(key string) (interface{}, error)
+	nullable bool
+}
+
+var nameSortKey = plantSortKey{
+	value: func(p *PlantModel) string { return p.Name },
+	parse: func(key string) (interface{}, error) { return key, nil },
+}
+
+var idSortKey = plantSortKey{
+	value: func(p *PlantModel) string { return fmt.Sprint(p.ID) },
+	parse: func(key string) (interface{}, error) { return strconv.ParseUint(key, 10, 64) },
+}
+
+func timeSortKey(date func(p *PlantModel) CareDate, nullable bool) plantSortKey {
+	return plantSortKey{
+		value: func(p *PlantModel) string {
+			if !date(p).Valid {
+				return ""
+			}
+			return date(p).Time.UTC().Format(time.RFC3339Nano)
+		},
+		parse: func(key string) (interface{}, error) {
+			return time.Parse(time.RFC3339Nano, key)
+		},
+		nullable: nullable,
+	}
+}
+
+var updatedSortKey = timeSortKey(func(p *PlantModel) CareDate { return NewCareDate(p.UpdatedAt) }, false)
+
+// next watering due, as set by setCareDueDates
+var nextCareSortKey = timeSortKey(func(p *PlantModel) CareDate { return p.WaterDueDate }, true)
+
+var plantSorts = map[string]plantSort{
+	"name":      {"name", false, nameSortKey},
+	"-name":     {"name", true, nameSortKey},
+	"created":   {"id", false, idSortKey},
+	"-created":  {"id", true, idSortKey},
+	"updated":   {"updated_at", false, updatedSortKey},
+	"-updated":  {"updated_at", true, updatedSortKey},
+	"nextCare":  {"water_due_date", false, nextCareSortKey},
+	"-nextCare": {"water_due_date", true, nextCareSortKey},
+}
+
+// order is the ORDER BY clause of a sort. NULLs come last going up and
+// first going down, as if they were later than any value.
+func (sort plantSort) order() string {
+	direction := "ASC"
+	if sort.desc {
+		direction = "DESC"
+	}
+	order := fmt.Sprintf("%s %s, id %s", sort.column, direction, direction)
+	if sort.key.nullable {
+		order = fmt.Sprintf("%s IS NULL %s, %s", sort.column, direction, order)
+	}
+	return order
+}
+
+// after narrows tx to the plants that come after the cursor's plant.
+func (sort plantSort) after(tx *gorm.DB, cursor plantCursor) (*gorm.DB, error) {
+	op := ">"
+	if sort.desc {
+		op = "<"
+	}
+	column := sort.column
+	if sort.key.nullable && cursor.Key == "" {
+		if sort.desc {
+			return tx.Where(fmt.Sprintf("(%s IS NULL AND id < ?) OR %s IS NOT NULL", column, column), cursor.ID), nil
+		}
+		return tx.Where(fmt.Sprintf("%s IS NULL AND id > ?", column), cursor.ID), nil
+	}
+	key, err := sort.key.parse(cursor.Key)
+	if err != nil {
+		return nil, errors.New("Invalid cursor.")
+	}
+	condition := fmt.Sprintf("%s %s ? OR (%s = ? AND id %s ?)", column, op, column, op)
+	if sort.key.nullable && !sort.desc {
+		condition += fmt.Sprintf(" OR %s IS NULL", column)
+	}
+	return tx.Where(condition, key, key, cursor.ID), nil
+}
+
+var DEFAULT_PLANT_SORT = "created"
+
+// associations of a plant that can be embedded in responses, by their JSON name
+var PLANT_INCLUDES = map[string]string{
+	"logs":     "Logs",
+	"comments": "Comments",
+	"photos":   "Photos",
+}
+
+// order of included associations, where it matters
+var plantIncludeOrders = map[string]string{
+	"Photos": "taken_at asc, id asc",
+}
+
+// preloadPlantIncludes preloads the named associations, rejecting unknown ones.
+func preloadPlantIncludes(db *gorm.DB, include []string) (*gorm.DB, error) {
+	for _, name := range include {
+		association, ok := PLANT_INCLUDES[name]
+		if !ok {
+			return nil, fmt.Errorf("Cannot include '%s'.", name)
+		}
+		if order, ok := plantIncludeOrders[association]; ok {
+			db = db.Preload(association, func(db *gorm.DB) *gorm.DB {
+				return db.Order(order)
+			})
+		} else {
+			db = db.Preload(association)
+		}
+	}
+	return db, nil
+}
+
+// cursors are base64 JSON holding the sort they belong to and the sort key and
+// ID of the last plant on the previous page
+type plantCursor struct {
+	Sort string `json:"s"`
+	Key  string `json:"k"`
+	ID   uint   `json:"id"`
+}
+
+func encodePlantCursor(cursor plantCursor) string {
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodePlantCursor(value string) (plantCursor, error) {
+	var cursor plantCursor
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return cursor, errors.New("Invalid cursor.")
+	}
+	if err := json.Unmarshal(data, &cursor); err != nil {
+		return cursor, errors.New("Invalid cursor.")
+	}
+	return cursor, nil
+}
+
+// GetPlantsPage lists the plants visible to a user (public ones if userId is
+// 0) that match query, a page at a time. Plants of the user's households
+// count as theirs.
+func GetPlantsPage(db *gorm.DB, userId uint, query *PlantQuery, page *PlantPage) error {
+	if err := checkDBConnection(db); err != nil {
+		return err
+	}
+
+	sortName := query.Sort
+	if sortName == "" {
+		sortName = DEFAULT_PLANT_SORT
+	}
+	sort, ok := plantSorts[sortName]
+	if !ok {
+		return errors.New("Invalid sort.")
+	}
+	limit := query.Limit
+	if limit <= 0 {
+		limit = DEFAULT_PLANT_PAGE_SIZE
+	}
+	if limit > MAX_PLANT_PAGE_SIZE {
+		limit = MAX_PLANT_PAGE_SIZE
+	}
+
+	tx := db.Model(&PlantModel{})
+	if userId == 0 {
+		tx = tx.Where("is_public = ?", true)
+	} else {
+		tx = tx.Where("user_id = ? OR is_public = ? OR household_id IN (?)", userId, true, userHouseholdIds(db, userId))
+	}
+
+	switch query.Visibility {
+	case "":
+	case "public":
+		tx = tx.Where("is_public = ?", true)
+	case "private":
+		tx = tx.Where("is_public = ?", false).Where("user_id = ? OR household_id IN (?)", userId, userHouseholdIds(db, userId))
+	case "mine":
+		tx = tx.Where("user_id = ? OR household_id IN (?)", userId, userHouseholdIds(db, userId))
+	default:
+		return errors.New("Invalid visibility.")
+	}
+	if query.Name != "" {
+		tx = tx.Where("LOWER(name) LIKE ?", "%"+strings.ToLower(escapeLike(query.Name))+"%")
+	}
+	if len(query.Tags) > 0 {
+		tx = tx.Where("tag IN ?", query.Tags)
+	}
+	if len(query.Owners) > 0 {
+		// owners are named by their current username
+		tx = tx.Where("user_id IN (?)", db.Model(&authentication.User{}).Select("id").Where("username IN ?", query.Owners))
+	}
+	if query.NeedsCare {
+		// overdue as the reminders see it, see plantNeedsCare
+		now := time.Now()
+		cutoff := overdueCutoff(now, REMINDER_GRACE_DAYS)
+		tx = tx.Where("water_due_date < ? OR fertilize_due_date < ? OR moist_check_due_date < ?", cutoff, cutoff, now)
+	}
+
+	if query.Cursor != "" {
+		cursor, err := decodePlantCursor(query.Cursor)
+		if err != nil {
+			return err
+		}
+		if cursor.Sort != sortName {
+			return errors.New("Cursor does not match sort.")
+		}
+		if tx, err = sort.after(tx, cursor); err != nil {
+			return err
+		}
+	}
+
+	tx, err := preloadPlantIncludes(tx, query.Include)
+	if err != nil {
+		return err
+	}
+
+	var plants []PlantModel
+	err = tx.Order(sort.order()).
+		Limit(limit + 1).
+		Find(&plants).Error
+	if err != nil {
+		fmt.Println("Had an error getting plants:", err)
+		return err
+	}
+	if err := resolvePlantNames(db, plants); err != nil {
+		return err
+	}
+
+	page.NextCursor = ""
+	if len(plants) > limit {
+		plants = plants[:limit]
+		last := &plants[limit-1]
+		page.NextCursor = encodePlantCursor(plantCursor{Sort: sortName, Key: sort.key.value(last), ID: last.ID})
+	}
+	page.Plants = plants
+	fmt.Printf("Got %d plants\n", len(plants))
+	return nil
+}
+
+// escape LIKE wildcards in user input
+func escapeLike(value string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(value)
+}
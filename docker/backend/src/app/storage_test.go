@@ -0,0 +1,221 @@
+package app
+
+import (
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// pagedPlants lists the plants query matches, following cursors limit plants
+// at a time.
+func pagedPlants(t *testing.T, db *gorm.DB, userId uint, query PlantQuery, limit int) []PlantModel {
+	t.Helper()
+	var plants []PlantModel
+	query.Limit = limit
+	for pages := 0; ; pages++ {
+		if pages > 100 {
+			t.Fatal("paging does not end")
+		}
+		var page PlantPage
+		if err := GetPlantsPage(db, userId, &query, &page); err != nil {
+			t.Fatal(err)
+		}
+		if len(page.Plants) > limit {
+			t.Fatalf("page of %d plants, limit %d", len(page.Plants), limit)
+		}
+		plants = append(plants, page.Plants...)
+		if page.NextCursor == "" {
+			return plants
+		}
+		query.Cursor = page.NextCursor
+	}
+}
+
+func plantNames(plants []PlantModel) []string {
+	var names []string
+	for _, plant := range plants {
+		names = append(names, plant.Name)
+	}
+	return names
+}
+
+func equalNames(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// plants with care due at different times, ties, and no schedule at all
+func createPagingTestPlants(t *testing.T, db *gorm.DB, userId uint) {
+	now := time.Now()
+	ago := func(days int) CareDate { return NewCareDate(now.AddDate(0, 0, -days)) }
+	tie := ago(2)
+	plants := []PlantModel{
+		{Name: "a", WateringFrequency: 7, LastWaterDate: tie},
+		{Name: "b", WateringFrequency: 7, LastWaterDate: tie},
+		// past the grace period
+		{Name: "c", WateringFrequency: 3, LastWaterDate: ago(10)},
+		{Name: "d", WateringFrequency: 0, LastWaterDate: ago(1)},
+		{Name: "e", WateringFrequency: 7},
+		{Name: "f", WateringFrequency: 14, LastWaterDate: ago(1)},
+		// due, but within the grace period
+		{Name: "g", WateringFrequency: 2, LastWaterDate: ago(4)},
+		// soil found moist since watering, and not checked again
+		{Name: "h", WateringFrequency: 7, LastWaterDate: ago(3), LastMoistDate: ago(2)},
+		{Name: "i", FertilizingFrequency: 30, LastFertilizeDate: ago(40)},
+		{Name: "twin", WateringFrequency: -1, LastWaterDate: ago(1)},
+		{Name: "twin"},
+	}
+	for _, plant := range plants {
+		plant.UserID = userId
+		createTestPlant(t, db, plant)
+	}
+}
+
+func TestPlantPagingOrder(t *testing.T) {
+	db := newTestDb(t)
+	userId := createTestUser(t, db, "alice")
+	createPagingTestPlants(t, db, userId)
+
+	cases := map[string][]string{
+		"nextCare":  {"c", "g", "h", "a", "b", "f", "d", "e", "i", "twin", "twin"},
+		"-nextCare": {"twin", "twin", "i", "e", "d", "f", "b", "a", "h", "g", "c"},
+		"name":      {"a", "b", "c", "d", "e", "f", "g", "h", "i", "twin", "twin"},
+		"-name":     {"twin", "twin", "i", "h", "g", "f", "e", "d", "c", "b", "a"},
+		"created":   {"a", "b", "c", "d", "e", "f", "g", "h", "i", "twin", "twin"},
+		"-created":  {"twin", "twin", "i", "h", "g", "f", "e", "d", "c", "b", "a"},
+	}
+	for sort, expected := range cases {
+		all := pagedPlants(t, db, userId, PlantQuery{Sort: sort}, MAX_PLANT_PAGE_SIZE)
+		if names := plantNames(all); !equalNames(names, expected) {
+			t.Errorf("%s: got %v, want %v", sort, names, expected)
+		}
+	}
+
+	// every page size sees every plant once, in the same order, for every sort
+	for sort := range plantSorts {
+		all := pagedPlants(t, db, userId, PlantQuery{Sort: sort}, MAX_PLANT_PAGE_SIZE)
+		for _, limit := range []int{1, 2, 3, 4} {
+			paged := pagedPlants(t, db, userId, PlantQuery{Sort: sort}, limit)
+			if len(paged) != len(all) {
+				t.Errorf("%s by %d: %d plants, want %d", sort, limit, len(paged), len(all))
+				continue
+			}
+			for i := range all {
+				if paged[i].ID != all[i].ID {
+					t.Errorf("%s by %d: plant %d is %d, want %d", sort, limit, i, paged[i].ID, all[i].ID)
+					break
+				}
+			}
+		}
+	}
+}
+
+func TestPlantPagingCursors(t *testing.T) {
+	db := newTestDb(t)
+	userId := createTestUser(t, db, "alice")
+	createPagingTestPlants(t, db, userId)
+
+	var page PlantPage
+	if err := GetPlantsPage(db, userId, &PlantQuery{Sort: "name", Limit: 2}, &page); err != nil {
+		t.Fatal(err)
+	}
+	if err := GetPlantsPage(db, userId, &PlantQuery{Sort: "nextCare", Cursor: page.NextCursor}, &page); err == nil {
+		t.Error("expected a cursor from another sort to be refused")
+	}
+	if err := GetPlantsPage(db, userId, &PlantQuery{Sort: "nextCare", Cursor: "garbage"}, &page); err == nil {
+		t.Error("expected a malformed cursor to be refused")
+	}
+	forged := encodePlantCursor(plantCursor{Sort: "nextCare", Key: "yesterday", ID: 1})
+	if err := GetPlantsPage(db, userId, &PlantQuery{Sort: "nextCare", Cursor: forged}, &page); err == nil {
+		t.Error("expected a cursor with a malformed key to be refused")
+	}
+	if err := GetPlantsPage(db, userId, &PlantQuery{Sort: "soil"}, &page); err == nil {
+		t.Error("expected an unknown sort to be refused")
+	}
+}
+
+// the needsCare filter agrees with the reminders
+func TestNeedsCareFilter(t *testing.T) {
+	db := newTestDb(t)
+	userId := createTestUser(t, db, "alice")
+	createPagingTestPlants(t, db, userId)
+
+	needsCare := pagedPlants(t, db, userId, PlantQuery{Sort: "name", NeedsCare: true}, MAX_PLANT_PAGE_SIZE)
+	if names := plantNames(needsCare); !equalNames(names, []string{"c", "h", "i"}) {
+		t.Errorf("got %v", names)
+	}
+	filtered := map[uint]bool{}
+	for _, plant := range needsCare {
+		filtered[plant.ID] = true
+	}
+	var plants []PlantModel
+	db.Find(&plants)
+	for i := range plants {
+		needsWater, needsFertilizer := plantNeedsCare(&plants[i])
+		if (needsWater || needsFertilizer) != filtered[plants[i].ID] {
+			t.Errorf("%s: reminders say %t, the filter %t", plants[i].Name, needsWater || needsFertilizer, filtered[plants[i].ID])
+		}
+	}
+}
+
+// due dates follow care and schedule changes
+func TestCareDueDatesFollowChanges(t *testing.T) {
+	db := newTestDb(t)
+	userId := createTestUser(t, db, "alice")
+	now := time.Now()
+	plant := createTestPlant(t, db, PlantModel{UserID: userId, Name: "fern", WateringFrequency: 3,
+		LastWaterDate: NewCareDate(now.AddDate(0, 0, -10)), LastFertilizeDate: NewCareDate(now.AddDate(0, 0, -10))})
+
+	event := CareEventModel{Kind: EVENT_WATERED, OccurredAt: now}
+	if err := RecordCareAction(db, &plant, &event); err != nil {
+		t.Fatal(err)
+	}
+	plant = reloadTestPlant(t, db, plant.ID)
+	if !plant.WaterDueDate.Valid || !plant.WaterDueDate.Time.Equal(now.AddDate(0, 0, 3)) {
+		t.Errorf("after watering, water due %s", plant.WaterDueDate)
+	}
+
+	event = CareEventModel{Kind: EVENT_MOIST_CHECK, OccurredAt: now.Add(time.Minute)}
+	if err := RecordCareAction(db, &plant, &event); err != nil {
+		t.Fatal(err)
+	}
+	plant = reloadTestPlant(t, db, plant.ID)
+	if !plant.MoistCheckDueDate.Valid {
+		t.Errorf("moist check due %s", plant.MoistCheckDueDate)
+	}
+
+	plant.WateringFrequency = -1
+	if err := UpdatePlant(db, &plant, false, userId); err != nil {
+		t.Fatal(err)
+	}
+	plant = reloadTestPlant(t, db, plant.ID)
+	if plant.WaterDueDate.Valid {
+		t.Errorf("without a schedule, water due %s", plant.WaterDueDate)
+	}
+}
+
+func TestBackfillCareDueDates(t *testing.T) {
+	db := newTestDb(t)
+	userId := createTestUser(t, db, "alice")
+	lastWater := NewCareDate(time.Now().AddDate(0, 0, -1))
+	plant := PlantModel{UserID: userId, Name: "fern", WateringFrequency: 7, LastWaterDate: lastWater}
+	// stored before due dates were kept
+	if err := db.Create(&plant).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := backfillCareDueDates(db); err != nil {
+		t.Fatal(err)
+	}
+	plant = reloadTestPlant(t, db, plant.ID)
+	if !plant.WaterDueDate.Valid || !plant.WaterDueDate.Time.Equal(lastWater.Time.AddDate(0, 0, 7)) {
+		t.Errorf("water due %s", plant.WaterDueDate)
+	}
+}
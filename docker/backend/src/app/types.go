@@ -1,5 +1,12 @@
 package app
 
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
 // Declare a new custom type
 type ResponseCode int
 
@@ -12,3 +19,56 @@ type HttpResponse struct {
 	Message string       `json:"message"`
 	Code    ResponseCode `json:"code"`
 }
+
+// the format care dates are exchanged with the frontend in
+const CARE_DATE_LAYOUT = "01/02/2006"
+
+// CareDate is a nullable timestamp column. It is exchanged with the frontend
+// as a "01/02/2006" string, or "" when unset, so older clients keep working.
+type CareDate struct {
+	sql.NullTime
+}
+
+func NewCareDate(t time.Time) CareDate {
+	return CareDate{sql.NullTime{Time: t, Valid: true}}
+}
+
+func (d CareDate) GormDataType() string {
+	return "time"
+}
+
+func (d CareDate) String() string {
+	if !d.Valid {
+		return ""
+	}
+	return d.Time.UTC().Format(CARE_DATE_LAYOUT)
+}
+
+// Equal reports whether both dates are unset or both refer to the same instant.
+func (d CareDate) Equal(other CareDate) bool {
+	if d.Valid != other.Valid {
+		return false
+	}
+	return !d.Valid || d.Time.Equal(other.Time)
+}
+
+func (d CareDate) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *CareDate) UnmarshalJSON(data []byte) error {
+	var s *string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	if s == nil || *s == "" {
+		*d = CareDate{}
+		return nil
+	}
+	t, err := parseCareDate(*s)
+	if err != nil {
+		return fmt.Errorf("invalid date %q", *s)
+	}
+	*d = NewCareDate(t)
+	return nil
+}
@@ -0,0 +1,142 @@
+// accounts from go_authentication, which own plants and comments by ID
+package app
+
+import (
+	"errors"
+
+	"github.com/waterproofpatch/go_authentication/authentication"
+	auth_types "github.com/waterproofpatch/go_authentication/types"
+	"gorm.io/gorm"
+)
+
+var ErrUnknownUser = errors.New("No account is registered with that email.")
+
+// an account's current contact details. Rows only store the account's ID, so
+// that changing an email or username doesn't orphan or go stale on them.
+type userContact struct {
+	ID       uint
+	Email    string
+	Username string
+}
+
+// userIdForEmail returns the ID of the account registered with email.
+func userIdForEmail(db *gorm.DB, email string) (uint, error) {
+	var ids []uint
+	err := db.Model(&authentication.User{}).Where("email = ?", email).Order("id asc").Limit(1).Pluck("id", &ids).Error
+	if err != nil {
+		return 0, err
+	}
+	if len(ids) == 0 {
+		return 0, ErrUnknownUser
+	}
+	return ids[0], nil
+}
+
+// callerId returns the ID of the logged in caller, or 0 for anonymous
+// callers. Tokens carry the caller's email, which is looked up on every
+// request so that it follows email changes.
+func callerId(db *gorm.DB, claims *auth_types.JWTData) (uint, error) {
+	if claims == nil {
+		return 0, nil
+	}
+	return userIdForEmail(db, claims.Email)
+}
+
+// usersById loads the current contact details of each account in ids.
+// Accounts that no longer exist are left out.
+func usersById(db *gorm.DB, ids []uint) (map[uint]userContact, error) {
+	users := map[uint]userContact{}
+	if len(ids) == 0 {
+		return users, nil
+	}
+	var found []userContact
+	if err := db.Model(&authentication.User{}).Where("id IN ?", ids).Find(&found).Error; err != nil {
+		return nil, err
+	}
+	for _, user := range found {
+		users[user.ID] = user
+	}
+	return users, nil
+}
+
+// userById loads the current contact details of one account.
+func userById(db *gorm.DB, id uint) (userContact, error) {
+	users, err := usersById(db, []uint{id})
+	if err != nil {
+		return userContact{}, err
+	}
+	user, ok := users[id]
+	if !ok {
+		return user, gorm.ErrRecordNotFound
+	}
+	return user, nil
+}
+
+// resolvePlantNames fills in the current usernames of the plants' owners and
+// of whoever commented on them.
+func resolvePlantNames(db *gorm.DB, plants []PlantModel) error {
+	var ids []uint
+	for i := range plants {
+		ids = append(ids, plants[i].UserID)
+		for j := range plants[i].Comments {
+			ids = append(ids, plants[i].Comments[j].UserID)
+		}
+	}
+	users, err := usersById(db, ids)
+	if err != nil {
+		return err
+	}
+	for i := range plants {
+		plants[i].Username = users[plants[i].UserID].Username
+		for j := range plants[i].Comments {
+			plants[i].Comments[j].Username = users[plants[i].Comments[j].UserID].Username
+		}
+	}
+	return nil
+}
+
+// resolvePlantName fills in the usernames on a single plant.
+func resolvePlantName(db *gorm.DB, plant *PlantModel) error {
+	plants := []PlantModel{*plant}
+	if err := resolvePlantNames(db, plants); err != nil {
+		return err
+	}
+	*plant = plants[0]
+	return nil
+}
+
+// resolveCareEventNames fills in the current usernames of whoever gave care.
+// Events from before care was attributed by ID, whose account is gone, keep
+// the name they were stored with.
+func resolveCareEventNames(db *gorm.DB, events []CareEventModel) error {
+	var ids []uint
+	for i := range events {
+		ids = append(ids, events[i].UserID)
+	}
+	users, err := usersById(db, ids)
+	if err != nil {
+		return err
+	}
+	for i := range events {
+		if user, ok := users[events[i].UserID]; ok {
+			events[i].Actor = user.Username
+		}
+	}
+	return nil
+}
+
+// resolveCommentNames fills in the current usernames of commenters.
+func resolveCommentNames(db *gorm.DB, comments []CommentModel) error {
+	var ids []uint
+	for i := range comments {
+		ids = append(ids, comments[i].UserID)
+	}
+	users, err := usersById(db, ids)
+	if err != nil {
+		return err
+	}
+	for i := range comments {
+		comments[i].Username = users[comments[i].UserID].Username
+	}
+	return nil
+}
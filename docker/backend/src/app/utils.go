@@ -1,16 +1,12 @@
 package app
 
 import (
-	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"image"
-	"image/jpeg"
 	"io/ioutil"
 	"net/http"
 	"os"
-	"os/exec"
 	"regexp"
 	"time"
 	_ "time/tzdata"
@@ -28,42 +24,32 @@ func formattedTime() string {
 	return currentTime.Format("01/02/2006  03:04:05 PM (EST)")
 }
 
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
 func isValidInput(input string) bool {
 	alphanumeric := regexp.MustCompile(`^[a-zA-Z0-9_]{3,16}$`)
 	return alphanumeric.MatchString(input)
 }
 
-// execute the python script 'plant_care_driver.py' in /email_service to send an email
-func sendEmail(plant *PlantModel, needsFertilizer bool, needsWater bool) {
-	fmt.Println("Building email...")
-	args := []string{"/email_service/plant_care_driver.py", "--recipient", plant.Email, "--plant-name", plant.Name, "--username", plant.Username}
-	if needsFertilizer {
-		args = append(args, "--needs-fertilizer")
+// queue a care digest email listing every due plant to their owner
+func sendCareDigest(db *gorm.DB, email string, duePlants []duePlant) error {
+	if os.Getenv("DEBUG_EMAIL") != "" && os.Getenv("DEBUG_EMAIL") != email {
+		fmt.Println("Debug email does not match recipient. Not sending.")
+		return nil
 	}
-	if needsWater {
-		args = append(args, "--needs-water")
-	}
-	cmd := exec.Command("/email_service/venv/bin/python", args...)
-	stdout, err := cmd.CombinedOutput()
-	if err != nil {
-		fmt.Println(string(stdout), err.Error())
-		return
-	}
-	fmt.Println(string(stdout))
-	tmpDate, err := getEstTimeNow()
+	fmt.Println("Building email...")
+	msg, err := renderCareEmail(email, duePlants)
 	if err != nil {
-		fmt.Printf("failed getting estTime\n")
-		return
-	}
-	if needsFertilizer {
-		fmt.Printf("Updating last fertilize notify date (%s)", plant.LastFertilizeNotifyDate)
-		plant.LastFertilizeNotifyDate = tmpDate.String()
-	}
-	if needsWater {
-		fmt.Printf("Updating last water and moist notify dates (%s, %s)", plant.LastWaterNotifyDate, plant.LastMoistNotifyDate)
-		plant.LastWaterNotifyDate = tmpDate.String()
-		plant.LastMoistNotifyDate = tmpDate.String()
+		return err
 	}
+	return queueEmail(db, msg)
 }
 
 func getEstTimeNow() (time.Time, error) {
@@ -81,119 +67,29 @@ func getEstTime(theTime time.Time) (time.Time, error) {
 	return estTime, nil
 }
 
-func needsCare(lastCareDate string, intervalDays int) bool {
-	dateLayoutStr := "01/02/2006"
-	lastCareTime, err := time.Parse(dateLayoutStr, lastCareDate)
-	if err != nil {
-		// attempt format migration
-		fmt.Println("Error parsing lastCareDate string:", err)
-		inputDateLayouts := []string{"Mon Jan 2 2006", "Mon Jan 02 2006"}
-
-		var date time.Time
-		for _, layout := range inputDateLayouts {
-			date, err = time.Parse(layout, lastCareDate)
-			if err == nil {
-				break
-			}
-		}
-
-		if err != nil {
-			// handle error
-			fmt.Println("Cannot migrate from", lastCareDate)
-			return false
-		} else {
-
-			fmt.Println("Migrating format from", lastCareDate)
-			// check/debug new date and see if it is in the format we want
-			outputDateStr := date.Format(dateLayoutStr)
-			fmt.Println("New date string after conversion: ", outputDateStr)
-			lastCareTime = date
+// parse a care date as sent by the frontend, accepting the older formats
+// some clients still send
+func parseCareDate(careDate string) (time.Time, error) {
+	dateLayouts := []string{CARE_DATE_LAYOUT, "Mon Jan 2 2006", "Mon Jan 02 2006", time.RFC3339}
+	var date time.Time
+	var err error
+	for _, layout := range dateLayouts {
+		date, err = time.Parse(layout, careDate)
+		if err == nil {
+			return date, nil
 		}
 	}
-	if err != nil {
-		fmt.Printf("Failed converting last care time to est")
-		return false
-	}
-	timeNow := time.Now()
-	timeNowEst, err := getEstTime(timeNow)
-	// email reminders should be sent as reminders, not alerts - so
-	// add a few days after the last care date to send reminders.
-	nextCareTime := lastCareTime.AddDate(0, 0, intervalDays+3)
-	if nextCareTime.Before(timeNowEst) {
-		fmt.Printf("Needs care: last care time: %v, next care time: %v, today is %v\n", lastCareTime, nextCareTime, timeNowEst)
+	return date, err
+}
+
+func needsCare(lastCareDate CareDate, intervalDays int) bool {
+	if isCareOverdue(lastCareDate, intervalDays, REMINDER_GRACE_DAYS, time.Now()) {
+		fmt.Printf("Needs care: last care time: %v, interval: %d days, grace: %d days\n", lastCareDate, intervalDays, REMINDER_GRACE_DAYS)
 		return true
 	}
 	return false
 }
 
-func StartTimer(stopCh chan bool, db *gorm.DB) {
-	// Create a ticker that ticks every 5 seconds
-	// this is bugged, and appears to be causing plants not to
-	// persist last water dates
-	return
-	// ticker := time.NewTicker(5 * time.Second)
-
-	// for {
-	// 	select {
-	// 	case <-ticker.C:
-	// 		// fmt.Printf("Tick...\n")
-	// 		var plants []PlantModel
-	// 		db.Find(&plants)
-
-	// 		for _, plant := range plants {
-	// 			if !plant.DoNotify {
-	// 				continue
-	// 			}
-	// 			needsWaterCare := false
-	// 			needsFertilizeCare := false
-	// 			if plant.LastMoistDate != "" && plant.LastMoistNotifyDate == "" {
-	// 				// fmt.Printf("Plant was marked as moist on %s\n", plant.LastMoistDate)
-	// 				// Parse the date string into a time.Time object
-	// 				date, err := time.Parse("01/02/2006", plant.LastMoistDate)
-	// 				if err != nil {
-	// 					panic(err)
-	// 				}
-	// 				// Calculate the duration between the current time and the date
-	// 				duration := time.Since(date)
-
-	// 				// moist checks are daily, for now
-	// 				if duration > 24*time.Hour {
-	// 					needsWaterCare = true
-	// 				}
-	// 			}
-	// 			// if a notification has not been set since the last
-	// 			// time the plant care date(s) have changed, check if we need
-	// 			// to send a notification
-	// 			if plant.LastWaterNotifyDate == "" {
-	// 				// fmt.Printf("Checking if plant %d (name=%s) needs water care...\n", plant.Id, plant.Name)
-	// 				needsWaterCare = needsCare(plant.LastWaterDate, plant.WateringFrequency)
-	// 			}
-	// 			if plant.LastFertilizeNotifyDate == "" {
-	// 				if plant.FertilizingFrequency > 0 {
-	// 					// fmt.Printf("Checking if plant %d (name=%s) needs fertilizer care...\n", plant.Id, plant.Name)
-	// 					needsFertilizeCare = needsCare(plant.LastFertilizeDate, plant.FertilizingFrequency)
-	// 				}
-	// 			}
-	// 			// is the plant overdue for watering
-	// 			if needsFertilizeCare || needsWaterCare {
-	// 				fmt.Printf("LastFertilizeNotifyDate=%s\n", plant.LastFertilizeNotifyDate)
-	// 				fmt.Printf("LastWaterNotifyDate=%s\n", plant.LastWaterNotifyDate)
-	// 				fmt.Printf("Sending notification to owner of plant %d (name=%s): %v (needsWaterCare=%v, needsFertilizeCare=%v)!\n", plant.ID, plant.Name, plant.Email, needsWaterCare, needsFertilizeCare)
-	// 				sendEmail(&plant,
-	// 					needsFertilizeCare,
-	// 					needsWaterCare)
-	// 				db.Save(&plant)
-	// 			}
-	// 		}
-	// 	case <-stopCh:
-	// 		// Stop the ticker and exit the goroutine
-	// 		fmt.Println("Stopping timer...")
-	// 		ticker.Stop()
-	// 		return
-	// 	}
-	// }
-}
-
 // returns -1 on failure, 0 on no-op, ImageModel.ID stored in database on success
 func ImageUploadHandler(w http.ResponseWriter, r *http.Request) int {
 	// Parse the multipart form in the request
@@ -221,42 +117,32 @@ func ImageUploadHandler(w http.ResponseWriter, r *http.Request) int {
 	// Print the original file size
 	fmt.Printf("Original file size: %d bytes\n", len(fileData))
 
-	// Decode the image data into an image.Image
-	img, _, err := image.Decode(bytes.NewReader(fileData))
+	// Read the orientation and capture time; nothing else from the original
+	// metadata is kept, since re-encoding drops it
+	exif, err := ReadExif(fileData)
 	if err != nil {
-		authentication.WriteError(w, "Failed decoding image.", http.StatusBadRequest)
-		return -1
+		fmt.Printf("Ignoring unreadable EXIF: %v\n", err)
 	}
 
-	// Create a new buffer to hold the compressed image data
-	var buf bytes.Buffer
-
-	// Compress the image using the jpeg.Encode function
-	err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: 75})
-	if err != nil {
-		authentication.WriteError(w, "Failed compressing image.", http.StatusBadRequest)
+	// Decode the image data into an image.Image, upright
+	img, format, err := DecodeUpload(fileData)
+	if errors.Is(err, ErrImageTooLarge) {
+		fmt.Printf("Refused image (format %q): %v\n", format, err)
+		authentication.WriteError(w, fmt.Sprintf("Images can be at most %d pixels wide or tall.", MAX_UPLOAD_IMAGE_EDGE), http.StatusBadRequest)
 		return -1
 	}
-
-	// Get the compressed image data as a byte slice
-	compressedFileData := buf.Bytes()
-
-	// Print the compressed file size
-	fmt.Printf("Compressed file size: %d bytes\n", len(compressedFileData))
-
-	// Open a connection to the database
-	db := authentication.GetDb()
-
-	// Create a new Image instance and set its fields
-	image := ImageModel{
-		Name: "image.jpg",
-		Data: compressedFileData,
+	if err != nil {
+		fmt.Printf("Failed decoding image (format %q): %v\n", format, err)
+		authentication.WriteError(w, "Failed decoding image.", http.StatusBadRequest)
+		return -1
 	}
+	img = applyOrientation(img, exif.Orientation)
 
-	// Insert the record into the database
-	result := db.Create(&image)
-	if result.Error != nil {
-		authentication.WriteError(w, "Failed writing image to db", http.StatusBadRequest)
+	// Compress the image at each size and store them
+	image, err := SaveImageVariants(authentication.GetDb(), img, exif.CapturedAt)
+	if err != nil {
+		fmt.Printf("Failed storing image: %v\n", err)
+		authentication.WriteError(w, "Failed storing image.", http.StatusBadRequest)
 		return -1
 	}
 
@@ -265,35 +151,36 @@ func ImageUploadHandler(w http.ResponseWriter, r *http.Request) int {
 	return int(image.ID)
 }
 
-// send a generic email message
-func sendGenericEmail(email string, content string) {
-	go func() {
-		args := []string{"/email_service/generic_driver.py", "--recipient", email, "--content", content, "--subject", "Verify your account"}
-		cmd := exec.Command("/email_service/venv/bin/python", args...)
-		stdout, err := cmd.CombinedOutput()
-		if err != nil {
-			fmt.Println(string(stdout), err.Error())
-			return
-		}
-		fmt.Println(string(stdout))
-	}()
+// discardUpload deletes an image stored by ImageUploadHandler when what it was
+// uploaded for failed to save. 0 means no image was uploaded.
+func discardUpload(db *gorm.DB, imageId int) {
+	if imageId <= 0 {
+		return
+	}
+	if err := DeleteImage(db, uint(imageId)); err != nil {
+		fmt.Printf("Failed cleaning up image %d: %v\n", imageId, err)
+	}
+}
+
+// the frontend URL, used for links in emails
+func siteUrl() string {
+	if os.Getenv("DEBUG") == "true" {
+		return "https://localhost:4200"
+	}
+	return "https://www.plantmindr.com"
 }
 
 // handle user requesting password reset
 func ResetPasswordCallback(email string, resetCode string) error {
 	fmt.Printf("resetPasswordCallback for %v", email)
 	// the backend will redirect
-	url := fmt.Sprintf("https://www.plantmindr.com/authentication?mode=performPasswordReset&resetCode=%s&resetEmail=%s", resetCode, email)
-	if os.Getenv("DEBUG") == "true" {
-		url = fmt.Sprintf("https://localhost:4200/authentication?mode=performPasswordReset&resetCode=%s&resetEmail=%s", resetCode, email)
-	}
-	// Craft the email content
-	emailContent := fmt.Sprintf(`Hello,
-You requested a password reset. Click the link below to reset your password:
-%s`, url)
+	url := fmt.Sprintf("%s/authentication?mode=performPasswordReset&resetCode=%s&resetEmail=%s", siteUrl(), resetCode, email)
 
-	sendGenericEmail(email, emailContent)
-	return nil
+	msg, err := renderPasswordResetEmail(email, url)
+	if err != nil {
+		return err
+	}
+	return queueEmail(authentication.GetDb(), msg)
 }
 
 func RegistrationCallback(email string, verificationCode string) error {
@@ -303,22 +190,12 @@ func RegistrationCallback(email string, verificationCode string) error {
 	if os.Getenv("DEBUG") == "true" {
 		url = fmt.Sprintf("http://localhost:5000/api/verify?code=%s&email=%s", verificationCode, email)
 	}
-	// Craft the email content
-	emailContent := fmt.Sprintf(`Hello,
 
-Thank you for registering with us. We're excited to have you on board!
-
-To verify your account, please click the link below:
-
-%s
-
-If you did not request this, please ignore this email.
-
-Your friends at
-plantmindr.com`, url)
-
-	sendGenericEmail(email, emailContent)
-	return nil
+	msg, err := renderVerificationEmail(email, url)
+	if err != nil {
+		return err
+	}
+	return queueEmail(authentication.GetDb(), msg)
 }
 
 // write an HTTP JSON response message
@@ -2,18 +2,24 @@ package app
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/waterproofpatch/go_authentication/authentication"
 	auth_types "github.com/waterproofpatch/go_authentication/types"
 
 	"github.com/gorilla/mux"
+	"gorm.io/gorm"
 )
 
-func images(w http.ResponseWriter, r *http.Request) {
+// serve an image to whoever may see it: anyone for public plants, otherwise
+// the owner, their household and admins
+func images(w http.ResponseWriter, r *http.Request, claims *auth_types.JWTData) {
 	vars := mux.Vars(r)
 	imageId, hasImageId := vars["id"]
 	db := authentication.GetDb()
@@ -30,14 +36,72 @@ func images(w http.ResponseWriter, r *http.Request) {
 			}
 			fmt.Printf("Handling request for imageId=%d\n", imageIdNo)
 
-			var img ImageModel
-			img.ID = uint(imageIdNo)
-			if err := db.First(&img, img.ID).Error; err != nil {
+			size := r.URL.Query().Get("size")
+			if size == "" {
+				size = IMAGE_SIZE_FULL
+			}
+			if !isValidImageSize(size) {
+				WriteResponse(w, "Invalid image size", http.StatusBadRequest, Generic)
+				return
+			}
+			img, exact, err := FindImageVariant(db, uint(imageIdNo), size)
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				WriteResponse(w, "Image not found", http.StatusNotFound, Generic)
+				return
+			}
+			if err != nil {
+				fmt.Printf("Failed loading image %d: %v\n", imageIdNo, err)
+				WriteResponse(w, "Failed loading image", http.StatusBadRequest, Generic)
+				return
+			}
+			allowed, public, err := canViewImage(db, img, claims)
+			if err != nil {
+				fmt.Printf("Failed checking access to image %d: %v\n", imageIdNo, err)
+				WriteResponse(w, "Failed loading image", http.StatusInternalServerError, Generic)
+				return
+			}
+			// indistinguishable from a missing image, so IDs can't be probed
+			if !allowed {
+				WriteResponse(w, "Image not found", http.StatusNotFound, Generic)
+				return
+			}
+
+			// image content never changes for a given ID and size, so it can
+			// be cached for good. A stand-in for a variant that hasn't been
+			// generated yet must not be. Only images of public plants may be
+			// kept by shared caches.
+			visibility := "private"
+			if public {
+				visibility = "public"
+			}
+			cacheControl := visibility + ", max-age=31536000, immutable"
+			if !exact {
+				cacheControl = visibility + ", max-age=3600"
+			}
+			w.Header().Set("Cache-Control", cacheControl)
+
+			if img.ContentHash != "" {
+				etag := `"` + img.ContentHash + `"`
+				w.Header().Set("ETag", etag)
+				if etagMatches(r.Header.Get("If-None-Match"), etag) {
+					w.WriteHeader(http.StatusNotModified)
+					return
+				}
+			}
+
+			data, err := ReadImage(img)
+			if err != nil {
+				fmt.Printf("Failed reading image %d: %v\n", img.ID, err)
 				WriteResponse(w, "Failed loading image", http.StatusBadRequest, Generic)
 				return
 			}
-			w.Header().Set("Content-WateringFrequency", "image/jpeg")
-			w.Write(img.Data)
+			if err := ensureImageMetadata(db, img, data); err != nil {
+				fmt.Printf("Failed recording metadata for image %d: %v\n", img.ID, err)
+			}
+			w.Header().Set("ETag", `"`+img.ContentHash+`"`)
+			w.Header().Set("Content-Type", img.ContentType)
+			w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+			w.Write(data)
 			return
 		} else {
 			WriteResponse(w, "Must supply image ID!", http.StatusBadRequest, Generic)
@@ -45,6 +109,41 @@ func images(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// etagMatches reports whether an If-None-Match header matches etag, using
+// the weak comparison RFC 9110 requires for If-None-Match.
+func etagMatches(ifNoneMatch string, etag string) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// plantETag is the strong ETag of a plant's current version.
+func plantETag(plant *PlantModel) string {
+	return fmt.Sprintf("\"%d\"", plant.Version)
+}
+
+// parsePlantIfMatch returns the plant version an If-Match header requires, or
+// 0 when there is no header or it is "*".
+func parsePlantIfMatch(ifMatch string) (int, error) {
+	ifMatch = strings.TrimSpace(ifMatch)
+	if ifMatch == "" || ifMatch == "*" {
+		return 0, nil
+	}
+	// weak tags never match for If-Match, and one version is all that's useful
+	version, err := strconv.Atoi(strings.Trim(ifMatch, "\""))
+	if err != nil || version <= 0 || !strings.HasPrefix(ifMatch, "\"") {
+		return 0, errors.New("Invalid If-Match header.")
+	}
+	return version, nil
+}
+
 // get the version information from the environment for displaying to the frontend
 func version(w http.ResponseWriter, r *http.Request) {
 	// see docker-compose.dev
@@ -63,19 +162,198 @@ func version(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+var plantQueryParams = []string{"limit", "cursor", "name", "tag", "owner", "needsCare", "visibility", "sort", "fields", "include"}
+
+// whether a plant list request uses paging, filtering or sorting
+func isPlantPageRequest(r *http.Request) bool {
+	query := r.URL.Query()
+	for _, param := range plantQueryParams {
+		if query.Has(param) {
+			return true
+		}
+	}
+	return false
+}
+
+// split a comma separated query parameter, returning def if it is absent
+func parseListParam(r *http.Request, name string, def []string) []string {
+	if !r.URL.Query().Has(name) {
+		return def
+	}
+	var values []string
+	for _, value := range strings.Split(r.URL.Query().Get(name), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// associations named in fields need preloading just as if they were included
+func withFieldIncludes(include []string, fields []string) []string {
+	for _, field := range fields {
+		if _, ok := PLANT_INCLUDES[field]; ok && !containsString(include, field) {
+			include = append(include, field)
+		}
+	}
+	return include
+}
+
+// sparsePlant reduces a plant to the requested JSON fields, plus its ID and
+// anything that was explicitly included. No fields means all fields.
+func sparsePlant(plant *PlantModel, fields []string, include []string) (interface{}, error) {
+	if len(fields) == 0 {
+		return plant, nil
+	}
+	data, err := json.Marshal(plant)
+	if err != nil {
+		return nil, err
+	}
+	var all map[string]json.RawMessage
+	if err := json.Unmarshal(data, &all); err != nil {
+		return nil, err
+	}
+	sparse := map[string]json.RawMessage{"ID": all["ID"]}
+	for _, field := range append(fields, include...) {
+		value, ok := all[field]
+		if !ok {
+			return nil, fmt.Errorf("Unknown field '%s'.", field)
+		}
+		sparse[field] = value
+	}
+	return sparse, nil
+}
+
+// writePlant encodes a plant honoring the request's fields parameter.
+func writePlant(w http.ResponseWriter, plant *PlantModel, fields []string, include []string) {
+	sparse, err := sparsePlant(plant, fields, include)
+	if err != nil {
+		WriteResponse(w, err.Error(), http.StatusBadRequest, Generic)
+		return
+	}
+	json.NewEncoder(w).Encode(sparse)
+}
+
+// writePlantPage encodes a page of plants honoring the request's fields parameter.
+func writePlantPage(w http.ResponseWriter, page *PlantPage, fields []string, include []string) {
+	plants := []interface{}{}
+	for i := range page.Plants {
+		sparse, err := sparsePlant(&page.Plants[i], fields, include)
+		if err != nil {
+			WriteResponse(w, err.Error(), http.StatusBadRequest, Generic)
+			return
+		}
+		plants = append(plants, sparse)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"plants":     plants,
+		"nextCursor": page.NextCursor,
+	})
+}
+
+func parsePlantQuery(r *http.Request) (*PlantQuery, error) {
+	query := r.URL.Query()
+	plantQuery := &PlantQuery{
+		Name:       query.Get("name"),
+		Tags:       query["tag"],
+		Owners:     query["owner"],
+		NeedsCare:  query.Get("needsCare") == "true",
+		Visibility: query.Get("visibility"),
+		Sort:       query.Get("sort"),
+		Cursor:     query.Get("cursor"),
+		// lists are lean unless the caller asks for more
+		Include: withFieldIncludes(parseListParam(r, "include", nil), parseListParam(r, "fields", nil)),
+	}
+	if query.Get("limit") != "" {
+		limit, err := strconv.Atoi(query.Get("limit"))
+		if err != nil {
+			return nil, errors.New("Invalid limit.")
+		}
+		plantQuery.Limit = limit
+	}
+	return plantQuery, nil
+}
+
+// lookupCaller returns the caller's user ID, or 0 for anonymous callers. If
+// the lookup fails it answers the request itself and returns false.
+func lookupCaller(w http.ResponseWriter, db *gorm.DB, claims *auth_types.JWTData) (uint, bool) {
+	userId, err := callerId(db, claims)
+	if errors.Is(err, ErrUnknownUser) {
+		WriteResponse(w, "Your account no longer exists.", http.StatusUnauthorized, Generic)
+		return 0, false
+	}
+	if err != nil {
+		fmt.Printf("Failed looking up user %s: %v\n", claims.Email, err)
+		WriteResponse(w, "Failed to look up your account", http.StatusInternalServerError, Generic)
+		return 0, false
+	}
+	return userId, true
+}
+
+// writePlantConflict answers a stale edit with the plant as it now is, so the
+// client can merge and retry against the current version.
+func writePlantConflict(w http.ResponseWriter, db *gorm.DB, id uint) {
+	var current PlantModel
+	if err := db.Preload("Logs").Preload("Comments").First(&current, id).Error; err != nil {
+		WriteResponse(w, err.Error(), http.StatusNotFound, Generic)
+		return
+	}
+	if err := resolvePlantName(db, &current); err != nil {
+		fmt.Printf("Failed resolving names for plant id=%d: %v\n", id, err)
+	}
+	fmt.Printf("Rejected stale edit of plant id=%d, now at version %d\n", id, current.Version)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", plantETag(&current))
+	w.WriteHeader(http.StatusConflict)
+	json.NewEncoder(w).Encode(current)
+}
+
 func plants(w http.ResponseWriter, r *http.Request, claims *auth_types.JWTData) {
 	db := authentication.GetDb()
 	var plants []PlantModel
 	var plant PlantModel
 	vars := mux.Vars(r)
 	id, hasPlantId := vars["id"]
+	userId, ok := lookupCaller(w, db, claims)
+	if !ok {
+		return
+	}
 
 	switch r.Method {
 	case "GET":
 		if hasPlantId {
-			result := db.Where("id = ?", id).Preload("Logs").Preload("Comments").Find(&plant)
-			fmt.Printf("%d record(s) found\n", result.RowsAffected)
-			json.NewEncoder(w).Encode(plant)
+			// detail views get everything unless they ask otherwise
+			fields := parseListParam(r, "fields", nil)
+			include := withFieldIncludes(parseListParam(r, "include", []string{"logs", "comments"}), fields)
+			tx, err := preloadPlantIncludes(db, include)
+			if err != nil {
+				WriteResponse(w, err.Error(), http.StatusBadRequest, Generic)
+				return
+			}
+			if err := tx.Where("id = ?", id).First(&plant).Error; err != nil {
+				if errors.Is(err, gorm.ErrRecordNotFound) {
+					WriteResponse(w, "Plant not found", http.StatusNotFound, Generic)
+					return
+				}
+				fmt.Printf("Failed getting plant id=%s: %v\n", id, err)
+				WriteResponse(w, "Failed to get plant", http.StatusInternalServerError, Generic)
+				return
+			}
+			role, err := plantRole(db, &plant, userId)
+			if err != nil {
+				WriteResponse(w, "Failed to get plant", http.StatusInternalServerError, Generic)
+				return
+			}
+			if !canViewPlant(&plant, role) {
+				WriteResponse(w, "This plant is not public and also not yours!", http.StatusBadRequest, Generic)
+				return
+			}
+			if err := resolvePlantName(db, &plant); err != nil {
+				WriteResponse(w, "Failed to get plant", http.StatusInternalServerError, Generic)
+				return
+			}
+			w.Header().Set("ETag", plantETag(&plant))
+			writePlant(w, &plant, fields, include)
 			return
 		}
 	case "DELETE":
@@ -87,17 +365,33 @@ func plants(w http.ResponseWriter, r *http.Request, claims *auth_types.JWTData)
 			WriteResponse(w, "Must provide id!", http.StatusBadRequest, Generic)
 			break
 		}
-		db.Find(&plant, id)
-		if claims != nil && plant.Email != claims.Email {
-			fmt.Printf("User %s tried deleting plant belonging to %s\n", claims.Email, plant.Email)
+		if err := db.First(&plant, id).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				WriteResponse(w, "Plant not found", http.StatusNotFound, Generic)
+				return
+			}
+			WriteResponse(w, "Failed to get plant", http.StatusInternalServerError, Generic)
+			return
+		}
+		// the plant's creator, or an owner of its household
+		role, err := plantRole(db, &plant, userId)
+		if err != nil {
+			WriteResponse(w, "Failed to get plant", http.StatusInternalServerError, Generic)
+			return
+		}
+		if !hasRole(role, ROLE_OWNER) {
+			fmt.Printf("User %d tried deleting plant belonging to user %d\n", userId, plant.UserID)
 			WriteResponse(w, "This isn't your plant!", http.StatusBadRequest, Generic)
 			return
 		}
-		fmt.Printf("Deleting plant imageId=%d\n", plant.ImageId)
-		db.Delete(&ImageModel{}, plant.ImageId)
-		fmt.Printf("Deleting plant id=%d\n", plant.ID)
-		db.Delete(&PlantModel{}, id)
-		break
+		fmt.Printf("Deleting plant id=%d imageId=%d\n", plant.ID, plant.ImageId)
+		if err := DeletePlant(db, &plant); err != nil {
+			fmt.Printf("Failed deleting plant %d: %v\n", plant.ID, err)
+			WriteResponse(w, "Failed to delete plant", http.StatusInternalServerError, Generic)
+			return
+		}
+		WriteResponse(w, "Deleted plant", http.StatusOK, Generic)
+		return
 	case "POST":
 		if claims == nil {
 			WriteResponse(w, "Must be logged in to add plants.", http.StatusUnauthorized, Generic)
@@ -113,16 +407,36 @@ func plants(w http.ResponseWriter, r *http.Request, claims *auth_types.JWTData)
 		}
 		json.Unmarshal([]byte(r.FormValue("plant")), &plant)
 		plant.ImageId = imageId
-		plant.Email = claims.Email
-		plant.Username = claims.Username
+		plant.UserID = userId
+		if plant.HouseholdID != 0 {
+			if err := requireHouseholdRole(db, plant.HouseholdID, userId, ROLE_EDITOR); err != nil {
+				discardUpload(db, imageId)
+				WriteResponse(w, err.Error(), http.StatusForbidden, Generic)
+				return
+			}
+		}
 
 		fmt.Printf("Adding plant as: %v", plant)
 		err := AddPlant(db, &plant)
 		if err != nil {
-			WriteResponse(w, err.Error(), http.StatusBadRequest, Generic)
+			discardUpload(db, imageId)
+			var quotaErr *QuotaExceededError
+			if errors.As(err, &quotaErr) {
+				WriteResponse(w, err.Error(), http.StatusForbidden, Generic)
+				return
+			}
+			var invalidErr *InvalidPlantError
+			if errors.As(err, &invalidErr) {
+				WriteResponse(w, err.Error(), http.StatusBadRequest, Generic)
+				return
+			}
+			fmt.Printf("Failed adding plant: %v\n", err)
+			WriteResponse(w, "Failed to add plant", http.StatusInternalServerError, Generic)
 			return
 		}
-		break
+		resolvePlantName(db, &plant)
+		json.NewEncoder(w).Encode(plant)
+		return
 	case "PUT":
 		if claims == nil {
 			WriteResponse(w, "Must be logged in to edit plants.", http.StatusUnauthorized, Generic)
@@ -135,14 +449,39 @@ func plants(w http.ResponseWriter, r *http.Request, claims *auth_types.JWTData)
 			return
 		}
 
+		// the edit is based on the version the client last saw, if it says
+		expectedVersion, err := parsePlantIfMatch(r.Header.Get("If-Match"))
+		if err != nil {
+			WriteResponse(w, err.Error(), http.StatusBadRequest, Generic)
+			return
+		}
+		plant.Version = expectedVersion
+
 		// get the existing plant so we can obtain its old imageId
 		var existingPlant PlantModel
-		db.First(&existingPlant, plant.ID)
-		if existingPlant.Email != claims.Email {
-			fmt.Printf("User %s tried editing plant belonging to %s\n", claims.Email, existingPlant.Email)
+		if err := db.First(&existingPlant, plant.ID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				WriteResponse(w, "Plant not found", http.StatusNotFound, Generic)
+				return
+			}
+			WriteResponse(w, "Failed to get plant", http.StatusInternalServerError, Generic)
+			return
+		}
+		role, err := plantRole(db, &existingPlant, userId)
+		if err != nil {
+			WriteResponse(w, "Failed to get plant", http.StatusInternalServerError, Generic)
+			return
+		}
+		if !hasRole(role, ROLE_EDITOR) {
+			fmt.Printf("User %d tried editing plant belonging to user %d\n", userId, existingPlant.UserID)
 			WriteResponse(w, "This isn't your plant!", http.StatusBadRequest, Generic)
 			return
 		}
+		// refuse stale edits before storing any upload
+		if expectedVersion != 0 && expectedVersion != existingPlant.Version {
+			writePlantConflict(w, db, plant.ID)
+			return
+		}
 
 		// conditionally upload a new image. An imageId of 0 means no image provided
 		imageId := ImageUploadHandler(w, r)
@@ -162,18 +501,54 @@ func plants(w http.ResponseWriter, r *http.Request, claims *auth_types.JWTData)
 			isNewImage = true
 
 		}
-		plant.Username = existingPlant.Username
-		plant.Email = existingPlant.Email
+		// moving between households has its own endpoint
+		plant.UserID = existingPlant.UserID
+		plant.HouseholdID = existingPlant.HouseholdID
 		fmt.Printf("Updating plant id=%d to: %s", plant.ID, plant)
 
-		err = UpdatePlant(db, &plant, isNewImage)
+		err = UpdatePlant(db, &plant, isNewImage, userId)
+		if err != nil {
+			if isNewImage {
+				discardUpload(db, imageId)
+			}
+			if errors.Is(err, ErrPlantModified) {
+				writePlantConflict(w, db, plant.ID)
+				return
+			}
+			var invalidErr *InvalidPlantError
+			if errors.As(err, &invalidErr) {
+				WriteResponse(w, err.Error(), http.StatusBadRequest, Generic)
+				return
+			}
+			fmt.Printf("Failed updating plant %d: %v\n", plant.ID, err)
+			WriteResponse(w, "Failed to update plant", http.StatusInternalServerError, Generic)
+			return
+		}
+		db.Preload("Logs").Preload("Comments").First(&plant, plant.ID)
+		resolvePlantName(db, &plant)
+		w.Header().Set("ETag", plantETag(&plant))
+		json.NewEncoder(w).Encode(plant)
+		return
+	}
+
+	if isPlantPageRequest(r) {
+		query, err := parsePlantQuery(r)
 		if err != nil {
 			WriteResponse(w, err.Error(), http.StatusBadRequest, Generic)
 			return
 		}
+		var page PlantPage
+		if err := GetPlantsPage(db, userId, query, &page); err != nil {
+			WriteResponse(w, err.Error(), http.StatusBadRequest, Generic)
+			return
+		}
+		writePlantPage(w, &page, parseListParam(r, "fields", nil), query.Include)
+		return
 	}
+
+	// older clients without paging parameters get the whole list
 	if claims != nil {
-		err := GetPlants(db, claims.Email, &plants)
+		err := GetPlants(db, userId, &plants)
 		if err != nil {
 			WriteResponse(w, "Failed to get plants", http.StatusBadRequest, Generic)
 			return
@@ -184,13 +559,13 @@ func plants(w http.ResponseWriter, r *http.Request, claims *auth_types.JWTData)
 				var count int64
 				// if the plant is ours and we have not yet seen this comment...
 				// TODO is this even necessary
-				if !plants[i].Comments[j].Viewed && claims.Email == plants[i].Email {
+				if !plants[i].Comments[j].Viewed && userId == plants[i].UserID {
 					count += 1
 				}
 			}
 		}
 	} else {
-		err := GetPlants(db, "", &plants)
+		err := GetPlants(db, 0, &plants)
 		if err != nil {
 			WriteResponse(w, "Failed to get plants", http.StatusBadRequest, Generic)
 			return
@@ -206,6 +581,10 @@ func comments(w http.ResponseWriter, r *http.Request, claims *auth_types.JWTData
 	vars := mux.Vars(r)
 	db := authentication.GetDb()
 	plantId := "0"
+	userId, ok := lookupCaller(w, db, claims)
+	if !ok {
+		return
+	}
 
 	switch r.Method {
 	case "GET":
@@ -228,7 +607,12 @@ func comments(w http.ResponseWriter, r *http.Request, claims *auth_types.JWTData
 		db.Where("id = ?", comment.PlantID).First(&plant)
 
 		// users should be able to delete comments by others for their plant
-		if plant.Email != claims.Email && comment.Email != claims.Email {
+		role, err := plantRole(db, &plant, userId)
+		if err != nil {
+			WriteResponse(w, "Failed to get plant", http.StatusInternalServerError, Generic)
+			return
+		}
+		if !hasRole(role, ROLE_OWNER) && comment.UserID != userId {
 			WriteResponse(w, "This isn't your comment, nor a comment on your plant!", http.StatusBadRequest, Generic)
 			return
 		}
@@ -257,25 +641,49 @@ func comments(w http.ResponseWriter, r *http.Request, claims *auth_types.JWTData
 
 		fmt.Printf("comment received: %v for plantId=%d", comment, comment.PlantID)
 
-		// make sure the plant is public
+		// make sure the plant is public, or shared with the commenter
 		db.Where("id = ?", comment.PlantID).First(&plant)
-		if !plant.IsPublic && plant.Email != claims.Email {
+		role, err := plantRole(db, &plant, userId)
+		if err != nil {
+			WriteResponse(w, "Failed to get plant", http.StatusInternalServerError, Generic)
+			return
+		}
+		if !canViewPlant(&plant, role) {
 			WriteResponse(w, "This plant is not public and also not yours, you cannot comment on it!", http.StatusBadRequest, Generic)
 			return
 		}
 
-		AddComment(db, comment.Content, claims.Email, claims.Username, comment.PlantID)
+		err = AddComment(db, comment.Content, userId, comment.PlantID)
+		var quotaErr *QuotaExceededError
+		if errors.As(err, &quotaErr) {
+			WriteResponse(w, err.Error(), http.StatusForbidden, Generic)
+			return
+		}
+		if err != nil {
+			fmt.Printf("Error adding comment: %v\n", err)
+			WriteResponse(w, "Failed to add comment", http.StatusInternalServerError, Generic)
+			return
+		}
 		plantId = strconv.FormatUint(uint64(plant.ID), 10)
 	}
 	fmt.Printf("getting comments for plantId=%v", plantId)
 	var comments []CommentModel
 	var plant PlantModel
-	db.Where("plant_id = ?", plantId).Find(&comments)
 	db.Where("id = ?", plantId).Find(&plant)
+	role, err := plantRole(db, &plant, userId)
+	if err != nil {
+		WriteResponse(w, "Failed to get plant", http.StatusInternalServerError, Generic)
+		return
+	}
+	if !canViewPlant(&plant, role) {
+		WriteResponse(w, "This plant is not public and also not yours!", http.StatusBadRequest, Generic)
+		return
+	}
+	db.Where("plant_id = ?", plantId).Find(&comments)
 
 	// update all comments here as viewed if the plant the comments are for is the owners plant
 	if claims != nil {
-		if plant.Email == claims.Email {
+		if hasRole(role, ROLE_EDITOR) {
 			fmt.Println("Owner of the plant is viewing comments, marking as viewed...")
 			for i := range comments {
 				comments[i].Viewed = true
@@ -283,14 +691,1004 @@ func comments(w http.ResponseWriter, r *http.Request, claims *auth_types.JWTData
 			}
 		}
 	}
+	if err := resolveCommentNames(db, comments); err != nil {
+		WriteResponse(w, "Failed to get comments", http.StatusInternalServerError, Generic)
+		return
+	}
 	json.NewEncoder(w).Encode(comments)
 }
 
+// log a care action (watered, fertilized, skipped_fertilize or moist_check)
+// on the plant in the URL, or on each plant in plantIds, at occurredAt or now
+func plantActions(w http.ResponseWriter, r *http.Request, claims *auth_types.JWTData) {
+	w.Header().Set("Content-Type", "application/json")
+	db := authentication.GetDb()
+	vars := mux.Vars(r)
+	if claims == nil {
+		WriteResponse(w, "Must be logged in to care for plants.", http.StatusUnauthorized, Generic)
+		return
+	}
+	userId, ok := lookupCaller(w, db, claims)
+	if !ok {
+		return
+	}
+
+	var request CareActionRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		WriteResponse(w, "Invalid care action", http.StatusBadRequest, Generic)
+		return
+	}
+	_, single := vars["id"]
+	if single {
+		plantId, err := routeId(r, "id")
+		if err != nil {
+			WriteResponse(w, "Invalid plant ID", http.StatusBadRequest, Generic)
+			return
+		}
+		request.PlantIDs = []uint{plantId}
+	}
+	plantIds := uniqueIds(request.PlantIDs)
+	if len(plantIds) == 0 {
+		WriteResponse(w, "No plants to care for", http.StatusBadRequest, Generic)
+		return
+	}
+	if len(plantIds) > MAX_CARE_ACTION_PLANTS {
+		WriteResponse(w, fmt.Sprintf("At most %d plants can be cared for at once", MAX_CARE_ACTION_PLANTS), http.StatusBadRequest, Generic)
+		return
+	}
+
+	var plants []PlantModel
+	if err := db.Where("id IN ?", plantIds).Order("id asc").Find(&plants).Error; err != nil {
+		WriteResponse(w, "Failed to get plants", http.StatusInternalServerError, Generic)
+		return
+	}
+	if len(plants) != len(plantIds) {
+		WriteResponse(w, "No such plant", http.StatusNotFound, Generic)
+		return
+	}
+	for i := range plants {
+		role, err := plantRole(db, &plants[i], userId)
+		if err != nil {
+			WriteResponse(w, "Failed to get plant", http.StatusInternalServerError, Generic)
+			return
+		}
+		if !hasRole(role, ROLE_EDITOR) {
+			fmt.Printf("User %d tried caring for plant belonging to user %d\n", userId, plants[i].UserID)
+			WriteResponse(w, "This isn't your plant!", http.StatusBadRequest, Generic)
+			return
+		}
+	}
+
+	event := CareEventModel{
+		Kind:       request.Action,
+		OccurredAt: request.OccurredAt,
+		Amount:     request.Amount,
+		Note:       request.Note,
+		UserID:     userId,
+	}
+	if err := RecordCareActions(db, plants, &event); err != nil {
+		var invalidErr *InvalidCareEventError
+		switch {
+		case errors.As(err, &invalidErr):
+			WriteResponse(w, err.Error(), http.StatusBadRequest, Generic)
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			WriteResponse(w, "No such plant", http.StatusNotFound, Generic)
+		default:
+			fmt.Printf("Failed recording %s for user %d: %v\n", event.Kind, userId, err)
+			WriteResponse(w, "Failed to record care", http.StatusInternalServerError, Generic)
+		}
+		return
+	}
+	if err := resolvePlantNames(db, plants); err != nil {
+		WriteResponse(w, "Failed to get plants", http.StatusInternalServerError, Generic)
+		return
+	}
+	if single {
+		w.Header().Set("ETag", plantETag(&plants[0]))
+		json.NewEncoder(w).Encode(plants[0])
+		return
+	}
+	json.NewEncoder(w).Encode(plants)
+}
+
+// list a plant's care events a page at a time, or record a new one. Care
+// actions recorded here move the plant's care dates like those from
+// plantActions.
+func careEvents(w http.ResponseWriter, r *http.Request, claims *auth_types.JWTData) {
+	w.Header().Set("Content-Type", "application/json")
+	db := authentication.GetDb()
+	vars := mux.Vars(r)
+	plantId, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		WriteResponse(w, "Invalid plant ID", http.StatusBadRequest, Generic)
+		return
+	}
+
+	var plant PlantModel
+	if err := db.First(&plant, plantId).Error; err != nil {
+		WriteResponse(w, "No such plant", http.StatusNotFound, Generic)
+		return
+	}
+	userId, ok := lookupCaller(w, db, claims)
+	if !ok {
+		return
+	}
+	role, err := plantRole(db, &plant, userId)
+	if err != nil {
+		WriteResponse(w, "Failed to get plant", http.StatusInternalServerError, Generic)
+		return
+	}
+	canEdit := hasRole(role, ROLE_EDITOR)
+	if !canViewPlant(&plant, role) {
+		WriteResponse(w, "This plant is not public and also not yours!", http.StatusBadRequest, Generic)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		limit := 0
+		if r.URL.Query().Get("limit") != "" {
+			limit, err = strconv.Atoi(r.URL.Query().Get("limit"))
+			if err != nil {
+				WriteResponse(w, "Invalid limit", http.StatusBadRequest, Generic)
+				return
+			}
+		}
+		var page CareEventPage
+		if err := GetCareEvents(db, plantId, r.URL.Query().Get("cursor"), limit, &page); err != nil {
+			WriteResponse(w, err.Error(), http.StatusBadRequest, Generic)
+			return
+		}
+		json.NewEncoder(w).Encode(page)
+	case "POST":
+		if !canEdit {
+			WriteResponse(w, "This isn't your plant!", http.StatusBadRequest, Generic)
+			return
+		}
+		var event CareEventModel
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			WriteResponse(w, "Invalid care event", http.StatusBadRequest, Generic)
+			return
+		}
+		event.ID = 0
+		event.PlantID = plantId
+		event.GrantID = 0
+		event.UserID = userId
+		event.Actor = ""
+		if err := LogCareEvent(db, &plant, &event); err != nil {
+			var invalidErr *InvalidCareEventError
+			switch {
+			case errors.As(err, &invalidErr):
+				WriteResponse(w, err.Error(), http.StatusBadRequest, Generic)
+			case errors.Is(err, gorm.ErrRecordNotFound):
+				WriteResponse(w, "No such plant", http.StatusNotFound, Generic)
+			default:
+				fmt.Printf("Failed recording %s on plant %d for user %d: %v\n", event.Kind, plantId, userId, err)
+				WriteResponse(w, "Failed to record care", http.StatusInternalServerError, Generic)
+			}
+			return
+		}
+		events := []CareEventModel{event}
+		if err := resolveCareEventNames(db, events); err != nil {
+			WriteResponse(w, "Failed to get care events", http.StatusInternalServerError, Generic)
+			return
+		}
+		json.NewEncoder(w).Encode(events[0])
+	}
+}
+
+// photo history of a plant; anyone who can see the plant can list its photos,
+// only those who can edit it can change them
+func plantPhotos(w http.ResponseWriter, r *http.Request, claims *auth_types.JWTData) {
+	w.Header().Set("Content-Type", "application/json")
+	db := authentication.GetDb()
+	vars := mux.Vars(r)
+	plantId, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		WriteResponse(w, "Invalid plant ID", http.StatusBadRequest, Generic)
+		return
+	}
+	photoId := 0
+	if _, ok := vars["photoId"]; ok {
+		photoId, err = strconv.Atoi(vars["photoId"])
+		if err != nil {
+			WriteResponse(w, "Invalid photo ID", http.StatusBadRequest, Generic)
+			return
+		}
+	}
+
+	var plant PlantModel
+	if err := db.First(&plant, plantId).Error; err != nil {
+		WriteResponse(w, "No such plant", http.StatusNotFound, Generic)
+		return
+	}
+	userId, ok := lookupCaller(w, db, claims)
+	if !ok {
+		return
+	}
+	role, err := plantRole(db, &plant, userId)
+	if err != nil {
+		WriteResponse(w, "Failed to get plant", http.StatusInternalServerError, Generic)
+		return
+	}
+	canEdit := hasRole(role, ROLE_EDITOR)
+	if !canViewPlant(&plant, role) {
+		WriteResponse(w, "This plant is not public and also not yours!", http.StatusBadRequest, Generic)
+		return
+	}
+	if r.Method != "GET" && !canEdit {
+		WriteResponse(w, "This isn't your plant!", http.StatusBadRequest, Generic)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		photos := []PlantPhotoModel{}
+		if err := GetPlantPhotos(db, &plant, &photos); err != nil {
+			WriteResponse(w, "Failed to get photos", http.StatusInternalServerError, Generic)
+			return
+		}
+		json.NewEncoder(w).Encode(photos)
+	case "POST":
+		// choose the cover
+		if photoId != 0 {
+			if err := SetPlantCoverPhoto(db, &plant, photoId); err != nil {
+				WriteResponse(w, "No such photo", http.StatusNotFound, Generic)
+				return
+			}
+			WriteResponse(w, "Cover photo updated", http.StatusOK, Generic)
+			return
+		}
+		// add a photo, sent as a multipart form like plant images
+		if err := r.ParseMultipartForm(10 << 20); err != nil {
+			WriteResponse(w, "Invalid photo upload", http.StatusBadRequest, Generic)
+			return
+		}
+		photo := PlantPhotoModel{Caption: r.FormValue("caption")}
+		if r.FormValue("takenAt") != "" {
+			photo.TakenAt, err = parseCareDate(r.FormValue("takenAt"))
+			if err != nil {
+				WriteResponse(w, "Invalid takenAt", http.StatusBadRequest, Generic)
+				return
+			}
+		}
+		if r.FormValue("careEventId") != "" {
+			careEventId, err := strconv.ParseUint(r.FormValue("careEventId"), 10, 64)
+			if err != nil {
+				WriteResponse(w, "Invalid care event ID", http.StatusBadRequest, Generic)
+				return
+			}
+			id := uint(careEventId)
+			photo.CareEventID = &id
+		}
+		imageId := ImageUploadHandler(w, r)
+		if imageId < 0 {
+			return
+		}
+		if imageId == 0 {
+			WriteResponse(w, "Must supply an image!", http.StatusBadRequest, Generic)
+			return
+		}
+		photo.ImageID = uint(imageId)
+		if err := AddPlantPhoto(db, &plant, &photo, r.FormValue("cover") == "true"); err != nil {
+			discardUpload(db, imageId)
+			WriteResponse(w, err.Error(), http.StatusBadRequest, Generic)
+			return
+		}
+		json.NewEncoder(w).Encode(photo)
+	case "PUT":
+		var update struct {
+			Caption     string `json:"caption"`
+			CareEventID *uint  `json:"careEventId"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+			WriteResponse(w, "Invalid photo", http.StatusBadRequest, Generic)
+			return
+		}
+		var photo PlantPhotoModel
+		err := UpdatePlantPhoto(db, &plant, photoId, update.Caption, update.CareEventID, &photo)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			WriteResponse(w, "No such photo", http.StatusNotFound, Generic)
+			return
+		}
+		if err != nil {
+			WriteResponse(w, err.Error(), http.StatusBadRequest, Generic)
+			return
+		}
+		json.NewEncoder(w).Encode(photo)
+	case "DELETE":
+		err := DeletePlantPhoto(db, &plant, photoId)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			WriteResponse(w, "No such photo", http.StatusNotFound, Generic)
+			return
+		}
+		if err != nil {
+			fmt.Printf("Failed deleting photo %d: %v\n", photoId, err)
+			WriteResponse(w, "Failed to delete photo", http.StatusInternalServerError, Generic)
+			return
+		}
+		WriteResponse(w, "Deleted photo", http.StatusOK, Generic)
+	}
+}
+
+// parse a schedule bound, either "2006-01-02" or a care date
+func parseScheduleDate(value string) (time.Time, error) {
+	date, err := time.Parse("2006-01-02", value)
+	if err == nil {
+		return date, nil
+	}
+	return parseCareDate(value)
+}
+
+// the computed care calendar for the caller's plants
+func schedule(w http.ResponseWriter, r *http.Request, claims *auth_types.JWTData) {
+	w.Header().Set("Content-Type", "application/json")
+	db := authentication.GetDb()
+	if claims == nil {
+		WriteResponse(w, "Must be logged in to view your schedule.", http.StatusUnauthorized, Generic)
+		return
+	}
+
+	query := r.URL.Query()
+	now := time.Now().UTC()
+	from := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	if query.Get("from") != "" {
+		var err error
+		from, err = parseScheduleDate(query.Get("from"))
+		if err != nil {
+			WriteResponse(w, "Invalid 'from' date", http.StatusBadRequest, Generic)
+			return
+		}
+	}
+	to := from.AddDate(0, 0, DEFAULT_SCHEDULE_DAYS)
+	if query.Get("to") != "" {
+		var err error
+		to, err = parseScheduleDate(query.Get("to"))
+		if err != nil {
+			WriteResponse(w, "Invalid 'to' date", http.StatusBadRequest, Generic)
+			return
+		}
+	}
+	graceDays := 0
+	if query.Get("graceDays") != "" {
+		var err error
+		graceDays, err = strconv.Atoi(query.Get("graceDays"))
+		if err != nil {
+			WriteResponse(w, "Invalid grace period", http.StatusBadRequest, Generic)
+			return
+		}
+	}
+
+	userId, ok := lookupCaller(w, db, claims)
+	if !ok {
+		return
+	}
+	var sched Schedule
+	if err := GetSchedule(db, userId, from, to, graceDays, &sched); err != nil {
+		WriteResponse(w, err.Error(), http.StatusBadRequest, Generic)
+		return
+	}
+	json.NewEncoder(w).Encode(sched)
+}
+
+// issue (POST) or revoke (DELETE) the caller's calendar feed token
+func calendarToken(w http.ResponseWriter, r *http.Request, claims *auth_types.JWTData) {
+	w.Header().Set("Content-Type", "application/json")
+	db := authentication.GetDb()
+	if claims == nil {
+		WriteResponse(w, "Must be logged in to manage your calendar feed.", http.StatusUnauthorized, Generic)
+		return
+	}
+
+	userId, ok := lookupCaller(w, db, claims)
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case "POST":
+		token, err := CreateCalendarToken(db, userId)
+		if err != nil {
+			WriteResponse(w, "Failed to create calendar token", http.StatusInternalServerError, Generic)
+			return
+		}
+		path := fmt.Sprintf("/api/calendar/%s.ics", token)
+		json.NewEncoder(w).Encode(map[string]string{
+			"token": token,
+			"path":  path,
+			"url":   fmt.Sprintf("webcal://%s%s", r.Host, path),
+		})
+	case "DELETE":
+		if err := RevokeCalendarTokens(db, userId); err != nil {
+			WriteResponse(w, "Failed to revoke calendar token", http.StatusInternalServerError, Generic)
+			return
+		}
+		WriteResponse(w, "Calendar feed revoked", http.StatusOK, Generic)
+	}
+}
+
+// the .ics feed for the owner of a calendar token, covering their households' plants too
+func calendarFeed(w http.ResponseWriter, r *http.Request) {
+	db := authentication.GetDb()
+	vars := mux.Vars(r)
+
+	userId, err := GetCalendarTokenOwner(db, vars["token"])
+	if err != nil {
+		WriteResponse(w, "Invalid calendar token", http.StatusNotFound, Generic)
+		return
+	}
+	// tokens die with their account
+	if _, err := userById(db, userId); err != nil {
+		WriteResponse(w, "Invalid calendar token", http.StatusNotFound, Generic)
+		return
+	}
+	var plants []PlantModel
+	if err := db.Where("user_id = ? OR household_id IN (?)", userId, userHouseholdIds(db, userId)).Find(&plants).Error; err != nil {
+		WriteResponse(w, "Failed to get plants", http.StatusInternalServerError, Generic)
+		return
+	}
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Header().Set("Cache-Control", "private, max-age=900")
+	w.Write([]byte(BuildCalendar(plants, time.Now())))
+}
+
+// get or update the caller's notification preferences
+func preferences(w http.ResponseWriter, r *http.Request, claims *auth_types.JWTData) {
+	w.Header().Set("Content-Type", "application/json")
+	db := authentication.GetDb()
+	if claims == nil {
+		WriteResponse(w, "Must be logged in to manage preferences.", http.StatusUnauthorized, Generic)
+		return
+	}
+
+	userId, ok := lookupCaller(w, db, claims)
+	if !ok {
+		return
+	}
+
+	var prefs NotificationPreferencesModel
+	switch r.Method {
+	case "GET":
+		if err := GetNotificationPreferences(db, userId, &prefs); err != nil {
+			WriteResponse(w, "Failed to get preferences", http.StatusInternalServerError, Generic)
+			return
+		}
+	case "PUT":
+		if err := json.NewDecoder(r.Body).Decode(&prefs); err != nil {
+			WriteResponse(w, "Invalid preferences", http.StatusBadRequest, Generic)
+			return
+		}
+		if err := UpdateNotificationPreferences(db, userId, &prefs); err != nil {
+			WriteResponse(w, err.Error(), http.StatusBadRequest, Generic)
+			return
+		}
+	}
+	json.NewEncoder(w).Encode(prefs)
+}
+
+// writeHouseholdError answers a failed household operation.
+func writeHouseholdError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrHouseholdForbidden):
+		WriteResponse(w, err.Error(), http.StatusForbidden, Generic)
+	case errors.Is(err, ErrInvalidInvite):
+		WriteResponse(w, err.Error(), http.StatusNotFound, Generic)
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		WriteResponse(w, "Not found", http.StatusNotFound, Generic)
+	default:
+		WriteResponse(w, err.Error(), http.StatusBadRequest, Generic)
+	}
+}
+
+// parse a numeric route variable
+func routeId(r *http.Request, name string) (uint, error) {
+	id, err := strconv.ParseUint(mux.Vars(r)[name], 10, 64)
+	return uint(id), err
+}
+
+// households the caller belongs to. GET lists them, POST creates one with the
+// caller as owner, DELETE /{id} removes one.
+func households(w http.ResponseWriter, r *http.Request, claims *auth_types.JWTData) {
+	w.Header().Set("Content-Type", "application/json")
+	db := authentication.GetDb()
+	if claims == nil {
+		WriteResponse(w, "Must be logged in to manage households.", http.StatusUnauthorized, Generic)
+		return
+	}
+	userId, ok := lookupCaller(w, db, claims)
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		var households []HouseholdModel
+		if err := GetHouseholds(db, userId, &households); err != nil {
+			WriteResponse(w, "Failed to get households", http.StatusInternalServerError, Generic)
+			return
+		}
+		json.NewEncoder(w).Encode(households)
+	case "POST":
+		var household HouseholdModel
+		if err := json.NewDecoder(r.Body).Decode(&household); err != nil {
+			WriteResponse(w, "Invalid household", http.StatusBadRequest, Generic)
+			return
+		}
+		if err := CreateHousehold(db, userId, &household); err != nil {
+			writeHouseholdError(w, err)
+			return
+		}
+		json.NewEncoder(w).Encode(household)
+	case "DELETE":
+		householdId, err := routeId(r, "id")
+		if err != nil {
+			WriteResponse(w, "Invalid household ID", http.StatusBadRequest, Generic)
+			return
+		}
+		if err := DeleteHousehold(db, householdId, userId); err != nil {
+			writeHouseholdError(w, err)
+			return
+		}
+		WriteResponse(w, "Deleted household", http.StatusOK, Generic)
+	}
+}
+
+// invitations to a household, managed by its owners. GET lists pending ones,
+// POST emails a new one, DELETE /{inviteId} withdraws one.
+func householdInvites(w http.ResponseWriter, r *http.Request, claims *auth_types.JWTData) {
+	w.Header().Set("Content-Type", "application/json")
+	db := authentication.GetDb()
+	if claims == nil {
+		WriteResponse(w, "Must be logged in to manage households.", http.StatusUnauthorized, Generic)
+		return
+	}
+	userId, ok := lookupCaller(w, db, claims)
+	if !ok {
+		return
+	}
+	householdId, err := routeId(r, "id")
+	if err != nil {
+		WriteResponse(w, "Invalid household ID", http.StatusBadRequest, Generic)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		var invites []HouseholdInviteModel
+		if err := GetHouseholdInvites(db, householdId, userId, &invites); err != nil {
+			writeHouseholdError(w, err)
+			return
+		}
+		json.NewEncoder(w).Encode(invites)
+	case "POST":
+		var request struct {
+			Email string `json:"email"`
+			Role  string `json:"role"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			WriteResponse(w, "Invalid invitation", http.StatusBadRequest, Generic)
+			return
+		}
+		var invite HouseholdInviteModel
+		if err := InviteToHousehold(db, householdId, userId, request.Email, request.Role, &invite); err != nil {
+			writeHouseholdError(w, err)
+			return
+		}
+		json.NewEncoder(w).Encode(invite)
+	case "DELETE":
+		inviteId, err := routeId(r, "inviteId")
+		if err != nil {
+			WriteResponse(w, "Invalid invitation ID", http.StatusBadRequest, Generic)
+			return
+		}
+		if err := RevokeHouseholdInvite(db, householdId, userId, inviteId); err != nil {
+			writeHouseholdError(w, err)
+			return
+		}
+		WriteResponse(w, "Invitation withdrawn", http.StatusOK, Generic)
+	}
+}
+
+// join a household with the code from an invitation email
+func acceptHouseholdInvite(w http.ResponseWriter, r *http.Request, claims *auth_types.JWTData) {
+	w.Header().Set("Content-Type", "application/json")
+	db := authentication.GetDb()
+	if claims == nil {
+		WriteResponse(w, "Must be logged in to join a household.", http.StatusUnauthorized, Generic)
+		return
+	}
+	userId, ok := lookupCaller(w, db, claims)
+	if !ok {
+		return
+	}
+	var request struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Code == "" {
+		WriteResponse(w, "Invalid invitation code", http.StatusBadRequest, Generic)
+		return
+	}
+	var household HouseholdModel
+	if err := AcceptHouseholdInvite(db, request.Code, userId, claims.Email, &household); err != nil {
+		writeHouseholdError(w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(household)
+}
+
+// members of a household. PUT /{userId} changes a member's role and DELETE
+// /{userId} removes them; both are for owners, except that members may remove
+// themselves to leave.
+func householdMembers(w http.ResponseWriter, r *http.Request, claims *auth_types.JWTData) {
+	w.Header().Set("Content-Type", "application/json")
+	db := authentication.GetDb()
+	if claims == nil {
+		WriteResponse(w, "Must be logged in to manage households.", http.StatusUnauthorized, Generic)
+		return
+	}
+	userId, ok := lookupCaller(w, db, claims)
+	if !ok {
+		return
+	}
+	householdId, err := routeId(r, "id")
+	if err != nil {
+		WriteResponse(w, "Invalid household ID", http.StatusBadRequest, Generic)
+		return
+	}
+	memberId, err := routeId(r, "userId")
+	if err != nil {
+		WriteResponse(w, "Invalid user ID", http.StatusBadRequest, Generic)
+		return
+	}
+
+	switch r.Method {
+	case "PUT":
+		var request struct {
+			Role string `json:"role"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			WriteResponse(w, "Invalid role", http.StatusBadRequest, Generic)
+			return
+		}
+		if err := SetHouseholdMemberRole(db, householdId, userId, memberId, request.Role); err != nil {
+			writeHouseholdError(w, err)
+			return
+		}
+		var household HouseholdModel
+		if err := GetHousehold(db, householdId, &household); err != nil {
+			writeHouseholdError(w, err)
+			return
+		}
+		json.NewEncoder(w).Encode(household)
+	case "DELETE":
+		if err := RemoveHouseholdMember(db, householdId, userId, memberId); err != nil {
+			writeHouseholdError(w, err)
+			return
+		}
+		WriteResponse(w, "Removed from household", http.StatusOK, Generic)
+	}
+}
+
+// share a plant with one of the caller's households, or with a householdId
+// of 0 make it personal again
+func plantHousehold(w http.ResponseWriter, r *http.Request, claims *auth_types.JWTData) {
+	w.Header().Set("Content-Type", "application/json")
+	db := authentication.GetDb()
+	if claims == nil {
+		WriteResponse(w, "Must be logged in to share plants.", http.StatusUnauthorized, Generic)
+		return
+	}
+	userId, ok := lookupCaller(w, db, claims)
+	if !ok {
+		return
+	}
+	plantId, err := routeId(r, "id")
+	if err != nil {
+		WriteResponse(w, "Invalid plant ID", http.StatusBadRequest, Generic)
+		return
+	}
+	var request struct {
+		HouseholdID uint `json:"householdId"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		WriteResponse(w, "Invalid household ID", http.StatusBadRequest, Generic)
+		return
+	}
+	var plant PlantModel
+	if err := db.First(&plant, plantId).Error; err != nil {
+		WriteResponse(w, "No such plant", http.StatusNotFound, Generic)
+		return
+	}
+	if err := MovePlantToHousehold(db, &plant, userId, request.HouseholdID); err != nil {
+		writeHouseholdError(w, err)
+		return
+	}
+	db.Preload("Logs").Preload("Comments").First(&plant, plant.ID)
+	resolvePlantName(db, &plant)
+	w.Header().Set("ETag", plantETag(&plant))
+	json.NewEncoder(w).Encode(plant)
+}
+
+// writeSitterError answers a failed plant-sitting operation.
+func writeSitterError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrSitterForbidden), errors.Is(err, ErrPlantNotInGrant):
+		WriteResponse(w, err.Error(), http.StatusForbidden, Generic)
+	case errors.Is(err, ErrInvalidGrant):
+		WriteResponse(w, err.Error(), http.StatusNotFound, Generic)
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		WriteResponse(w, "Not found", http.StatusNotFound, Generic)
+	default:
+		WriteResponse(w, err.Error(), http.StatusBadRequest, Generic)
+	}
+}
+
+// plant-sitter access the caller has handed out. GET lists it, POST gives a
+// sitter access to some plants, DELETE /{id} revokes it.
+func sitterGrants(w http.ResponseWriter, r *http.Request, claims *auth_types.JWTData) {
+	w.Header().Set("Content-Type", "application/json")
+	db := authentication.GetDb()
+	if claims == nil {
+		WriteResponse(w, "Must be logged in to manage plant sitters.", http.StatusUnauthorized, Generic)
+		return
+	}
+	userId, ok := lookupCaller(w, db, claims)
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		var grants []SitterGrantModel
+		if err := GetSitterGrants(db, userId, &grants); err != nil {
+			WriteResponse(w, "Failed to get plant sitters", http.StatusInternalServerError, Generic)
+			return
+		}
+		json.NewEncoder(w).Encode(grants)
+	case "POST":
+		var request SitterGrantRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			WriteResponse(w, "Invalid plant sitter access", http.StatusBadRequest, Generic)
+			return
+		}
+		var grant SitterGrantModel
+		if err := CreateSitterGrant(db, userId, &request, &grant); err != nil {
+			writeSitterError(w, err)
+			return
+		}
+		json.NewEncoder(w).Encode(grant)
+	case "DELETE":
+		grantId, err := routeId(r, "id")
+		if err != nil {
+			WriteResponse(w, "Invalid grant ID", http.StatusBadRequest, Generic)
+			return
+		}
+		if err := RevokeSitterGrant(db, grantId, userId); err != nil {
+			writeSitterError(w, err)
+			return
+		}
+		WriteResponse(w, "Plant sitter access revoked", http.StatusOK, Generic)
+	}
+}
+
+// recordSitterCare logs the care action in the request body under grant and
+// answers with the updated plant.
+func recordSitterCare(w http.ResponseWriter, r *http.Request, db *gorm.DB, grant *SitterGrantModel, sitter userContact) {
+	var event CareEventModel
+	if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+		WriteResponse(w, "Invalid care action", http.StatusBadRequest, Generic)
+		return
+	}
+	var plant PlantModel
+	if err := RecordSitterCare(db, grant, sitter, &plant, &event); err != nil {
+		writeSitterError(w, err)
+		return
+	}
+	resolvePlantName(db, &plant)
+	json.NewEncoder(w).Encode(plant)
+}
+
+// plants the caller is sitting. GET lists the live access they were given,
+// POST /{id}/care logs a care action under it.
+func sitting(w http.ResponseWriter, r *http.Request, claims *auth_types.JWTData) {
+	w.Header().Set("Content-Type", "application/json")
+	db := authentication.GetDb()
+	if claims == nil {
+		WriteResponse(w, "Must be logged in to sit plants.", http.StatusUnauthorized, Generic)
+		return
+	}
+	userId, ok := lookupCaller(w, db, claims)
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		var grants []SitterGrantModel
+		if err := GetSittingGrants(db, userId, &grants); err != nil {
+			WriteResponse(w, "Failed to get plants to sit", http.StatusInternalServerError, Generic)
+			return
+		}
+		json.NewEncoder(w).Encode(grants)
+	case "POST":
+		grantId, err := routeId(r, "id")
+		if err != nil {
+			WriteResponse(w, "Invalid grant ID", http.StatusBadRequest, Generic)
+			return
+		}
+		var grant SitterGrantModel
+		if err := GetSitterGrantForSitter(db, grantId, userId, &grant); err != nil {
+			writeSitterError(w, err)
+			return
+		}
+		recordSitterCare(w, r, db, &grant, userContact{ID: userId, Email: claims.Email, Username: claims.Username})
+	}
+}
+
+// plant-sitting through a link, which works without an account. GET shows
+// the plants the link covers, POST /care logs a care action on one.
+func sittingLink(w http.ResponseWriter, r *http.Request, claims *auth_types.JWTData) {
+	w.Header().Set("Content-Type", "application/json")
+	db := authentication.GetDb()
+	vars := mux.Vars(r)
+
+	var grant SitterGrantModel
+	if err := GetSitterGrantByToken(db, vars["token"], &grant); err != nil {
+		writeSitterError(w, err)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		json.NewEncoder(w).Encode(grant)
+	case "POST":
+		// logged in sitters are credited by account
+		var sitter userContact
+		if claims != nil {
+			userId, ok := lookupCaller(w, db, claims)
+			if !ok {
+				return
+			}
+			sitter = userContact{ID: userId, Email: claims.Email, Username: claims.Username}
+		}
+		recordSitterCare(w, r, db, &grant, sitter)
+	}
+}
+
+// the caller's usage against their quota
+func usage(w http.ResponseWriter, r *http.Request, claims *auth_types.JWTData) {
+	w.Header().Set("Content-Type", "application/json")
+	db := authentication.GetDb()
+	if claims == nil {
+		WriteResponse(w, "Must be logged in to see your usage.", http.StatusUnauthorized, Generic)
+		return
+	}
+	userId, ok := lookupCaller(w, db, claims)
+	if !ok {
+		return
+	}
+	var usage QuotaUsage
+	if err := GetQuotaUsage(db, userId, &usage); err != nil {
+		WriteResponse(w, "Failed to get usage", http.StatusInternalServerError, Generic)
+		return
+	}
+	json.NewEncoder(w).Encode(usage)
+}
+
+// admin view of quotas. GET lists every user's usage, PUT assigns a user's
+// tier and overrides.
+func adminQuotas(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	db := authentication.GetDb()
+
+	switch r.Method {
+	case "GET":
+		var usages []QuotaUsage
+		if err := GetAllQuotaUsage(db, &usages); err != nil {
+			WriteResponse(w, "Failed to get usage", http.StatusInternalServerError, Generic)
+			return
+		}
+		json.NewEncoder(w).Encode(usages)
+	case "PUT":
+		var quota QuotaModel
+		if err := json.NewDecoder(r.Body).Decode(&quota); err != nil {
+			WriteResponse(w, "Invalid quota", http.StatusBadRequest, Generic)
+			return
+		}
+		if err := UpdateQuota(db, &quota); err != nil {
+			WriteResponse(w, err.Error(), http.StatusBadRequest, Generic)
+			return
+		}
+		var usage QuotaUsage
+		if err := GetQuotaUsage(db, quota.UserID, &usage); err != nil {
+			WriteResponse(w, "Failed to get usage", http.StatusInternalServerError, Generic)
+			return
+		}
+		json.NewEncoder(w).Encode(usage)
+	}
+}
+
+// admin view of the email outbox. GET lists messages (dead ones by default),
+// POST to /{id}/retry requeues a message.
+func adminEmails(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	db := authentication.GetDb()
+	vars := mux.Vars(r)
+
+	switch r.Method {
+	case "GET":
+		status := r.URL.Query().Get("status")
+		if status == "" {
+			status = OUTBOX_DEAD
+		}
+		var outboxEmails []OutboxEmailModel
+		if err := GetOutboxEmails(db, status, &outboxEmails); err != nil {
+			WriteResponse(w, "Failed to get emails", http.StatusInternalServerError, Generic)
+			return
+		}
+		json.NewEncoder(w).Encode(outboxEmails)
+	case "POST":
+		id, err := strconv.Atoi(vars["id"])
+		if err != nil {
+			WriteResponse(w, "Invalid email ID", http.StatusBadRequest, Generic)
+			return
+		}
+		if err := RetryOutboxEmail(db, id); err != nil {
+			WriteResponse(w, err.Error(), http.StatusBadRequest, Generic)
+			return
+		}
+		WriteResponse(w, "Email queued for retry", http.StatusOK, Generic)
+	}
+}
+
+// find images no plant refers to and delete them, or with ?dryRun=true just
+// report them
+func adminImageGc(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	db := authentication.GetDb()
+	dryRun := r.URL.Query().Get("dryRun") == "true"
+	report, err := CollectOrphanedImages(db, dryRun)
+	if err != nil {
+		fmt.Printf("Failed collecting orphaned images: %v\n", err)
+		WriteResponse(w, "Failed collecting orphaned images", http.StatusInternalServerError, Generic)
+		return
+	}
+	json.NewEncoder(w).Encode(report)
+}
+
 func InitViews(router *mux.Router) {
 	router.HandleFunc("/api/comments", authentication.VerifiedOnly(comments, true)).Methods("GET", "POST", "PUT", "DELETE", "OPTIONS")
 	router.HandleFunc("/api/comments/{id:[0-9]+}", authentication.VerifiedOnly(comments, true)).Methods("GET", "POST", "PUT", "DELETE", "OPTIONS")
 	router.HandleFunc("/api/plants", authentication.VerifiedOnly(plants, true)).Methods("GET", "POST", "PUT", "OPTIONS")
 	router.HandleFunc("/api/plants/{id:[0-9]+}", authentication.VerifiedOnly(plants, true)).Methods("GET", "POST", "DELETE", "PUT", "OPTIONS")
-	router.HandleFunc("/api/images/{id:[0-9]+}", images).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/plants/actions", authentication.VerifiedOnly(plantActions, false)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/api/plants/{id:[0-9]+}/actions", authentication.VerifiedOnly(plantActions, false)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/api/plants/{id:[0-9]+}/events", authentication.VerifiedOnly(careEvents, true)).Methods("GET", "POST", "OPTIONS")
+	router.HandleFunc("/api/plants/{id:[0-9]+}/photos", authentication.VerifiedOnly(plantPhotos, true)).Methods("GET", "POST", "OPTIONS")
+	router.HandleFunc("/api/plants/{id:[0-9]+}/photos/{photoId:[0-9]+}", authentication.VerifiedOnly(plantPhotos, true)).Methods("PUT", "DELETE", "OPTIONS")
+	router.HandleFunc("/api/plants/{id:[0-9]+}/photos/{photoId:[0-9]+}/cover", authentication.VerifiedOnly(plantPhotos, true)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/api/plants/{id:[0-9]+}/household", authentication.VerifiedOnly(plantHousehold, false)).Methods("PUT", "OPTIONS")
+	router.HandleFunc("/api/households", authentication.VerifiedOnly(households, false)).Methods("GET", "POST", "OPTIONS")
+	router.HandleFunc("/api/households/{id:[0-9]+}", authentication.VerifiedOnly(households, false)).Methods("DELETE", "OPTIONS")
+	router.HandleFunc("/api/households/{id:[0-9]+}/invites", authentication.VerifiedOnly(householdInvites, false)).Methods("GET", "POST", "OPTIONS")
+	router.HandleFunc("/api/households/{id:[0-9]+}/invites/{inviteId:[0-9]+}", authentication.VerifiedOnly(householdInvites, false)).Methods("DELETE", "OPTIONS")
+	router.HandleFunc("/api/households/invites/accept", authentication.VerifiedOnly(acceptHouseholdInvite, false)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/api/households/{id:[0-9]+}/members/{userId:[0-9]+}", authentication.VerifiedOnly(householdMembers, false)).Methods("PUT", "DELETE", "OPTIONS")
+	router.HandleFunc("/api/sitters", authentication.VerifiedOnly(sitterGrants, false)).Methods("GET", "POST", "OPTIONS")
+	router.HandleFunc("/api/sitters/{id:[0-9]+}", authentication.VerifiedOnly(sitterGrants, false)).Methods("DELETE", "OPTIONS")
+	router.HandleFunc("/api/sitting", authentication.VerifiedOnly(sitting, false)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/sitting/{id:[0-9]+}/care", authentication.VerifiedOnly(sitting, false)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/api/sitting/link/{token}", authentication.VerifiedOnly(sittingLink, true)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/sitting/link/{token}/care", authentication.VerifiedOnly(sittingLink, true)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/api/images/{id:[0-9]+}", authentication.VerifiedOnly(images, true)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/schedule", authentication.VerifiedOnly(schedule, false)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/calendar/token", authentication.VerifiedOnly(calendarToken, false)).Methods("POST", "DELETE", "OPTIONS")
+	router.HandleFunc("/api/calendar/{token:[A-Za-z0-9_-]+}.ics", calendarFeed).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/preferences", authentication.VerifiedOnly(preferences, false)).Methods("GET", "PUT", "OPTIONS")
+	router.HandleFunc("/api/usage", authentication.VerifiedOnly(usage, false)).Methods("GET", "OPTIONS")
 	router.HandleFunc("/api/version", version).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/admin/emails", authentication.AdminOnly(adminEmails)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/admin/emails/{id:[0-9]+}/retry", authentication.AdminOnly(adminEmails)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/api/admin/quotas", authentication.AdminOnly(adminQuotas)).Methods("GET", "PUT", "OPTIONS")
+	router.HandleFunc("/api/admin/images/gc", authentication.AdminOnly(adminImageGc)).Methods("POST", "OPTIONS")
 }
@@ -2,11 +2,15 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
+	"sync"
+	"syscall"
 	"time"
 
 	"app/app"
@@ -15,6 +19,7 @@ import (
 
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
+	"gorm.io/gorm"
 )
 
 func makeRouter() *mux.Router {
@@ -25,13 +30,39 @@ func makeRouter() *mux.Router {
 
 var DEFAULT_PORT = 8080
 
+// migrateImages moves image bytes between stores, e.g.
+//
+//	web-app migrate-images -from db -to s3
+//
+// Stores are configured from the same environment as the server.
+func migrateImages(db *gorm.DB, args []string) error {
+	flags := flag.NewFlagSet("migrate-images", flag.ExitOnError)
+	from := flags.String("from", "db", "store to move images out of (db, fs or s3)")
+	to := flags.String("to", "", "store to move images into (db, fs or s3)")
+	keep := flags.Bool("keep", false, "leave the original copies in the source store")
+	flags.Parse(args)
+
+	source, err := app.NewImageStore(*from)
+	if err != nil {
+		return err
+	}
+	destination, err := app.NewImageStore(*to)
+	if err != nil {
+		return err
+	}
+	_, err = app.MigrateImages(db, source, destination, *keep)
+	return err
+}
+
 // startServing creates the server mux and registers endpoints with it.
 func startServing(port int, router *mux.Router) {
 	portStr := fmt.Sprintf("0.0.0.0:%d", port)
 	log.Printf("Starting server on https://%s...", portStr)
 
 	methods := []string{"GET", "POST", "PUT", "DELETE"}
-	headers := []string{"Content-Type", "Access-Control-Allow-Origin", "Authorization"}
+	headers := []string{"Content-Type", "Access-Control-Allow-Origin", "Authorization", "If-Match"}
+	// plant versions, for If-Match on edits
+	exposedHeaders := []string{"ETag"}
 	origins := []string{
 		// from the storage account
 		"https://plantmindrstorage.z13.web.core.windows.net",
@@ -49,6 +80,7 @@ func startServing(port int, router *mux.Router) {
 		Handler: handlers.CORS(handlers.AllowCredentials(),
 			handlers.AllowedMethods(methods),
 			handlers.AllowedHeaders(headers),
+			handlers.ExposedHeaders(exposedHeaders),
 			handlers.AllowedOrigins(origins))(router),
 		Addr: portStr,
 		// Good practice: enforce timeouts for servers you create!
@@ -64,8 +96,19 @@ func main() {
 	log.Printf("Starting...")
 	stopCh := make(chan bool)
 
-	// Stop the function by sending a message to the channel
-	// stopCh <- true
+	var workers sync.WaitGroup
+
+	// Stop the background workers by closing the channel before exiting, so
+	// an in-progress reminder sweep, outbox drain or image collection can finish.
+	go func() {
+		sigCh := make(chan os.Signal, 1)
+		signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+		sig := <-sigCh
+		log.Printf("Received %v, shutting down...", sig)
+		close(stopCh)
+		workers.Wait()
+		os.Exit(0)
+	}()
 
 	router := makeRouter()
 	dropTables := false
@@ -144,13 +187,110 @@ func main() {
 		registrationCallbackUrl,
 		os.Getenv("DEBUG") == "true")
 
+	mailer, err := app.NewMailerFromEnv()
+	if err != nil {
+		log.Printf("Error configuring mailer: %v", err)
+		return
+	}
+	app.InitMailer(mailer)
+
+	imageStore, err := app.NewImageStoreFromEnv()
+	if err != nil {
+		log.Printf("Error configuring image store: %v", err)
+		return
+	}
+	app.InitImageStore(imageStore)
+	log.Printf("Images will be stored in the %s store", imageStore.Name())
+
 	db := authentication.GetDb()
 
 	app.InitViews(router)
 	app.InitModels(db, dropTables)
 
-	// Run the function in a goroutine
-	go app.StartTimer(stopCh, db)
+	if len(os.Args) > 1 && os.Args[1] == "migrate-images" {
+		if err := migrateImages(db, os.Args[2:]); err != nil {
+			log.Printf("Image migration failed: %v", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "backfill-image-variants" {
+		if _, err := app.BackfillImageVariants(db); err != nil {
+			log.Printf("Image variant backfill failed: %v", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	reminderInterval := app.DEFAULT_REMINDER_INTERVAL
+	if os.Getenv("REMINDER_INTERVAL") != "" {
+		reminderInterval, err = time.ParseDuration(os.Getenv("REMINDER_INTERVAL"))
+		if err != nil {
+			log.Printf("Error parsing REMINDER_INTERVAL %s.", os.Getenv("REMINDER_INTERVAL"))
+			return
+		}
+	}
+	log.Printf("Care reminders will be checked every %v", reminderInterval)
+	if os.Getenv("REMINDER_GRACE_DAYS") != "" {
+		app.REMINDER_GRACE_DAYS, err = strconv.Atoi(os.Getenv("REMINDER_GRACE_DAYS"))
+		if err != nil {
+			log.Printf("Error converting REMINDER_GRACE_DAYS %s to int.", os.Getenv("REMINDER_GRACE_DAYS"))
+			return
+		}
+	}
+	log.Printf("Care reminders will be sent %d day(s) after care is due", app.REMINDER_GRACE_DAYS)
+
+	if os.Getenv("DEFAULT_QUOTA_TIER") != "" {
+		if _, ok := app.QUOTA_TIERS[os.Getenv("DEFAULT_QUOTA_TIER")]; !ok {
+			log.Printf("Unknown DEFAULT_QUOTA_TIER %s.", os.Getenv("DEFAULT_QUOTA_TIER"))
+			return
+		}
+		app.DEFAULT_QUOTA_TIER = os.Getenv("DEFAULT_QUOTA_TIER")
+	}
+	log.Printf("Accounts without a quota will be on the %s tier", app.DEFAULT_QUOTA_TIER)
+
+	if os.Getenv("IMAGE_GC_INTERVAL") != "" {
+		app.IMAGE_GC_INTERVAL, err = time.ParseDuration(os.Getenv("IMAGE_GC_INTERVAL"))
+		if err != nil {
+			log.Printf("Error parsing IMAGE_GC_INTERVAL %s.", os.Getenv("IMAGE_GC_INTERVAL"))
+			return
+		}
+	}
+
+	if os.Getenv("CARE_EVENT_RETENTION_DAYS") != "" {
+		retentionDays, err := strconv.Atoi(os.Getenv("CARE_EVENT_RETENTION_DAYS"))
+		if err != nil || retentionDays < 0 {
+			log.Printf("Error converting CARE_EVENT_RETENTION_DAYS %s to a number of days.", os.Getenv("CARE_EVENT_RETENTION_DAYS"))
+			return
+		}
+		app.CARE_EVENT_RETENTION = time.Duration(retentionDays) * 24 * time.Hour
+	}
+	log.Printf("Care events will be kept for %v (0 keeps them forever)", app.CARE_EVENT_RETENTION)
+
+	if os.Getenv("OUTBOX_RETENTION_DAYS") != "" {
+		retentionDays, err := strconv.Atoi(os.Getenv("OUTBOX_RETENTION_DAYS"))
+		if err != nil || retentionDays < 0 {
+			log.Printf("Error converting OUTBOX_RETENTION_DAYS %s to a number of days.", os.Getenv("OUTBOX_RETENTION_DAYS"))
+			return
+		}
+		app.OUTBOX_RETENTION = time.Duration(retentionDays) * 24 * time.Hour
+	}
+	log.Printf("Sent emails will be kept for %v (0 keeps them forever)", app.OUTBOX_RETENTION)
+
+	// Run the background workers in goroutines
+	workers.Add(3)
+	go func() {
+		defer workers.Done()
+		app.StartTimer(stopCh, db, reminderInterval)
+	}()
+	go func() {
+		defer workers.Done()
+		app.StartOutboxWorker(stopCh, db)
+	}()
+	go func() {
+		defer workers.Done()
+		app.StartImageGc(stopCh, db)
+	}()
 
 	startServing(port, router)
 }
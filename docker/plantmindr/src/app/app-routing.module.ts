@@ -2,6 +2,8 @@ import { NgModule } from '@angular/core';
 import { RouterModule, Routes } from '@angular/router';
 import { AuthenticationComponent } from './components/authentication/authentication.component';
 import { CommentsComponent } from './components/comments/comments.component';
+import { HouseholdsComponent } from './components/households/households.component';
+import { SittingComponent } from './components/sitting/sitting.component';
 import { PlantsComponent } from './components/plants/plants.component';
 import { ProfileComponent } from './components/profile/profile.component';
 import { HttpsGuard } from './services/httpsguard.service';
@@ -11,6 +13,8 @@ const routes: Routes = [
   { path: 'home', canActivate: [HttpsGuard], component: PlantsComponent },
   { path: 'profile', canActivate: [HttpsGuard], component: ProfileComponent },
   { path: 'comments/:plantId/:plantUsername', canActivate: [HttpsGuard], component: CommentsComponent },
+  { path: 'households', canActivate: [HttpsGuard], component: HouseholdsComponent },
+  { path: 'sitting', canActivate: [HttpsGuard], component: SittingComponent },
   { path: '', redirectTo: '/home', pathMatch: 'full' },
 ];
 
@@ -42,7 +42,8 @@ import { ProfileComponent } from './components/profile/profile.component';
 import { CommentsComponent } from './components/comments/comments.component';
 import { PlantCareDialogComponent } from './components/plant-care-dialog/plant-care-dialog.component';
 import { NotesComponent } from './components/notes/notes.component';
-import { PlantFilterPipe } from './pipes/plant-filter-pipe';
+import { HouseholdsComponent } from './components/households/households.component';
+import { SittingComponent } from './components/sitting/sitting.component';
 
 
 @NgModule({
@@ -56,10 +57,11 @@ import { PlantFilterPipe } from './pipes/plant-filter-pipe';
     PlantsComponent,
     PlantComponent,
     ProfileComponent,
-    PlantFilterPipe,
     CommentsComponent,
     PlantCareDialogComponent,
-    NotesComponent
+    NotesComponent,
+    HouseholdsComponent,
+    SittingComponent
   ],
   imports: [
     NgxLoadingButtonsModule,
@@ -0,0 +1,36 @@
+import { Component } from '@angular/core';
+import { ActivatedRoute } from '@angular/router';
+
+import { AuthenticationService } from 'src/app/services/authentication.service';
+import { HouseholdsService } from 'src/app/services/households.service';
+
+@Component({
+  selector: 'app-households',
+  templateUrl: './households.component.html',
+  styleUrls: ['./households.component.css']
+})
+export class HouseholdsComponent {
+
+  // code from an invitation email, accepted once the user is logged in
+  inviteCode: string = ""
+
+  constructor(
+    public householdsService: HouseholdsService,
+    private activatedRoute: ActivatedRoute,
+    public authenticationService: AuthenticationService) {
+  }
+
+  ngOnInit() {
+    this.activatedRoute.queryParams.subscribe(params => {
+      this.inviteCode = params['invite'] || ""
+      if (!this.authenticationService.isAuthenticated$.value) {
+        return
+      }
+      if (this.inviteCode) {
+        this.householdsService.acceptInvite(this.inviteCode)
+      } else {
+        this.householdsService.getHouseholds()
+      }
+    });
+  }
+}
@@ -143,31 +143,24 @@ export class PlantComponent {
         if (!this.plant) {
           return;
         }
+        if (result.moist) {
+          console.log("Plant is moist - only logging that")
+          this.plantsService.markMoist(this.plant)
+          return;
+        }
+        let actions: string[] = []
         if (result.water) {
-          this.plant.lastWaterDate = Plant.formatDate(new Date())
-          console.log("Setting lastWaterDate to " + this.plant.lastWaterDate);
-          this.plant.lastMoistDate = '' // unset
+          actions.push('watered')
         }
-        if (result.fertilize || result.skipFertilize) {
-          this.plant.lastFertilizeDate = Plant.formatDate(new Date())
-          console.log("Setting lastFertilizeDate to " + this.plant.lastFertilizeDate);
-          if (result.skipFertilize) {
-            console.log("Fertilize was skipped")
-            this.plant.skippedLastFertilize = true
-          } else {
-            this.plant.skippedLastFertilize = false
-          }
+        if (result.fertilize) {
+          actions.push('fertilized')
+        } else if (result.skipFertilize) {
+          console.log("Fertilize was skipped")
+          actions.push('skipped_fertilize')
         }
-        if (result.moist) {
-          console.log("Plant is moist - only updating that attribute")
-          this.plant.lastMoistDate = Plant.formatDate(new Date())
-          // this.plantsService.markMoist(this.plant)
-          this.plantsService.updatePlant(this.plant, null)
-          return;
+        if (actions.length > 0) {
+          this.plantsService.logCare(this.plant, actions)
         }
-
-        // not updating the image for this plant
-        this.plantsService.updatePlant(this.plant, null)
       } else {
         console.log("Dialog declined.")
       }
@@ -277,7 +270,8 @@ export class PlantComponent {
     }
     console.log("Getting image for imageId=" + this.plant.imageId)
     this.isImageLoading = true;
-    this.plantsService.getPlantImage(this.plant.imageId)
+    // plant cards are small, so don't download the full size image
+    this.plantsService.getPlantImage(this.plant.imageId, this.isCondensed ? 'thumb' : 'medium')
       .subscribe(blob => {
         const reader = new FileReader();
         reader.onloadend = () => {
@@ -4,6 +4,7 @@ import { FormControl, FormGroup, FormBuilder, Validators } from '@angular/forms'
 import { ActivatedRoute } from '@angular/router';
 import { AuthenticationService } from 'src/app/services/authentication.service';
 import { DomSanitizer, SafeUrl } from '@angular/platform-browser';
+import { Subject, debounceTime, distinctUntilChanged } from 'rxjs';
 
 import { Plant } from 'src/app/models/plant.model';
 import { Router } from '@angular/router';
@@ -64,8 +65,8 @@ export class PlantsComponent {
   // name filter, if applied from HTML
   plantNameFilter: string = "";
 
-  // number of plants matching a filter
-  numPlantsMatchingFilter: number = 0
+  // name filter as it's typed, applied once the user pauses
+  plantNameFilter$: Subject<string> = new Subject<string>();
 
   // the plant edit/add form
   form = new FormGroup({
@@ -104,11 +105,14 @@ export class PlantsComponent {
       this.mode = params['mode'];
     });
 
-    // on init, ask for the list of plants
-    this.plantsService.getPlants()
-
-    // set the filters
+    // set the filters, then ask for the list of plants matching them
     this.loadFiltersFromLocalStorage()
+    this.applyFilters()
+
+    this.plantNameFilter$.pipe(debounceTime(300), distinctUntilChanged()).subscribe((name: string) => {
+      this.plantNameFilter = name
+      this.applyFilters()
+    })
 
     // sanitize the selected preview image URL for display at the frontend
     this.selectedImagePreview_safe = this.sanitizer.bypassSecurityTrustUrl(this.selectedImagePreview);
@@ -138,6 +142,19 @@ export class PlantsComponent {
     }
   }
 
+  /**
+   * Have the backend list the plants matching the current filters.
+   */
+  private applyFilters(): void {
+    this.plantsService.setFilters({
+      name: this.plantNameFilter,
+      tags: this.filterTags,
+      owners: this.filterUsernames,
+      needsCare: this.filters.get("needsCare") || false,
+      visibility: this.mode === 'public' ? 'public' : 'mine',
+    })
+  }
+
   public viewModeChanged(isCondensed: boolean): void {
     this.condensedView = isCondensed;
     localStorage.setItem("isCondensed", isCondensed ? "true" : "false")
@@ -147,6 +164,7 @@ export class PlantsComponent {
     if (!this.filterUsernames.includes(username)) {
       this.filterUsernames = [...this.filterUsernames, username]
       localStorage.setItem('filterUsernames', JSON.stringify(this.filterUsernames))
+      this.applyFilters()
     }
   }
 
@@ -155,6 +173,7 @@ export class PlantsComponent {
     if (index > -1) {
       this.filterUsernames = [...this.filterUsernames.slice(0, index), ...this.filterUsernames.slice(index + 1)];
       localStorage.setItem('filterUsernames', JSON.stringify(this.filterUsernames))
+      this.applyFilters()
     }
   }
 
@@ -162,6 +181,7 @@ export class PlantsComponent {
     if (!this.filterTags.includes(tag)) {
       this.filterTags = [...this.filterTags, tag];
       localStorage.setItem('filterTags', JSON.stringify(this.filterTags));
+      this.applyFilters()
     }
   }
 
@@ -170,6 +190,7 @@ export class PlantsComponent {
     if (index > -1) {
       this.filterTags = [...this.filterTags.slice(0, index), ...this.filterTags.slice(index + 1)];
       localStorage.setItem('filterTags', JSON.stringify(this.filterTags));
+      this.applyFilters()
     }
   }
 
@@ -179,11 +200,11 @@ export class PlantsComponent {
    * @param filterName the name of the filter to toggle
    */
   public filterChange(filterName: string): void {
-    this.numPlantsMatchingFilter = 0;
     const newFilters = new Map(this.filters.entries());
     newFilters.set(filterName, !this.filters.get(filterName));
     this.filters = newFilters;
     localStorage.setItem(filterName, (this.filters.get(filterName) ? "true" : false) || "n/a");
+    this.applyFilters()
   }
 
 
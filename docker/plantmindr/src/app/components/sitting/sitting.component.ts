@@ -0,0 +1,39 @@
+import { Component } from '@angular/core';
+import { ActivatedRoute } from '@angular/router';
+
+import { AuthenticationService } from 'src/app/services/authentication.service';
+import { SittingService } from 'src/app/services/sitting.service';
+import { SitterGrant } from 'src/app/models/sitter-grant.model';
+import { Plant } from 'src/app/models/plant.model';
+
+@Component({
+  selector: 'app-sitting',
+  templateUrl: './sitting.component.html',
+  styleUrls: ['./sitting.component.css']
+})
+export class SittingComponent {
+
+  // token from a plant-sitting link; without one, the user's own access is shown
+  token: string = ""
+
+  constructor(
+    public sittingService: SittingService,
+    private activatedRoute: ActivatedRoute,
+    public authenticationService: AuthenticationService) {
+  }
+
+  ngOnInit() {
+    this.activatedRoute.queryParams.subscribe(params => {
+      this.token = params['token'] || ""
+      if (this.token) {
+        this.sittingService.getGrantByToken(this.token)
+      } else if (this.authenticationService.isAuthenticated$.value) {
+        this.sittingService.getGrants()
+      }
+    });
+  }
+
+  public logCare(grant: SitterGrant, plant: Plant, kind: string) {
+    this.sittingService.logCare(grant, plant, kind, this.token)
+  }
+}
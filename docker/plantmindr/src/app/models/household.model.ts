@@ -0,0 +1,16 @@
+export class HouseholdMember {
+	constructor(
+		public householdId: number,
+		public userId: number,
+		public role: string,
+		public username: string
+	) { }
+}
+
+export class Household {
+	constructor(
+		public ID: number,
+		public name: string,
+		public members: HouseholdMember[]
+	) { }
+}
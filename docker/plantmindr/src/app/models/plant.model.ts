@@ -2,6 +2,9 @@ import { PlantLog } from "../types";
 import { Comment } from "./comment.model";
 
 export class Plant {
+	// the version this copy was loaded at, sent back when editing
+	public version?: number;
+
 	constructor(
 		public ID: number,
 		public name: string,
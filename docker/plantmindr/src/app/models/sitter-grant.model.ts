@@ -0,0 +1,14 @@
+import { Plant } from "./plant.model";
+
+export class SitterGrant {
+	constructor(
+		public ID: number,
+		public userId: number,
+		public sitterId: number,
+		public label: string,
+		public expiresAt: string,
+		public revokedAt: string | null,
+		public plants: Plant[],
+		public sitter: string
+	) { }
+}
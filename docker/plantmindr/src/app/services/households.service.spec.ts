@@ -0,0 +1,40 @@
+import { TestBed } from '@angular/core/testing';
+import { HttpClientTestingModule, HttpTestingController } from '@angular/common/http/testing';
+import { HouseholdsService } from './households.service';
+import { Household } from '../models/household.model';
+
+describe('HouseholdsService', () => {
+	let service: HouseholdsService;
+	let httpMock: HttpTestingController;
+
+	beforeEach(() => {
+		TestBed.configureTestingModule({
+			imports: [HttpClientTestingModule],
+			providers: [HouseholdsService]
+		});
+
+		service = TestBed.inject(HouseholdsService);
+		httpMock = TestBed.inject(HttpTestingController);
+	});
+
+	afterEach(() => {
+		httpMock.verify(); // Ensure that there are no outstanding requests
+	});
+
+	it('should accept an invite and reload households', () => {
+		const household = new Household(1, 'Home', []);
+
+		service.acceptInvite('abc');
+
+		const req = httpMock.expectOne(service.getUrlBase() + service.householdsApiUrl + '/invites/accept');
+		expect(req.request.method).toBe('POST');
+		expect(req.request.body).toEqual({ code: 'abc' });
+		req.flush(household);
+		expect(service.joinedHousehold$.value).toEqual(household);
+
+		const reload = httpMock.expectOne(service.getUrlBase() + service.householdsApiUrl);
+		expect(reload.request.method).toBe('GET');
+		reload.flush([household]);
+		expect(service.households$.value).toEqual([household]);
+	});
+});
@@ -0,0 +1,54 @@
+import { Injectable } from '@angular/core';
+import { BehaviorSubject, Observable, finalize } from 'rxjs';
+import { HttpClient } from '@angular/common/http';
+
+import { Household } from '../models/household.model';
+import { BaseService } from './base.service';
+
+@Injectable({
+  providedIn: 'root'
+})
+export class HouseholdsService extends BaseService {
+
+  householdsApiUrl = '/api/households';
+
+  // households the user belongs to
+  households$: BehaviorSubject<Household[]> = new BehaviorSubject<Household[]>([])
+  // the household the user just joined by invitation, if any
+  joinedHousehold$: BehaviorSubject<Household | null> = new BehaviorSubject<Household | null>(null)
+
+  constructor(private http: HttpClient) { super() }
+
+  public getHouseholds(): void {
+    this.isLoading$.next(true);
+    this.get().pipe(
+      finalize(() => {
+        this.isLoading$.next(false)
+      })
+    ).subscribe((households: Household[]) => this.households$.next(households))
+  }
+
+  /**
+   * join a household with the code from an invitation email
+   * @param code the invitation code
+   */
+  public acceptInvite(code: string): void {
+    this.isLoading$.next(true);
+    this.postAccept(code).pipe(
+      finalize(() => {
+        this.isLoading$.next(false)
+      })
+    ).subscribe((household: Household) => {
+      this.joinedHousehold$.next(household)
+      this.getHouseholds()
+    })
+  }
+
+  private get(): Observable<any> {
+    return this.http.get(this.getUrlBase() + this.householdsApiUrl, this.httpOptions)
+  }
+
+  private postAccept(code: string): Observable<any> {
+    return this.http.post(this.getUrlBase() + this.householdsApiUrl + '/invites/accept', { code: code }, this.httpOptions)
+  }
+}
@@ -1,10 +1,12 @@
 import { catchError } from 'rxjs/operators';
 import { HttpErrorResponse } from '@angular/common/http';
-import { HttpClient } from '@angular/common/http';
+import { HttpClient, HttpParams } from '@angular/common/http';
 import { Injectable } from '@angular/core';
-import { map, from, of, tap, Subject, throwError, Observable, BehaviorSubject } from 'rxjs';
+import { from, of, tap, Subject, throwError, Observable, BehaviorSubject, EMPTY } from 'rxjs';
+import { concatMap } from 'rxjs/operators';
 
 import { Plant } from '../models/plant.model';
+import { HttpResponse, PlantFilters, PlantPage } from '../types';
 import { BaseService } from './base.service';
 import { AuthenticationService } from './authentication.service';
 
@@ -26,6 +28,15 @@ export class PlantsService extends BaseService {
   // plant
   usernames = new Set<string>();
 
+  // number of plants to request per page
+  pageSize = 50;
+
+  // filters the backend applies to the plant list, see setFilters
+  filters: PlantFilters = { name: '', tags: [], owners: [], needsCare: false, visibility: 'mine' };
+
+  // cursor of the next page of plants, empty once the last page is loaded
+  nextCursor$: BehaviorSubject<string> = new BehaviorSubject<string>('')
+
   // urls for backend requests
   plantsApiUrl = '/api/plants';
   imagesApiUrl = '/api/images';
@@ -52,7 +63,7 @@ export class PlantsService extends BaseService {
    * @returns a Plant object
    */
   private mapPlant(plant: any): Plant {
-    return new Plant(
+    const mapped = new Plant(
       plant.ID,
       plant.name,
       plant.username,
@@ -71,15 +82,18 @@ export class PlantsService extends BaseService {
       plant.comments,
       plant.notes
     )
+    mapped.version = plant.version
+    return mapped
   }
 
   /**
    * Make a request to the backend to get the image by imageId.
    * @param imageId the imageId to obtain.
+   * @param size which variant to get: 'thumb', 'medium' or 'full'.
    * @returns observable
    */
-  public getPlantImage(imageId: number): Observable<any> {
-    const request = new Request(`/my-data-store/${imageId}`);
+  public getPlantImage(imageId: number, size: string = 'full'): Observable<any> {
+    const request = new Request(`/my-data-store/${imageId}?size=${size}`);
     return from(
       caches.open('my-cache').then(cache => {
         return cache.match(request).then(response => {
@@ -88,7 +102,7 @@ export class PlantsService extends BaseService {
             return response.blob();
           } else {
             console.log(`Image with id ${imageId} not found in cache, requesting from API`);
-            return this.getImage(imageId).pipe(
+            return this.getImage(imageId, size).pipe(
               tap(imageBlob => {
                 const imageResponse = new Response(imageBlob);
                 cache.put(request, imageResponse);
@@ -108,10 +122,6 @@ export class PlantsService extends BaseService {
     this.isLoading$.next(true)
     this.delete(id)
       .pipe(
-        map((plants: Plant[]) => plants.map(plant => this.mapPlant(plant))),
-        map((plants: Plant[]) => {
-          return plants.sort((a: Plant, b: Plant) => this.getDaysUntilNextCareActivity(a) - this.getDaysUntilNextCareActivity(b))
-        }),
         catchError((error: any) => {
           this.isLoading$.next(false)
           if (error instanceof HttpErrorResponse) {
@@ -120,36 +130,37 @@ export class PlantsService extends BaseService {
           return throwError(error);
         })
       )
-      .subscribe((x) => {
-        this.updatePlantsList(x)
-        this.isLoading$.next(false)
+      .subscribe(() => {
+        this.getPlants()
       });
   }
 
-  // plant's that have moist soil make a PUT request 
+  // plant's that have moist soil only log that
   public markMoist(plant: Plant): void {
-    const formData = new FormData();
-    formData.append('plant', JSON.stringify(plant));
-    this.put(formData)
+    this.logCare(plant, ['moist_check'])
+  }
+
+  /**
+   * Log care given to a plant without re-sending the whole plant.
+   * @param plant the plant that was cared for.
+   * @param actions 'watered', 'fertilized', 'skipped_fertilize' or 'moist_check', logged in order.
+   */
+  public logCare(plant: Plant, actions: string[]): void {
+    from(actions)
       .pipe(
-        map((plants: Plant[]) => plants.map(plant => this.mapPlant(plant))),
-        map((plants: Plant[]) => {
-          return plants.sort((a: Plant, b: Plant) => this.getDaysUntilNextCareActivity(a) - this.getDaysUntilNextCareActivity(b))
-        }),
+        concatMap((action: string) => this.postAction(plant.ID, action)),
         catchError((error: any) => {
           this.formProcessingSucceeded$.next(false)
-          if (error instanceof HttpErrorResponse) {
-          } else {
-          }
-          return of(null)
+          // show whatever was logged before the failure
+          this.getPlants()
+          return EMPTY
         })
       )
-      .subscribe((x) => {
-        if (x == null) {
-          return
+      .subscribe({
+        complete: () => {
+          this.formProcessingSucceeded$.next(true)
+          this.getPlants()
         }
-        this.formProcessingSucceeded$.next(true)
-        this.updatePlantsList(x)
       });
   }
   /**
@@ -163,16 +174,13 @@ export class PlantsService extends BaseService {
       formData.append('image', image, image.name);
     }
     formData.append('plant', JSON.stringify(plant));
-    this.put(formData)
+    this.put(formData, plant.version)
       .pipe(
-        map((plants: Plant[]) => plants.map(plant => this.mapPlant(plant))),
-        map((plants: Plant[]) => {
-          return plants.sort((a: Plant, b: Plant) => this.getDaysUntilNextCareActivity(a) - this.getDaysUntilNextCareActivity(b))
-        }),
         catchError((error: any) => {
           this.formProcessingSucceeded$.next(false)
-          if (error instanceof HttpErrorResponse) {
-          } else {
+          if (error instanceof HttpErrorResponse && error.status == 409) {
+            // edited elsewhere in the meantime, show the current plant
+            this.getPlants()
           }
           return of(null)
         })
@@ -182,7 +190,7 @@ export class PlantsService extends BaseService {
           return
         }
         this.formProcessingSucceeded$.next(true)
-        this.updatePlantsList(x)
+        this.getPlants()
       });
   }
 
@@ -199,10 +207,6 @@ export class PlantsService extends BaseService {
     formData.append('plant', JSON.stringify(plant));
     this.post(formData)
       .pipe(
-        map((plants: Plant[]) => plants.map(plant => this.mapPlant(plant))),
-        map((plants: Plant[]) => {
-          return plants.sort((a: Plant, b: Plant) => this.getDaysUntilNextCareActivity(a) - this.getDaysUntilNextCareActivity(b))
-        }),
         catchError((error: any) => {
           this.formProcessingSucceeded$.next(false)
           if (error instanceof HttpErrorResponse) {
@@ -218,22 +222,27 @@ export class PlantsService extends BaseService {
           return;
         }
         this.formProcessingSucceeded$.next(true)
-        this.updatePlantsList(x)
+        this.getPlants()
       });
   }
 
 
   /**
-   * Get a list of plants.
+   * Change which plants are listed and load the first page of them.
+   * @param filters the filters to apply.
+   */
+  public setFilters(filters: PlantFilters): void {
+    this.filters = filters
+    this.getPlants()
+  }
+
+  /**
+   * Get the first page of plants matching the filters.
    */
   public getPlants(): void {
     this.isLoading$.next(true)
-    this.get()
+    this.get('')
       .pipe(
-        map((plants: Plant[]) => plants.map(plant => this.mapPlant(plant))),
-        map((plants: Plant[]) => {
-          return plants.sort((a: Plant, b: Plant) => this.getDaysUntilNextCareActivity(a) - this.getDaysUntilNextCareActivity(b))
-        }),
         catchError((error: any) => {
           this.isLoading$.next(false)
           if (error instanceof HttpErrorResponse) {
@@ -242,8 +251,22 @@ export class PlantsService extends BaseService {
           return throwError(error);
         })
       )
-      .subscribe((plants: Plant[]) => {
-        this.updatePlantsList(plants);
+      .subscribe((page: PlantPage) => {
+        this.updatePlantsList(page, []);
+      });
+  }
+
+  /**
+   * Append the next page of plants to the list, if there is one.
+   */
+  public loadMorePlants(): void {
+    const cursor = this.nextCursor$.value
+    if (!cursor) {
+      return
+    }
+    this.get(cursor)
+      .subscribe((page: PlantPage) => {
+        this.updatePlantsList(page, this.plants$.value);
       });
   }
 
@@ -262,12 +285,14 @@ export class PlantsService extends BaseService {
 
   /**
    * Handle updating the list of plants from the API service (put, post, get, etc.)
-   * @param plants new plants.
+   * @param page a page of plants from the backend.
+   * @param loaded plants already listed, which the page follows.
    */
-  private updatePlantsList(plants: Plant[]): void {
-    // handle case where plants were removed from server copy
+  private updatePlantsList(page: PlantPage, loaded: Plant[]): void {
+    const plants = page.plants.map(plant => this.mapPlant(plant))
     console.log(`updating plant list with ${plants.length}`)
-    this.plants$.next(plants)
+    this.plants$.next(loaded.concat(plants))
+    this.nextCursor$.next(page.nextCursor || '')
     plants.forEach((x) => {
       this.tags.add(x.tag)
       this.usernames.add(x.username)
@@ -275,80 +300,51 @@ export class PlantsService extends BaseService {
     this.isLoading$.next(false)
   }
 
-  private getDaysUntilNextCareActivity(plant: Plant): number {
-    // Convert string dates to Date objects
-    let lastWaterDate = new Date(plant.lastWaterDate);
-    let lastMoistDate: Date | null = plant.lastMoistDate ? new Date(plant.lastMoistDate) : null;
-    let lastFertilizeDate: Date | null = (plant.lastFertilizeDate && plant.fertilizingFrequency > 0) ? new Date(plant.lastFertilizeDate) : null;
-
-    let nextWaterCareDate = new Date();
-    nextWaterCareDate.setTime(lastWaterDate.getTime() + plant.wateringFrequency * 24 * 60 * 60 * 1000);
-
-    let nextFertilizeCareDate: Date | null = null;
-    if (lastFertilizeDate) {
-      nextFertilizeCareDate = new Date();
-      nextFertilizeCareDate.setTime(lastFertilizeDate.getTime() + plant.fertilizingFrequency * 24 * 60 * 60 * 1000);
-    }
-
-    let nextMoistCareDate: Date | null = null;
-    if (lastMoistDate) {
-      nextMoistCareDate = new Date();
-      nextMoistCareDate.setTime(lastMoistDate.getTime() + 1 * 24 * 60 * 60 * 1000);
+  private post(formData: FormData): Observable<Plant> {
+    return this.http.post<Plant>(this.getUrlBase() + this.plantsApiUrl, formData, this.httpOptionsNonJson);
+  }
+  /**
+   * edit a plant, only if it's still at the version it was loaded at.
+   */
+  private put(formData: FormData, version?: number): Observable<Plant> {
+    const headers = version ? this.httpOptionsNonJson.headers.set('If-Match', `"${version}"`) : this.httpOptionsNonJson.headers;
+    return this.http.put<Plant>(this.getUrlBase() + this.plantsApiUrl, formData, { ...this.httpOptionsNonJson, headers: headers });
+  }
+  /**
+   * get one page of plants matching the filters, soonest care first.
+   * @param cursor where the page starts, empty for the first page.
+   */
+  private get(cursor: string): Observable<PlantPage> {
+    let params = new HttpParams()
+      .set('limit', this.pageSize)
+      .set('include', 'logs,comments')
+      .set('sort', 'nextCare')
+      .set('visibility', this.filters.visibility)
+    if (this.filters.name) {
+      params = params.set('name', this.filters.name)
     }
-
-    let careDates = [nextWaterCareDate.getTime()];
-    if (nextFertilizeCareDate) {
-      careDates.push(nextFertilizeCareDate.getTime());
+    this.filters.tags.forEach(tag => params = params.append('tag', tag))
+    this.filters.owners.forEach(owner => params = params.append('owner', owner))
+    if (this.filters.needsCare) {
+      params = params.set('needsCare', 'true')
     }
-    if (nextMoistCareDate) {
-      careDates.push(nextMoistCareDate.getTime());
+    if (cursor) {
+      params = params.set('cursor', cursor)
     }
-
-    let earliestCareDate = new Date(Math.min(...careDates));
-
-    // Calculate the difference in days between the future date and the current date
-    let diffInTime = earliestCareDate.getTime() - new Date().getTime();
-    let diffInDays = diffInTime / (1000 * 3600 * 24);
-
-    return diffInDays;
-  }
-  private post(formData: FormData): Observable<Plant[]> {
-    return this.http.post<Plant[]>(this.getUrlBase() + this.plantsApiUrl, formData, this.httpOptionsNonJson);
-  }
-  private put(formData: FormData): Observable<Plant[]> {
-    return this.http.put<Plant[]>(this.getUrlBase() + this.plantsApiUrl, formData, this.httpOptionsNonJson);
+    return this.http.get<PlantPage>(this.getUrlBase() + this.plantsApiUrl, { ...this.httpOptions, params: params });
   }
-  private get(): Observable<Plant[]> {
-    return this.http.get<Plant[]>(
-      this.getUrlBase() + this.plantsApiUrl,
-      this.httpOptions
-    );
+  private postAction(id: number, action: string): Observable<Plant> {
+    return this.http.post<Plant>(
+      this.getUrlBase() + this.plantsApiUrl + "/" + id + "/actions",
+      { action: action },
+      this.httpOptions);
   }
-  private delete(id: number): Observable<Plant[]> {
-    return this.http.delete<Plant[]>(
+  private delete(id: number): Observable<HttpResponse> {
+    return this.http.delete<HttpResponse>(
       this.getUrlBase() + this.plantsApiUrl + "/" + id,
       this.httpOptions);
   }
-  private getImage(id: number): Observable<any> {
-    return this.http.get(this.getUrlBase() + this.imagesApiUrl + '/' + id, { responseType: 'blob', headers: { 'Access-Control-Allow-Origin': '*' } })
-  }
-
-  /**
-   * get a list of plants that are mine.
-   * @returns a list of plants where the username matches the username of the authenticated user
-   */
-  public getPlantsForMode(mode: string): Observable<Plant[]> {
-    console.log(`mode=${mode}`)
-    if (mode !== "public") {
-      return this.plants$.pipe(
-        map(plants => plants.filter(plant => plant.username === this.authenticationService.username))
-      );
-    }
-    else {
-
-      return this.plants$.pipe(
-        map(plants => plants.filter(plant => plant.isPublic))
-      );
-    }
+  private getImage(id: number, size: string): Observable<any> {
+    return this.http.get(this.getUrlBase() + this.imagesApiUrl + '/' + id, { params: { size: size }, responseType: 'blob', headers: { 'Access-Control-Allow-Origin': '*' } })
   }
 }
@@ -0,0 +1,43 @@
+import { TestBed } from '@angular/core/testing';
+import { HttpClientTestingModule, HttpTestingController } from '@angular/common/http/testing';
+import { SittingService } from './sitting.service';
+import { SitterGrant } from '../models/sitter-grant.model';
+
+describe('SittingService', () => {
+	let service: SittingService;
+	let httpMock: HttpTestingController;
+
+	beforeEach(() => {
+		TestBed.configureTestingModule({
+			imports: [HttpClientTestingModule],
+			providers: [SittingService]
+		});
+
+		service = TestBed.inject(SittingService);
+		httpMock = TestBed.inject(HttpTestingController);
+	});
+
+	afterEach(() => {
+		httpMock.verify(); // Ensure that there are no outstanding requests
+	});
+
+	it('should load and log care through a link', () => {
+		const plant: any = { ID: 2, name: 'fern' };
+		const grant = new SitterGrant(1, 1, 0, 'neighbour', '', null, [plant], '');
+
+		service.getGrantByToken('abc');
+
+		const req = httpMock.expectOne(service.getUrlBase() + service.sittingApiUrl + '/link/abc');
+		expect(req.request.method).toBe('GET');
+		req.flush(grant);
+		expect(service.grants$.value).toEqual([grant]);
+
+		service.logCare(grant, plant, 'watered', 'abc');
+
+		const care = httpMock.expectOne(service.getUrlBase() + service.sittingApiUrl + '/link/abc/care');
+		expect(care.request.method).toBe('POST');
+		expect(care.request.body).toEqual({ plantId: 2, kind: 'watered' });
+		care.flush({ ID: 2, name: 'fern', lastWaterDate: 'now' });
+		expect((service.grants$.value[0].plants[0] as any).lastWaterDate).toBe('now');
+	});
+});
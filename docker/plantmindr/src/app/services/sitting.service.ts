@@ -0,0 +1,71 @@
+import { Injectable } from '@angular/core';
+import { BehaviorSubject, Observable, finalize } from 'rxjs';
+import { HttpClient } from '@angular/common/http';
+
+import { Plant } from '../models/plant.model';
+import { SitterGrant } from '../models/sitter-grant.model';
+import { BaseService } from './base.service';
+
+@Injectable({
+  providedIn: 'root'
+})
+export class SittingService extends BaseService {
+
+  sittingApiUrl = '/api/sitting';
+
+  // plant-sitting access, from a link or given to the user's account
+  grants$: BehaviorSubject<SitterGrant[]> = new BehaviorSubject<SitterGrant[]>([])
+
+  constructor(private http: HttpClient) { super() }
+
+  /**
+   * load the access a plant-sitting link gives, which works without an account
+   * @param token the token from the link
+   */
+  public getGrantByToken(token: string): void {
+    this.isLoading$.next(true);
+    this.http.get(this.getUrlBase() + this.sittingApiUrl + '/link/' + encodeURIComponent(token), this.httpOptions).pipe(
+      finalize(() => {
+        this.isLoading$.next(false)
+      })
+    ).subscribe((grant: any) => this.grants$.next([grant]))
+  }
+
+  /**
+   * load the access given to the logged in user
+   */
+  public getGrants(): void {
+    this.isLoading$.next(true);
+    this.http.get(this.getUrlBase() + this.sittingApiUrl, this.httpOptions).pipe(
+      finalize(() => {
+        this.isLoading$.next(false)
+      })
+    ).subscribe((grants: any) => this.grants$.next(grants))
+  }
+
+  /**
+   * log care given to one of a grant's plants
+   * @param grant the access the care is logged under
+   * @param plant the plant cared for
+   * @param kind the care action, e.g. watered
+   * @param token the token of the link the grant was opened with, if any
+   */
+  public logCare(grant: SitterGrant, plant: Plant, kind: string, token?: string): void {
+    this.isLoading$.next(true);
+    this.postCare(grant, { plantId: plant.ID, kind: kind }, token).pipe(
+      finalize(() => {
+        this.isLoading$.next(false)
+      })
+    ).subscribe((updated: Plant) => {
+      grant.plants = grant.plants.map(p => p.ID == updated.ID ? updated : p)
+      this.grants$.next(this.grants$.value)
+    })
+  }
+
+  private postCare(grant: SitterGrant, event: any, token?: string): Observable<any> {
+    if (token) {
+      return this.http.post(this.getUrlBase() + this.sittingApiUrl + '/link/' + encodeURIComponent(token) + '/care', event, this.httpOptions)
+    }
+    return this.http.post(this.getUrlBase() + this.sittingApiUrl + '/' + grant.ID + '/care', event, this.httpOptions)
+  }
+}
@@ -14,3 +14,18 @@ export interface PlantLog {
   CreatedAt: string;
 }
 
+
+export interface PlantPage {
+  plants: any[];
+  nextCursor: string;
+}
+
+// filters for listing plants, applied by the backend
+export interface PlantFilters {
+  name: string;
+  tags: string[];
+  owners: string[];
+  needsCare: boolean;
+  // 'public', 'private' or 'mine'
+  visibility: string;
+}